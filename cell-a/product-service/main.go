@@ -1,53 +1,50 @@
 package main
 
 import (
-    "encoding/json"
     "log"
     "net/http"
-    "os"
     "sync"
     "time"
 
+    "cell-shared"
+    "cell-shared/config"
+    "cell-shared/openapi"
+    "cell-shared/server"
     "github.com/gorilla/mux"
     "github.com/google/uuid"
 )
 
-type Product struct {
-    ID          string    `json:"id"`
-    Name        string    `json:"name"`
-    Description string    `json:"description"`
-    Price       float64   `json:"price"`
-    Stock       int       `json:"stock"`
-    CellID      string    `json:"cell_id"`
-    CreatedAt   time.Time `json:"created_at"`
-}
-
 type ProductService struct {
     CellID   string
-    Products map[string]*Product
+    Products map[string]*shared.Product
     mutex    sync.RWMutex
     Port     string
-}
 
-func NewProductService() *ProductService {
-    return &ProductService{
-        CellID:   getEnv("CELL_ID", "cell-a"),
-        Products: make(map[string]*Product),
-        Port:     getEnv("PORT", "8012"),
-    }
+    server *server.Server
 }
 
-func getEnv(key, defaultValue string) string {
-    if value := os.Getenv(key); value != "" {
-        return value
-    }
-    return defaultValue
+func NewProductService() *ProductService {
+    s := &ProductService{
+        CellID:   config.Get("CELL_ID", "cell-a"),
+        Products: make(map[string]*shared.Product),
+        Port:     config.Get("PORT", "8012"),
+    }
+    s.server = server.New("product-service", s.CellID)
+    s.server.Readiness.Register("storage", true, server.LockCheck(&s.mutex))
+
+    s.server.Metrics.Register(s.server.Metrics.NewStoreCollector("product_stock", "Units in stock, by product.", []string{"product_id"}, func(report func(float64, ...string)) {
+        s.mutex.RLock()
+        defer s.mutex.RUnlock()
+        for _, product := range s.Products {
+            report(float64(product.Stock), product.ID)
+        }
+    }))
+    return s
 }
 
 func (s *ProductService) createProduct(w http.ResponseWriter, r *http.Request) {
-    var product Product
-    if err := json.NewDecoder(r.Body).Decode(&product); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+    var product shared.Product
+    if !openapi.DecodeBody(w, r, s.CellID, openapi.ProductCreate, &product) {
         return
     }
 
@@ -59,13 +56,7 @@ func (s *ProductService) createProduct(w http.ResponseWriter, r *http.Request) {
     product.CreatedAt = time.Now()
     s.Products[product.ID] = &product
 
-    w.Header().Set("Content-Type", "application/json")
-    w.WriteHeader(http.StatusCreated)
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "data":    product,
-        "cell_id": s.CellID,
-    })
+    shared.WriteData(w, http.StatusCreated, s.CellID, product)
 }
 
 func (s *ProductService) getProduct(w http.ResponseWriter, r *http.Request) {
@@ -76,51 +67,31 @@ func (s *ProductService) getProduct(w http.ResponseWriter, r *http.Request) {
     product, exists := s.Products[productID]
     s.mutex.RUnlock()
 
-    w.Header().Set("Content-Type", "application/json")
     if !exists {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]interface{}{
-            "success": false,
-            "error":   "Product not found",
-            "cell_id": s.CellID,
-        })
+        shared.WriteError(w, s.CellID, shared.ErrorNotFound, "Product not found")
         return
     }
 
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "data":    product,
-        "cell_id": s.CellID,
-    })
+    shared.WriteData(w, http.StatusOK, s.CellID, product)
 }
 
 func (s *ProductService) getAllProducts(w http.ResponseWriter, r *http.Request) {
     s.mutex.RLock()
-    products := make([]*Product, 0, len(s.Products))
+    products := make([]*shared.Product, 0, len(s.Products))
     for _, product := range s.Products {
         products = append(products, product)
     }
     s.mutex.RUnlock()
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "data":    products,
-        "cell_id": s.CellID,
-        "count":   len(products),
-    })
+    shared.WriteList(w, s.CellID, products, len(products))
 }
 
 func (s *ProductService) updateStock(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     productID := vars["id"]
     
-    var request struct {
-        Quantity int `json:"quantity"`
-    }
-    
-    if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+    var request shared.StockUpdate
+    if !openapi.DecodeBody(w, r, s.CellID, openapi.StockUpdate, &request) {
         return
     }
 
@@ -129,42 +100,26 @@ func (s *ProductService) updateStock(w http.ResponseWriter, r *http.Request) {
 
     product, exists := s.Products[productID]
     if !exists {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]interface{}{
-            "success": false,
-            "error":   "Product not found",
-            "cell_id": s.CellID,
-        })
+        shared.WriteError(w, s.CellID, shared.ErrorNotFound, "Product not found")
         return
     }
 
     if product.Stock < request.Quantity {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]interface{}{
-            "success": false,
-            "error":   "Insufficient stock",
-            "cell_id": s.CellID,
-        })
+        shared.WriteError(w, s.CellID, shared.ErrorInsufficientStock, "Insufficient stock")
         return
     }
 
     product.Stock -= request.Quantity
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "data":    product,
-        "cell_id": s.CellID,
-    })
+    shared.WriteData(w, http.StatusOK, s.CellID, product)
 }
 
 func (s *ProductService) updateProduct(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     productID := vars["id"]
 
-    var updates Product
-    if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+    var updates shared.ProductUpdate
+    if !openapi.DecodeBody(w, r, s.CellID, openapi.ProductUpdate, &updates) {
         return
     }
 
@@ -173,34 +128,24 @@ func (s *ProductService) updateProduct(w http.ResponseWriter, r *http.Request) {
 
     product, exists := s.Products[productID]
     if !exists {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]interface{}{
-            "success": false,
-            "error":   "Product not found",
-            "cell_id": s.CellID,
-        })
+        shared.WriteError(w, s.CellID, shared.ErrorNotFound, "Product not found")
         return
     }
 
-    if updates.Name != "" {
-        product.Name = updates.Name
+    if updates.Name != nil {
+        product.Name = *updates.Name
     }
-    if updates.Description != "" {
-        product.Description = updates.Description
+    if updates.Description != nil {
+        product.Description = *updates.Description
     }
-    if updates.Price > 0 {
-        product.Price = updates.Price
+    if updates.Price != nil {
+        product.Price = *updates.Price
     }
-    if updates.Stock >= 0 {
-        product.Stock = updates.Stock
+    if updates.Stock != nil {
+        product.Stock = *updates.Stock
     }
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "data":    product,
-        "cell_id": s.CellID,
-    })
+    shared.WriteData(w, http.StatusOK, s.CellID, product)
 }
 
 func (s *ProductService) deleteProduct(w http.ResponseWriter, r *http.Request) {
@@ -211,51 +156,35 @@ func (s *ProductService) deleteProduct(w http.ResponseWriter, r *http.Request) {
     defer s.mutex.Unlock()
 
     if _, exists := s.Products[productID]; !exists {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]interface{}{
-            "success": false,
-            "error":   "Product not found",
-            "cell_id": s.CellID,
-        })
+        shared.WriteError(w, s.CellID, shared.ErrorNotFound, "Product not found")
         return
     }
 
     delete(s.Products, productID)
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "message": "Product deleted successfully",
-        "cell_id": s.CellID,
-    })
+    shared.WriteMessage(w, http.StatusOK, s.CellID, "Product deleted successfully")
 }
 
-func (s *ProductService) healthCheck(w http.ResponseWriter, r *http.Request) {
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "status":        "healthy",
-        "service":       "product-service",
-        "cell_id":       s.CellID,
-        "product_count": len(s.Products),
-        "timestamp":     time.Now(),
-        "version":       "1.0.0",
-    })
+// healthDetails adds the product count to /health
+func (s *ProductService) healthDetails() map[string]interface{} {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+    return map[string]interface{}{"product_count": len(s.Products)}
 }
 
 func main() {
     service := NewProductService()
     
-    r := mux.NewRouter()
-    
-    r.HandleFunc("/health", service.healthCheck).Methods("GET")
-    r.HandleFunc("/readiness", service.healthCheck).Methods("GET")
-    r.HandleFunc("/products", service.createProduct).Methods("POST")
-    r.HandleFunc("/products", service.getAllProducts).Methods("GET")
-    r.HandleFunc("/products/{id}", service.getProduct).Methods("GET")
-    r.HandleFunc("/products/{id}", service.updateProduct).Methods("PUT")
-    r.HandleFunc("/products/{id}", service.deleteProduct).Methods("DELETE")
-    r.HandleFunc("/products/{id}/stock", service.updateStock).Methods("PUT")
+    api := service.server
+    api.HandleHealth(service.healthDetails)
+    api.Route(openapi.Operation{ID: "createProduct", Method: "POST", Path: "/products", Summary: "Create a product", Request: openapi.ProductCreate, Response: openapi.Data("Product"), Status: http.StatusCreated}, service.createProduct)
+    api.Route(openapi.Operation{ID: "listProducts", Method: "GET", Path: "/products", Summary: "List products", Response: openapi.List("Product")}, service.getAllProducts)
+    api.Route(openapi.Operation{ID: "getProduct", Method: "GET", Path: "/products/{id}", Summary: "Get a product", Response: openapi.Data("Product")}, service.getProduct)
+    api.Route(openapi.Operation{ID: "updateProduct", Method: "PUT", Path: "/products/{id}", Summary: "Update a product", Request: openapi.ProductUpdate, Response: openapi.Data("Product")}, service.updateProduct)
+    api.Route(openapi.Operation{ID: "deleteProduct", Method: "DELETE", Path: "/products/{id}", Summary: "Delete a product", Response: openapi.Message()}, service.deleteProduct)
+    api.Route(openapi.Operation{ID: "reserveStock", Method: "PUT", Path: "/products/{id}/stock", Summary: "Take units out of stock; 400 when there are not enough", Request: openapi.StockUpdate, Response: openapi.Data("Product")}, service.updateStock)
     
     log.Printf("Cell A Product Service starting on port %s", service.Port)
-    log.Fatal(http.ListenAndServe(":"+service.Port, r))
+    service.server.Readiness.MarkWarm()
+    service.server.Run(service.Port)
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+    "crypto/rsa"
+    "log"
+    "net/http"
+    "time"
+
+    "cell-shared"
+    "cell-shared/auth"
+    "cell-shared/config"
+    "cell-shared/openapi"
+)
+
+// refreshSession is a refresh token that has not been used or revoked yet
+type refreshSession struct {
+    UserID    string
+    ExpiresAt time.Time
+}
+
+// Authenticator holds the credentials and refresh tokens of users who
+// registered with a password. Its maps are guarded by the UserService mutex.
+type Authenticator struct {
+    signer     *auth.Signer
+    passwords  *auth.Passwords
+    refreshTTL time.Duration
+
+    hashes   map[string][]byte         // user ID -> bcrypt hash
+    roles    map[string][]string       // user ID -> roles beyond a plain user's
+    sessions map[string]refreshSession // refresh token hash -> session
+    pruneAt  int
+}
+
+// NewAuthenticator signs with the key in JWT_SIGNING_KEY_FILE. Only in dev
+// mode may it be unset, when a generated key is used instead: replicas would
+// otherwise each sign with their own key and reject each other's tokens.
+func NewAuthenticator() *Authenticator {
+    var key *rsa.PrivateKey
+    var err error
+    if path := config.Get("JWT_SIGNING_KEY_FILE", ""); path != "" {
+        key, err = auth.LoadKey(path)
+    } else if !config.DevMode() {
+        log.Fatalf("JWT_SIGNING_KEY_FILE is not set; mount a signing key shared by every replica, or set DEV_MODE=true to sign with a generated one")
+    } else {
+        log.Printf("JWT_SIGNING_KEY_FILE is not set; tokens are signed with a generated key that does not survive a restart or match other replicas")
+        key, err = auth.GenerateKey()
+    }
+    if err != nil {
+        log.Fatalf("Loading JWT signing key: %v", err)
+    }
+
+    return &Authenticator{
+        signer:     auth.NewSigner(key, config.Get("JWT_ISSUER", "user-service"), config.Duration("ACCESS_TOKEN_TTL", 15*time.Minute)),
+        passwords:  auth.NewPasswords(int(config.Int64("BCRYPT_COST", 10))),
+        refreshTTL: config.Duration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+        hashes:     make(map[string][]byte),
+        roles:      make(map[string][]string),
+        sessions:   make(map[string]refreshSession),
+        pruneAt:    1024,
+    }
+}
+
+// seedAdmin creates the account given by ADMIN_EMAIL and ADMIN_PASSWORD with
+// the admin role. It is the only way to get the role, so registering cannot
+// grant it.
+func (s *UserService) seedAdmin() {
+    email, password := config.Get("ADMIN_EMAIL", ""), config.Get("ADMIN_PASSWORD", "")
+    if email == "" || password == "" {
+        return
+    }
+    hash, err := s.auth.passwords.Hash(password)
+    if err != nil {
+        log.Fatalf("Hashing ADMIN_PASSWORD: %v", err)
+    }
+
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    user := &shared.User{Name: "Administrator", Email: email}
+    s.insertUser(user)
+    s.auth.hashes[user.ID] = hash
+    s.auth.roles[user.ID] = []string{auth.RoleAdmin}
+    log.Printf("Created admin account %s", email)
+}
+
+// writeUnauthorized answers a login or refresh that could not be honoured.
+// The message never says whether the email exists.
+func (s *UserService) writeUnauthorized(w http.ResponseWriter, message string) {
+    shared.WriteError(w, s.CellID, shared.ErrorUnauthorized, message)
+}
+
+// register creates a user who can log in with a password
+func (s *UserService) register(w http.ResponseWriter, r *http.Request) {
+    var registration shared.Registration
+    if !openapi.DecodeBody(w, r, s.CellID, openapi.Registration, &registration) {
+        return
+    }
+    if len(registration.Password) > auth.MaxPasswordBytes {
+        shared.WriteInvalid(w, s.CellID, []shared.FieldError{{Field: "password", Message: "must be at most 72 bytes"}})
+        return
+    }
+
+    // Hashing is deliberately slow, so it happens outside the lock
+    hash, err := s.auth.passwords.Hash(registration.Password)
+    if err != nil {
+        shared.WriteError(w, s.CellID, shared.ErrorInternal, "Could not hash password")
+        return
+    }
+
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    user := &shared.User{Name: registration.Name, Email: registration.Email}
+    if !s.insertUser(user) {
+        s.writeEmailTaken(w)
+        return
+    }
+    s.auth.hashes[user.ID] = hash
+
+    shared.WriteData(w, http.StatusCreated, s.CellID, user)
+}
+
+// login trades an email and password for tokens
+func (s *UserService) login(w http.ResponseWriter, r *http.Request) {
+    var credentials shared.Credentials
+    if !openapi.DecodeBody(w, r, s.CellID, openapi.Credentials, &credentials) {
+        return
+    }
+
+    s.mutex.RLock()
+    var user shared.User
+    var hash []byte
+    var roles []string
+    if id, ok := s.byEmail[normalizeEmail(credentials.Email)]; ok {
+        user, hash, roles = *s.Users[id], s.auth.hashes[id], s.auth.roles[id]
+    }
+    s.mutex.RUnlock()
+
+    if !s.auth.passwords.Check(hash, credentials.Password) {
+        s.writeUnauthorized(w, "Invalid email or password")
+        return
+    }
+    s.issueTokens(w, &user, roles)
+}
+
+// refresh trades a refresh token for new tokens. Each refresh token works
+// once; the answer carries its replacement.
+func (s *UserService) refresh(w http.ResponseWriter, r *http.Request) {
+    var request shared.RefreshRequest
+    if !openapi.DecodeBody(w, r, s.CellID, openapi.RefreshRequest, &request) {
+        return
+    }
+
+    s.mutex.Lock()
+    key := auth.HashRefreshToken(request.RefreshToken)
+    session, ok := s.auth.sessions[key]
+    delete(s.auth.sessions, key)
+    user, exists := s.Users[session.UserID]
+    var current shared.User
+    if exists {
+        current = *user
+    }
+    roles := s.auth.roles[session.UserID]
+    s.mutex.Unlock()
+
+    if !ok || !exists || time.Now().After(session.ExpiresAt) {
+        s.writeUnauthorized(w, "Refresh token is invalid or expired")
+        return
+    }
+    s.issueTokens(w, &current, roles)
+}
+
+// logout revokes a refresh token. It succeeds for unknown tokens too, so it
+// can be retried.
+func (s *UserService) logout(w http.ResponseWriter, r *http.Request) {
+    var request shared.RefreshRequest
+    if !openapi.DecodeBody(w, r, s.CellID, openapi.RefreshRequest, &request) {
+        return
+    }
+
+    s.mutex.Lock()
+    delete(s.auth.sessions, auth.HashRefreshToken(request.RefreshToken))
+    s.mutex.Unlock()
+
+    shared.WriteMessage(w, http.StatusOK, s.CellID, "Logged out")
+}
+
+// issueTokens answers with a new access token and refresh token for user
+func (s *UserService) issueTokens(w http.ResponseWriter, user *shared.User, roles []string) {
+    access, err := s.auth.signer.Issue(user.ID, user.CellID, user.Email, roles)
+    if err != nil {
+        shared.WriteError(w, s.CellID, shared.ErrorInternal, "Could not sign access token")
+        return
+    }
+    refresh, key, err := auth.NewRefreshToken()
+    if err != nil {
+        shared.WriteError(w, s.CellID, shared.ErrorInternal, "Could not create refresh token")
+        return
+    }
+
+    s.mutex.Lock()
+    s.auth.sessions[key] = refreshSession{UserID: user.ID, ExpiresAt: time.Now().Add(s.auth.refreshTTL)}
+    s.auth.pruneExpired()
+    s.mutex.Unlock()
+
+    w.Header().Set("Cache-Control", "no-store")
+    shared.WriteData(w, http.StatusOK, s.CellID, shared.Tokens{
+        AccessToken:      access,
+        TokenType:        "Bearer",
+        ExpiresIn:        int(s.auth.signer.TTL().Seconds()),
+        RefreshToken:     refresh,
+        RefreshExpiresIn: int(s.auth.refreshTTL.Seconds()),
+    })
+}
+
+// pruneExpired drops expired sessions whenever their number has doubled
+// since the last pass, which keeps the cost per login constant on average
+func (a *Authenticator) pruneExpired() {
+    if len(a.sessions) < a.pruneAt {
+        return
+    }
+    now := time.Now()
+    for key, session := range a.sessions {
+        if now.After(session.ExpiresAt) {
+            delete(a.sessions, key)
+        }
+    }
+    a.pruneAt = 2*len(a.sessions) + 1024
+}
+
+// forget removes the password, roles and every session of a deleted user
+func (a *Authenticator) forget(userID string) {
+    delete(a.hashes, userID)
+    delete(a.roles, userID)
+    for key, session := range a.sessions {
+        if session.UserID == userID {
+            delete(a.sessions, key)
+        }
+    }
+}
+
+// jwks publishes the key access tokens are signed with
+func (s *UserService) jwks(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Cache-Control", "public, max-age=300")
+    shared.WriteJSON(w, http.StatusOK, s.auth.signer.JWKS())
+}
@@ -1,72 +1,103 @@
 package main
 
 import (
-    "encoding/json"
     "log"
     "net/http"
-    "os"
+    "strings"
     "sync"
     "time"
 
+    "cell-shared"
+    "cell-shared/auth"
+    "cell-shared/config"
+    "cell-shared/openapi"
+    "cell-shared/server"
     "github.com/gorilla/mux"
     "github.com/google/uuid"
 )
 
-type User struct {
-    ID        string    `json:"id"`
-    Name      string    `json:"name"`
-    Email     string    `json:"email"`
-    CellID    string    `json:"cell_id"`
-    CreatedAt time.Time `json:"created_at"`
-}
-
 type UserService struct {
-    CellID string
-    Users  map[string]*User
-    mutex  sync.RWMutex
-    Port   string
+    CellID  string
+    Users   map[string]*shared.User
+    byEmail map[string]string // normalized email -> user ID
+    auth    *Authenticator
+    mutex   sync.RWMutex
+    Port    string
+
+    server *server.Server
 }
 
 func NewUserService() *UserService {
-    return &UserService{
-        CellID: getEnv("CELL_ID", "cell-a"),
-        Users:  make(map[string]*User),
-        Port:   getEnv("PORT", "8011"),
+    s := &UserService{
+        CellID:  config.Get("CELL_ID", "cell-a"),
+        Users:   make(map[string]*shared.User),
+        byEmail: make(map[string]string),
+        auth:    NewAuthenticator(),
+        Port:    config.Get("PORT", "8011"),
     }
+    s.server = server.New("user-service", s.CellID)
+    s.server.Readiness.Register("storage", true, server.LockCheck(&s.mutex))
+    s.server.Metrics.Register(s.server.Metrics.NewStoreCollector("user_count", "Users currently stored.", nil, func(report func(float64, ...string)) {
+        s.mutex.RLock()
+        defer s.mutex.RUnlock()
+        report(float64(len(s.Users)))
+    }))
+    return s
 }
 
-func getEnv(key, defaultValue string) string {
-    if value := os.Getenv(key); value != "" {
-        return value
-    }
-    return defaultValue
+// normalizeEmail is the form emails are indexed and compared in, so
+// Ada@Example.com and ada@example.com are the same address
+func normalizeEmail(email string) string {
+    return strings.ToLower(strings.TrimSpace(email))
+}
+
+// writeEmailTaken answers a create or update that would give two users the
+// same email
+func (s *UserService) writeEmailTaken(w http.ResponseWriter) {
+    e := shared.NewError(shared.ErrorConflict, "Email already in use")
+    e.Details = []shared.FieldError{{Field: "email", Message: "is already in use"}}
+    shared.WriteFailure(w, s.CellID, e)
 }
 
 func (s *UserService) createUser(w http.ResponseWriter, r *http.Request) {
-    var user User
-    if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+    var user shared.User
+    if !openapi.DecodeBody(w, r, s.CellID, openapi.UserCreate, &user) {
         return
     }
 
     s.mutex.Lock()
     defer s.mutex.Unlock()
 
+    if !s.insertUser(&user) {
+        s.writeEmailTaken(w)
+        return
+    }
+
+    shared.WriteData(w, http.StatusCreated, s.CellID, user)
+}
+
+// insertUser assigns the new user an ID and stores it, unless another user
+// has the email already. The caller holds the write lock.
+func (s *UserService) insertUser(user *shared.User) bool {
+    email := normalizeEmail(user.Email)
+    if _, taken := s.byEmail[email]; taken {
+        return false
+    }
+
     user.ID = uuid.New().String()
     user.CellID = s.CellID
     user.CreatedAt = time.Now()
-    s.Users[user.ID] = &user
-
-    w.Header().Set("Content-Type", "application/json")
-    w.WriteHeader(http.StatusCreated)
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "data":    user,
-        "cell_id": s.CellID,
-    })
+    s.Users[user.ID] = user
+    s.byEmail[email] = user.ID
+    return true
 }
 
+// getUser returns the caller's own record, or any record for an admin
 func (s *UserService) getUser(w http.ResponseWriter, r *http.Request) {
+    caller := auth.Caller(w, r, s.CellID)
+    if caller == nil {
+        return
+    }
     vars := mux.Vars(r)
     userID := vars["id"]
 
@@ -74,48 +105,59 @@ func (s *UserService) getUser(w http.ResponseWriter, r *http.Request) {
     user, exists := s.Users[userID]
     s.mutex.RUnlock()
 
-    w.Header().Set("Content-Type", "application/json")
-    if !exists {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]interface{}{
-            "success": false,
-            "error":   "User not found",
-            "cell_id": s.CellID,
-        })
+    // Other users' records are hidden rather than forbidden, so their IDs
+    // cannot be probed
+    if !exists || !caller.CanAccess(userID) {
+        shared.WriteError(w, s.CellID, shared.ErrorNotFound, "User not found")
         return
     }
 
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "data":    user,
-        "cell_id": s.CellID,
-    })
+    shared.WriteData(w, http.StatusOK, s.CellID, user)
 }
 
+// getAllUsers lists every user, or with ?email= the one user with that
+// email, if any
 func (s *UserService) getAllUsers(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+    if query.Has("email") {
+        email := normalizeEmail(query.Get("email"))
+        if email == "" {
+            shared.WriteInvalid(w, s.CellID, []shared.FieldError{{Field: "email", Message: "must not be empty"}})
+            return
+        }
+
+        s.mutex.RLock()
+        users := []*shared.User{}
+        if id, ok := s.byEmail[email]; ok {
+            users = append(users, s.Users[id])
+        }
+        s.mutex.RUnlock()
+
+        shared.WriteList(w, s.CellID, users, len(users))
+        return
+    }
+
     s.mutex.RLock()
-    users := make([]*User, 0, len(s.Users))
+    users := make([]*shared.User, 0, len(s.Users))
     for _, user := range s.Users {
         users = append(users, user)
     }
     s.mutex.RUnlock()
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "data":    users,
-        "cell_id": s.CellID,
-        "count":   len(users),
-    })
+    shared.WriteList(w, s.CellID, users, len(users))
 }
 
+// updateUser changes the caller's own record, or any record for an admin
 func (s *UserService) updateUser(w http.ResponseWriter, r *http.Request) {
+    caller := auth.Caller(w, r, s.CellID)
+    if caller == nil {
+        return
+    }
     vars := mux.Vars(r)
     userID := vars["id"]
 
-    var updates User
-    if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+    var updates shared.UserUpdate
+    if !openapi.DecodeBody(w, r, s.CellID, openapi.UserUpdate, &updates) {
         return
     }
 
@@ -123,83 +165,91 @@ func (s *UserService) updateUser(w http.ResponseWriter, r *http.Request) {
     defer s.mutex.Unlock()
 
     user, exists := s.Users[userID]
-    if !exists {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]interface{}{
-            "success": false,
-            "error":   "User not found",
-            "cell_id": s.CellID,
-        })
+    if !exists || !caller.CanAccess(userID) {
+        shared.WriteError(w, s.CellID, shared.ErrorNotFound, "User not found")
         return
     }
 
-    if updates.Name != "" {
-        user.Name = updates.Name
+    if updates.Email != nil {
+        oldEmail, newEmail := normalizeEmail(user.Email), normalizeEmail(*updates.Email)
+        if newEmail != oldEmail {
+            if _, taken := s.byEmail[newEmail]; taken {
+                s.writeEmailTaken(w)
+                return
+            }
+            delete(s.byEmail, oldEmail)
+            s.byEmail[newEmail] = user.ID
+        }
     }
-    if updates.Email != "" {
-        user.Email = updates.Email
+
+    if updates.Name != nil {
+        user.Name = *updates.Name
+    }
+    if updates.Email != nil {
+        user.Email = *updates.Email
     }
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "data":    user,
-        "cell_id": s.CellID,
-    })
+    shared.WriteData(w, http.StatusOK, s.CellID, user)
 }
 
+// deleteUser removes the caller's own record, or any record for an admin
 func (s *UserService) deleteUser(w http.ResponseWriter, r *http.Request) {
+    caller := auth.Caller(w, r, s.CellID)
+    if caller == nil {
+        return
+    }
     vars := mux.Vars(r)
     userID := vars["id"]
 
     s.mutex.Lock()
     defer s.mutex.Unlock()
 
-    if _, exists := s.Users[userID]; !exists {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]interface{}{
-            "success": false,
-            "error":   "User not found",
-            "cell_id": s.CellID,
-        })
+    user, exists := s.Users[userID]
+    if !exists || !caller.CanAccess(userID) {
+        shared.WriteError(w, s.CellID, shared.ErrorNotFound, "User not found")
         return
     }
 
     delete(s.Users, userID)
+    delete(s.byEmail, normalizeEmail(user.Email))
+    s.auth.forget(userID)
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "message": "User deleted successfully",
-        "cell_id": s.CellID,
-    })
+    shared.WriteMessage(w, http.StatusOK, s.CellID, "User deleted successfully")
 }
 
-func (s *UserService) healthCheck(w http.ResponseWriter, r *http.Request) {
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "status":     "healthy",
-        "service":    "user-service",
-        "cell_id":    s.CellID,
-        "user_count": len(s.Users),
-        "timestamp":  time.Now(),
-        "version":    "1.0.0",
-    })
+// healthDetails adds the user count to /health
+func (s *UserService) healthDetails() map[string]interface{} {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+    return map[string]interface{}{"user_count": len(s.Users)}
 }
 
+var (
+    emailConflict  = map[int]string{http.StatusConflict: "Another user already has the email"}
+    badCredentials = map[int]string{http.StatusUnauthorized: "The email or password is wrong"}
+    badRefresh     = map[int]string{http.StatusUnauthorized: "The refresh token is unknown, already used or expired"}
+)
+
 func main() {
     service := NewUserService()
+    service.seedAdmin()
     
-    r := mux.NewRouter()
-    
-    r.HandleFunc("/health", service.healthCheck).Methods("GET")
-    r.HandleFunc("/readiness", service.healthCheck).Methods("GET")
-    r.HandleFunc("/users", service.createUser).Methods("POST")
-    r.HandleFunc("/users", service.getAllUsers).Methods("GET")
-    r.HandleFunc("/users/{id}", service.getUser).Methods("GET")
-    r.HandleFunc("/users/{id}", service.updateUser).Methods("PUT")
-    r.HandleFunc("/users/{id}", service.deleteUser).Methods("DELETE")
+    api := service.server
+    api.HandleHealth(service.healthDetails)
+    api.Route(openapi.Operation{ID: "createUser", Method: "POST", Path: "/users", Summary: "Create a user", Request: openapi.UserCreate, Response: openapi.Data("User"), Status: http.StatusCreated, Errors: emailConflict}, service.createUser)
+    api.Route(openapi.Operation{ID: "listUsers", Method: "GET", Path: "/users", Summary: "List users, or find one by email", Response: openapi.List("User"), Query: []openapi.Parameter{
+        {Name: "email", Description: "Only the user with this email, compared case-insensitively", Schema: &openapi.Schema{Type: "string", Format: "email"}},
+    }}, service.getAllUsers)
+    api.Route(openapi.Operation{ID: "getUser", Method: "GET", Path: "/users/{id}", Summary: "Get a user", Response: openapi.Data("User")}, service.getUser)
+    api.Route(openapi.Operation{ID: "updateUser", Method: "PUT", Path: "/users/{id}", Summary: "Update a user's name or email", Request: openapi.UserUpdate, Response: openapi.Data("User"), Errors: emailConflict}, service.updateUser)
+    api.Route(openapi.Operation{ID: "deleteUser", Method: "DELETE", Path: "/users/{id}", Summary: "Delete a user", Response: openapi.Message()}, service.deleteUser)
+    api.Route(openapi.Operation{ID: "register", Method: "POST", Path: "/auth/register", Summary: "Create a user who logs in with a password", Request: openapi.Registration, Response: openapi.Data("User"), Status: http.StatusCreated, Errors: emailConflict}, service.register)
+    api.Route(openapi.Operation{ID: "login", Method: "POST", Path: "/auth/login", Summary: "Trade an email and password for tokens", Request: openapi.Credentials, Response: openapi.Data("Tokens"), Errors: badCredentials}, service.login)
+    api.Route(openapi.Operation{ID: "refreshTokens", Method: "POST", Path: "/auth/refresh", Summary: "Trade a refresh token for new tokens", Request: openapi.RefreshRequest, Response: openapi.Data("Tokens"), Errors: badRefresh}, service.refresh)
+    api.Route(openapi.Operation{ID: "logout", Method: "POST", Path: "/auth/logout", Summary: "Revoke a refresh token", Request: openapi.RefreshRequest, Response: openapi.Message()}, service.logout)
+    api.Route(openapi.Operation{ID: "getJWKS", Method: "GET", Path: "/.well-known/jwks.json", Summary: "Keys that verify access tokens, as a bare JWKS", Response: openapi.Ref("JWKS")}, service.jwks)
     
     log.Printf("Cell A User Service starting on port %s", service.Port)
-    log.Fatal(http.ListenAndServe(":"+service.Port, r))
-}
\ No newline at end of file
+    service.server.Readiness.MarkWarm()
+    service.server.Run(service.Port)
+}
@@ -1,66 +1,127 @@
 package main
 
 import (
-    "bytes"
-    "encoding/json"
-    "fmt"
     "log"
     "net/http"
-    "os"
     "sync"
     "time"
 
+    "cell-shared"
+    "cell-shared/auth"
+    "cell-shared/client"
+    "cell-shared/config"
+    "cell-shared/logging"
+    "cell-shared/openapi"
+    "cell-shared/server"
     "github.com/gorilla/mux"
     "github.com/google/uuid"
 )
 
-type Order struct {
-    ID        string    `json:"id"`
-    UserID    string    `json:"user_id"`
-    ProductID string    `json:"product_id"`
-    Quantity  int       `json:"quantity"`
-    Total     float64   `json:"total"`
-    Status    string    `json:"status"`
-    CreatedAt time.Time `json:"created_at"`
-    CellID    string    `json:"cell_id"`
-}
-
 type OrderService struct {
     CellID            string
-    Orders            map[string]*Order
+    Orders            map[string]*shared.Order
     mutex             sync.RWMutex
     Port              string
     CellAGatewayURL   string
+    CellAGatewayHost  string
     PaymentServiceURL string
+    cellA             *client.Client
+    users             *UserCache
+
+    server *server.Server
 }
 
 func NewOrderService() *OrderService {
-    return &OrderService{
-        CellID:            getEnv("CELL_ID", "cell-b"),
-        Orders:            make(map[string]*Order),
-        Port:              getEnv("PORT", "8021"),
-        CellAGatewayURL:   getEnv("CELL_A_GATEWAY_URL", "http://cell-a-gateway:8010"),
-        PaymentServiceURL: getEnv("PAYMENT_SERVICE_URL", "http://cell-b-payment-service:8022"),
+    s := &OrderService{
+        CellID:            config.Get("CELL_ID", "cell-b"),
+        Orders:            make(map[string]*shared.Order),
+        Port:              config.Get("PORT", "8021"),
+        CellAGatewayURL:   config.Get("CELL_A_GATEWAY_URL", "http://cell-a-gateway:8010"),
+        CellAGatewayHost:  config.Get("CELL_A_GATEWAY_HOST", ""),
+        PaymentServiceURL: config.Get("PAYMENT_SERVICE_URL", "http://cell-b-payment-service:8022"),
     }
+    s.server = server.New("order-service", s.CellID)
+    s.cellA = client.New(s.CellAGatewayURL,
+        client.WithHTTPClient(server.NewClient(config.Duration("UPSTREAM_TIMEOUT", 30*time.Second))),
+        client.WithHost(s.CellAGatewayHost),
+        client.WithRetry(int(config.Int64("UPSTREAM_RETRY_ATTEMPTS", 2)), 100*time.Millisecond),
+    )
+    s.users = NewUserCache(s.cellA.Users, config.Duration("USER_CACHE_TTL", 30*time.Second))
+    s.server.Readiness.Register("storage", true, server.LockCheck(&s.mutex))
+    // Orders can still be read while Cell A is away, so the cross-cell
+    // dependency only fails readiness when explicitly asked to
+    s.server.Readiness.Register("cell-a-gateway", config.Bool("READINESS_UPSTREAMS_CRITICAL", false), server.UpstreamCheck(s.CellAGatewayURL, s.CellAGatewayHost))
+
+    s.server.Metrics.Register(s.server.Metrics.NewStoreCollector("orders_by_status", "Orders currently stored, by status.", []string{"status"}, func(report func(float64, ...string)) {
+        s.mutex.RLock()
+        defer s.mutex.RUnlock()
+        counts := make(map[string]int)
+        for _, order := range s.Orders {
+            counts[order.Status]++
+        }
+        for status, count := range counts {
+            report(float64(count), status)
+        }
+    }))
+    return s
 }
 
-func getEnv(key, defaultValue string) string {
-    if value := os.Getenv(key); value != "" {
-        return value
+func (s *OrderService) createOrder(w http.ResponseWriter, r *http.Request) {
+    caller := auth.Caller(w, r, s.CellID)
+    if caller == nil {
+        return
+    }
+    var order shared.Order
+    if !openapi.DecodeBody(w, r, s.CellID, openapi.OrderCreate, &order) {
+        return
     }
-    return defaultValue
-}
 
-func (s *OrderService) createOrder(w http.ResponseWriter, r *http.Request) {
-    var order Order
-    if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+    // Orders belong to the caller unless an admin places one for someone else
+    if order.UserID == "" {
+        order.UserID = caller.UserID
+    }
+    if order.UserID == "" {
+        shared.WriteInvalid(w, s.CellID, []shared.FieldError{{Field: "user_id", Message: "is required"}})
         return
     }
+    if !caller.CanAccess(order.UserID) {
+        shared.WriteError(w, s.CellID, shared.ErrorForbidden, "Orders can only be placed for yourself")
+        return
+    }
+
+    // Validate user exists, before any stock is reserved for them
+    user, err := s.users.Get(r.Context(), order.UserID)
+    if err != nil {
+        if client.IsNotFound(err) {
+            e := shared.NewError(shared.ErrorInvalidRequest, "User not found")
+            e.Details = []shared.FieldError{{Field: "user_id", Message: "does not exist"}}
+            shared.WriteFailure(w, s.CellID, e)
+            return
+        }
+        logging.FromContext(r.Context()).Error("Error validating user", "user_id", order.UserID, "error", err)
+        shared.WriteFailure(w, s.CellID, client.UpstreamError("User service unavailable", "user-service", "cell-a", err))
+        return
+    }
+    order.User = user
 
     // Validate product exists and update stock
-    if !s.validateAndUpdateStock(order.ProductID, order.Quantity) {
-        http.Error(w, "Product not found or insufficient stock", http.StatusBadRequest)
+    if _, err := s.cellA.Products.ReserveStock(r.Context(), order.ProductID, order.Quantity); err != nil {
+        switch {
+        case client.IsNotFound(err):
+            e := shared.NewError(shared.ErrorInvalidRequest, "Product not found")
+            e.Details = []shared.FieldError{{Field: "product_id", Message: "does not exist"}}
+            shared.WriteFailure(w, s.CellID, e)
+        case client.IsRejected(err):
+            // Insufficient stock, passed on with the product service's code
+            e := shared.NewError(client.Code(err), "Product cannot be reserved")
+            if e.Code == "" {
+                e.Code = shared.ErrorInvalidRequest
+            }
+            shared.WriteFailure(w, s.CellID, e)
+        default:
+            logging.FromContext(r.Context()).Error("Error updating stock", "product_id", order.ProductID, "error", err)
+            shared.WriteFailure(w, s.CellID, client.UpstreamError("Product service unavailable", "product-service", "cell-a", err))
+        }
         return
     }
 
@@ -70,44 +131,17 @@ func (s *OrderService) createOrder(w http.ResponseWriter, r *http.Request) {
     order.ID = uuid.New().String()
     order.CellID = s.CellID
     order.CreatedAt = time.Now()
-    order.Status = "pending"
+    order.Status = shared.OrderStatusPending
     s.Orders[order.ID] = &order
 
-    w.Header().Set("Content-Type", "application/json")
-    w.WriteHeader(http.StatusCreated)
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "data":    order,
-        "cell_id": s.CellID,
-    })
-}
-
-func (s *OrderService) validateAndUpdateStock(productID string, quantity int) bool {
-    stockUpdate := map[string]int{"quantity": quantity}
-    jsonData, _ := json.Marshal(stockUpdate)
-    
-    req, err := http.NewRequest("PUT", fmt.Sprintf("%s/products/%s/stock", s.CellAGatewayURL, productID), bytes.NewBuffer(jsonData))
-    if err != nil {
-        log.Printf("Error creating request: %v", err)
-        return false
-    }
-    req.Header.Set("Content-Type", "application/json")
-    
-    client := &http.Client{}
-    resp, err := client.Do(req)
-    if err != nil {
-        log.Printf("Error updating stock: %v", err)
-        return false
-    }
-    
-    if err != nil || resp.StatusCode != http.StatusOK {
-        return false
-    }
-    
-    return true
+    shared.WriteData(w, http.StatusCreated, s.CellID, order)
 }
 
 func (s *OrderService) getOrder(w http.ResponseWriter, r *http.Request) {
+    caller := auth.Caller(w, r, s.CellID)
+    if caller == nil {
+        return
+    }
     vars := mux.Vars(r)
     orderID := vars["id"]
 
@@ -115,51 +149,41 @@ func (s *OrderService) getOrder(w http.ResponseWriter, r *http.Request) {
     order, exists := s.Orders[orderID]
     s.mutex.RUnlock()
 
-    w.Header().Set("Content-Type", "application/json")
-    if !exists {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]interface{}{
-            "success": false,
-            "error":   "Order not found",
-            "cell_id": s.CellID,
-        })
+    // Other users' orders are hidden rather than forbidden, so their IDs
+    // cannot be probed
+    if !exists || !caller.CanAccess(order.UserID) {
+        shared.WriteError(w, s.CellID, shared.ErrorNotFound, "Order not found")
         return
     }
 
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "data":    order,
-        "cell_id": s.CellID,
-    })
+    shared.WriteData(w, http.StatusOK, s.CellID, order)
 }
 
+// getAllOrders lists the caller's orders, or every order for an admin
 func (s *OrderService) getAllOrders(w http.ResponseWriter, r *http.Request) {
+    caller := auth.Caller(w, r, s.CellID)
+    if caller == nil {
+        return
+    }
+
     s.mutex.RLock()
-    orders := make([]*Order, 0, len(s.Orders))
+    orders := make([]*shared.Order, 0)
     for _, order := range s.Orders {
-        orders = append(orders, order)
+        if caller.CanAccess(order.UserID) {
+            orders = append(orders, order)
+        }
     }
     s.mutex.RUnlock()
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "data":    orders,
-        "cell_id": s.CellID,
-        "count":   len(orders),
-    })
+    shared.WriteList(w, s.CellID, orders, len(orders))
 }
 
 func (s *OrderService) updateOrderStatus(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     orderID := vars["id"]
     
-    var request struct {
-        Status string `json:"status"`
-    }
-    
-    if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+    var request shared.OrderStatusUpdate
+    if !openapi.DecodeBody(w, r, s.CellID, openapi.OrderStatusUpdate, &request) {
         return
     }
 
@@ -168,23 +192,13 @@ func (s *OrderService) updateOrderStatus(w http.ResponseWriter, r *http.Request)
 
     order, exists := s.Orders[orderID]
     if !exists {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]interface{}{
-            "success": false,
-            "error":   "Order not found",
-            "cell_id": s.CellID,
-        })
+        shared.WriteError(w, s.CellID, shared.ErrorNotFound, "Order not found")
         return
     }
 
     order.Status = request.Status
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "data":    order,
-        "cell_id": s.CellID,
-    })
+    shared.WriteData(w, http.StatusOK, s.CellID, order)
 }
 
 func (s *OrderService) deleteOrder(w http.ResponseWriter, r *http.Request) {
@@ -195,53 +209,43 @@ func (s *OrderService) deleteOrder(w http.ResponseWriter, r *http.Request) {
     defer s.mutex.Unlock()
 
     if _, exists := s.Orders[orderID]; !exists {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]interface{}{
-            "success": false,
-            "error":   "Order not found",
-            "cell_id": s.CellID,
-        })
+        shared.WriteError(w, s.CellID, shared.ErrorNotFound, "Order not found")
         return
     }
 
     delete(s.Orders, orderID)
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "message": "Order deleted successfully",
-        "cell_id": s.CellID,
-    })
+    shared.WriteMessage(w, http.StatusOK, s.CellID, "Order deleted successfully")
 }
 
-func (s *OrderService) healthCheck(w http.ResponseWriter, r *http.Request) {
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "status":      "healthy",
-        "service":     "order-service",
-        "cell_id":     s.CellID,
-        "order_count": len(s.Orders),
-        "timestamp":   time.Now(),
-        "version":     "1.0.0",
-    })
+// healthDetails adds the order count to /health
+func (s *OrderService) healthDetails() map[string]interface{} {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+    return map[string]interface{}{"order_count": len(s.Orders)}
 }
 
+var (
+    noIdentity   = map[int]string{http.StatusUnauthorized: "No gateway verified the caller"}
+    foreignOrder = map[int]string{http.StatusUnauthorized: noIdentity[http.StatusUnauthorized], http.StatusForbidden: "user_id names another user and the caller is not an admin"}
+)
+
 func main() {
     service := NewOrderService()
     
-    r := mux.NewRouter()
-    
-    r.HandleFunc("/health", service.healthCheck).Methods("GET")
-    r.HandleFunc("/readiness", service.healthCheck).Methods("GET")
-    r.HandleFunc("/orders", service.createOrder).Methods("POST")
-    r.HandleFunc("/orders", service.getAllOrders).Methods("GET")
-    r.HandleFunc("/orders/{id}", service.getOrder).Methods("GET")
-    r.HandleFunc("/orders/{id}/status", service.updateOrderStatus).Methods("PUT")
-    r.HandleFunc("/orders/{id}", service.deleteOrder).Methods("DELETE")
+    api := service.server
+    api.HandleHealth(service.healthDetails)
+    api.Route(openapi.Operation{ID: "createOrder", Method: "POST", Path: "/orders", Summary: "Place an order for a user in Cell A, reserving stock there", Request: openapi.OrderCreate, Response: openapi.Data("Order"), Status: http.StatusCreated, Errors: foreignOrder}, service.createOrder)
+    api.Route(openapi.Operation{ID: "listOrders", Method: "GET", Path: "/orders", Summary: "List the caller's orders, or every order for an admin", Response: openapi.List("Order"), Errors: noIdentity}, service.getAllOrders)
+    api.Route(openapi.Operation{ID: "getOrder", Method: "GET", Path: "/orders/{id}", Summary: "Get one of the caller's orders", Response: openapi.Data("Order"), Errors: noIdentity}, service.getOrder)
+    api.Route(openapi.Operation{ID: "updateOrderStatus", Method: "PUT", Path: "/orders/{id}/status", Summary: "Set an order's status", Request: openapi.OrderStatusUpdate, Response: openapi.Data("Order")}, service.updateOrderStatus)
+    api.Route(openapi.Operation{ID: "deleteOrder", Method: "DELETE", Path: "/orders/{id}", Summary: "Delete an order", Response: openapi.Message()}, service.deleteOrder)
     
     log.Printf("Cell B Order Service starting on port %s", service.Port)
     log.Printf("Cell A Gateway URL: %s", service.CellAGatewayURL)
     log.Printf("Payment Service URL: %s", service.PaymentServiceURL)
     
-    log.Fatal(http.ListenAndServe(":"+service.Port, r))
+    service.server.Readiness.MarkWarm()
+    
+    service.server.Run(service.Port)
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+    "context"
+    "sync"
+    "time"
+
+    "cell-shared"
+    "cell-shared/client"
+)
+
+// UserCache looks up the users orders are placed for in Cell A and remembers
+// them for a while, so a burst of orders from one user costs one lookup.
+// Only users that exist are cached, so someone who registered a moment ago
+// can order straight away; a deleted user may still order until their entry
+// expires.
+type UserCache struct {
+    users   *client.Users
+    ttl     time.Duration
+    mutex   sync.Mutex
+    entries map[string]cachedUser
+    pruneAt int
+}
+
+type cachedUser struct {
+    user    shared.UserSnapshot
+    fetched time.Time
+}
+
+// NewUserCache keeps users for ttl; a ttl of zero looks every user up
+func NewUserCache(users *client.Users, ttl time.Duration) *UserCache {
+    return &UserCache{users: users, ttl: ttl, entries: make(map[string]cachedUser), pruneAt: 1024}
+}
+
+// Get returns a snapshot of the user with ID id. The error is the client's,
+// so client.IsNotFound tells an unknown user from Cell A being unavailable.
+func (c *UserCache) Get(ctx context.Context, id string) (*shared.UserSnapshot, error) {
+    c.mutex.Lock()
+    entry, exists := c.entries[id]
+    c.mutex.Unlock()
+    if exists && time.Since(entry.fetched) < c.ttl {
+        return &entry.user, nil
+    }
+
+    user, err := c.users.Get(ctx, id)
+    if err != nil {
+        return nil, err
+    }
+    snapshot := shared.UserSnapshot{ID: user.ID, Name: user.Name, Email: user.Email}
+
+    if c.ttl > 0 {
+        c.mutex.Lock()
+        c.entries[id] = cachedUser{user: snapshot, fetched: time.Now()}
+        c.pruneExpired()
+        c.mutex.Unlock()
+    }
+    return &snapshot, nil
+}
+
+// pruneExpired drops expired entries once the cache has doubled in size
+// since the last pass. The caller holds the mutex.
+func (c *UserCache) pruneExpired() {
+    if len(c.entries) < c.pruneAt {
+        return
+    }
+    for id, entry := range c.entries {
+        if time.Since(entry.fetched) >= c.ttl {
+            delete(c.entries, id)
+        }
+    }
+    c.pruneAt = 2*len(c.entries) + 1024
+}
@@ -1,63 +1,111 @@
 package main
 
 import (
-    "bytes"
+    "context"
     "encoding/json"
     "fmt"
     "log"
     "net/http"
     "os"
     "sync"
+    "sync/atomic"
     "time"
 
+    "cell-shared"
+    "cell-shared/auth"
+    "cell-shared/client"
+    "cell-shared/config"
+    "cell-shared/logging"
+    "cell-shared/openapi"
+    "cell-shared/server"
+    "cell-shared/tracing"
     "github.com/gorilla/mux"
     "github.com/google/uuid"
+    "go.opentelemetry.io/otel/attribute"
 )
 
-type Payment struct {
-    ID        string    `json:"id"`
-    OrderID   string    `json:"order_id"`
-    Amount    float64   `json:"amount"`
-    Status    string    `json:"status"`
-    Method    string    `json:"method"`
-    CellID    string    `json:"cell_id"`
-    CreatedAt time.Time `json:"created_at"`
-}
-
 type PaymentService struct {
-    CellID          string
-    Payments        map[string]*Payment
-    mutex           sync.RWMutex
-    Port            string
-    OrderServiceURL string
+    CellID           string
+    Payments         map[string]*shared.Payment
+    mutex            sync.RWMutex
+    Port             string
+    OrderServiceURL  string
+    OrderServiceHost string
+    orders           *client.Client
+
+    MaxPendingPayments  int64
+    PendingPaymentsFile string
+    pendingPayments     atomic.Int64
+    background          sync.WaitGroup
+    server              *server.Server
 }
 
 func NewPaymentService() *PaymentService {
-    return &PaymentService{
-        CellID:          getEnv("CELL_ID", "cell-b"),
-        Payments:        make(map[string]*Payment),
-        Port:            getEnv("PORT", "8022"),
-        OrderServiceURL: getEnv("ORDER_SERVICE_URL", "http://cell-b-order-service:8021"),
+    s := &PaymentService{
+        CellID:              config.Get("CELL_ID", "cell-b"),
+        Payments:            make(map[string]*shared.Payment),
+        Port:                config.Get("PORT", "8022"),
+        OrderServiceURL:     config.Get("ORDER_SERVICE_URL", "http://cell-b-order-service:8021"),
+        OrderServiceHost:    config.Get("ORDER_SERVICE_HOST", ""),
+        MaxPendingPayments:  config.Int64("MAX_PENDING_PAYMENTS", 1000),
+        PendingPaymentsFile: config.Get("PENDING_PAYMENTS_FILE", ""),
     }
+    s.server = server.New("payment-service", s.CellID)
+    s.orders = client.New(s.OrderServiceURL,
+        client.WithHTTPClient(server.NewClient(config.Duration("UPSTREAM_TIMEOUT", 30*time.Second))),
+        client.WithHost(s.OrderServiceHost),
+        client.WithRetry(int(config.Int64("UPSTREAM_RETRY_ATTEMPTS", 2)), 100*time.Millisecond),
+    )
+    s.server.Readiness.Register("storage", true, server.LockCheck(&s.mutex))
+    s.server.Readiness.Register("processing-queue", true, s.checkQueueDepth)
+    s.server.Readiness.Register("order-service", config.Bool("READINESS_UPSTREAMS_CRITICAL", false), server.UpstreamCheck(s.OrderServiceURL, s.OrderServiceHost))
+
+    s.server.Metrics.Register(s.server.Metrics.NewStoreCollector("payments_by_status", "Payments currently stored, by status.", []string{"status"}, func(report func(float64, ...string)) {
+        s.mutex.RLock()
+        defer s.mutex.RUnlock()
+        counts := make(map[string]int)
+        for _, payment := range s.Payments {
+            counts[payment.Status]++
+        }
+        for status, count := range counts {
+            report(float64(count), status)
+        }
+    }))
+    s.server.Metrics.Register(s.server.Metrics.NewStoreCollector("payments_pending", "Payments still being processed in the background.", nil, func(report func(float64, ...string)) {
+        report(float64(s.pendingPayments.Load()))
+    }))
+    return s
 }
 
-func getEnv(key, defaultValue string) string {
-    if value := os.Getenv(key); value != "" {
-        return value
+// checkQueueDepth fails readiness while too many payments are still being processed
+func (s *PaymentService) checkQueueDepth(ctx context.Context) error {
+    if pending := s.pendingPayments.Load(); pending >= s.MaxPendingPayments {
+        return fmt.Errorf("%d payments pending, threshold is %d", pending, s.MaxPendingPayments)
     }
-    return defaultValue
+    return nil
 }
 
 func (s *PaymentService) createPayment(w http.ResponseWriter, r *http.Request) {
-    var payment Payment
-    if err := json.NewDecoder(r.Body).Decode(&payment); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+    if auth.Caller(w, r, s.CellID) == nil {
+        return
+    }
+    var payment shared.Payment
+    if !openapi.DecodeBody(w, r, s.CellID, openapi.PaymentCreate, &payment) {
         return
     }
 
-    // Validate order exists
-    if !s.validateOrder(payment.OrderID) {
-        http.Error(w, "Order not found", http.StatusBadRequest)
+    // Validate order exists. Order-service answers as the caller, so other
+    // users' orders are not found.
+    order, err := s.orders.Orders.Get(r.Context(), payment.OrderID)
+    if err != nil {
+        if client.IsNotFound(err) {
+            e := shared.NewError(shared.ErrorInvalidRequest, "Order not found")
+            e.Details = []shared.FieldError{{Field: "order_id", Message: "does not exist"}}
+            shared.WriteFailure(w, s.CellID, e)
+            return
+        }
+        logging.FromContext(r.Context()).Error("Error validating order", "order_id", payment.OrderID, "error", err)
+        shared.WriteFailure(w, s.CellID, client.UpstreamError("Order service unavailable", "order-service", s.CellID, err))
         return
     }
 
@@ -65,64 +113,137 @@ func (s *PaymentService) createPayment(w http.ResponseWriter, r *http.Request) {
     defer s.mutex.Unlock()
 
     payment.ID = uuid.New().String()
+    payment.UserID = order.UserID
     payment.CellID = s.CellID
     payment.CreatedAt = time.Now()
-    payment.Status = "processing"
+    payment.Status = shared.PaymentStatusProcessing
     s.Payments[payment.ID] = &payment
 
     // Simulate payment processing
-    go s.processPayment(payment.ID)
-
-    w.Header().Set("Content-Type", "application/json")
-    w.WriteHeader(http.StatusCreated)
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "data":    payment,
-        "cell_id": s.CellID,
-    })
+    s.startProcessing(r.Context(), payment.ID)
+
+    shared.WriteData(w, http.StatusCreated, s.CellID, payment)
 }
 
-func (s *PaymentService) validateOrder(orderID string) bool {
-    resp, err := http.Get(fmt.Sprintf("%s/orders/%s", s.OrderServiceURL, orderID))
-    if err != nil || resp.StatusCode != http.StatusOK {
-        return false
-    }
-    return true
+// startProcessing runs processPayment in the background, tracked so shutdown
+// can wait for it. The work outlives the request, so it keeps the request's
+// trace but not its cancellation.
+func (s *PaymentService) startProcessing(ctx context.Context, paymentID string) {
+    s.pendingPayments.Add(1)
+    s.background.Add(1)
+    go s.processPayment(context.WithoutCancel(ctx), paymentID)
 }
 
-func (s *PaymentService) processPayment(paymentID string) {
+func (s *PaymentService) processPayment(ctx context.Context, paymentID string) {
+    defer s.background.Done()
+    defer s.pendingPayments.Add(-1)
+
+    ctx, span := tracing.Tracer.Start(ctx, "processPayment")
+    span.SetAttributes(attribute.String("payment.id", paymentID))
+    defer span.End()
     time.Sleep(2 * time.Second)
     
     s.mutex.Lock()
-    defer s.mutex.Unlock()
-    
-    if payment, exists := s.Payments[paymentID]; exists {
-        payment.Status = "completed"
-        s.updateOrderStatus(payment.OrderID, "paid")
+    payment, exists := s.Payments[paymentID]
+    var orderID string
+    if exists {
+        payment.Status = shared.PaymentStatusCompleted
+        orderID = payment.OrderID
+    }
+    s.mutex.Unlock()
+
+    // The order update goes through order-service, so it must not hold the
+    // store lock: a slow call would stall every request and readiness probe
+    if exists {
+        s.updateOrderStatus(ctx, orderID, shared.OrderStatusPaid)
     }
 }
 
-func (s *PaymentService) updateOrderStatus(orderID, status string) {
-    statusUpdate := map[string]string{"status": status}
-    jsonData, _ := json.Marshal(statusUpdate)
-    
-    req, err := http.NewRequest("PUT", fmt.Sprintf("%s/orders/%s/status", s.OrderServiceURL, orderID), bytes.NewBuffer(jsonData))
-    if err != nil {
-        log.Printf("Error creating request: %v", err)
+// finishBackgroundWork waits for in-progress payments during shutdown and,
+// if the deadline passes first, persists the ones still processing
+func (s *PaymentService) finishBackgroundWork(ctx context.Context) {
+    done := make(chan struct{})
+    go func() {
+        s.background.Wait()
+        close(done)
+    }()
+
+    select {
+    case <-done:
+        log.Printf("All in-progress payments completed")
+    case <-ctx.Done():
+        s.persistPendingPayments()
+    }
+}
+
+func (s *PaymentService) persistPendingPayments() {
+    s.mutex.RLock()
+    var pending []*shared.Payment
+    for _, payment := range s.Payments {
+        if payment.Status == shared.PaymentStatusProcessing {
+            pending = append(pending, payment)
+        }
+    }
+    data, err := json.Marshal(pending)
+    s.mutex.RUnlock()
+
+    if len(pending) == 0 {
         return
     }
-    req.Header.Set("Content-Type", "application/json")
-    
-    client := &http.Client{}
-    resp, err := client.Do(req)
+    if s.PendingPaymentsFile == "" || err != nil {
+        log.Printf("Abandoning %d in-progress payments (PENDING_PAYMENTS_FILE not set)", len(pending))
+        return
+    }
+    if err := os.WriteFile(s.PendingPaymentsFile, data, 0o600); err != nil {
+        log.Printf("Error persisting pending payments: %v", err)
+        return
+    }
+    log.Printf("Persisted %d in-progress payments to %s", len(pending), s.PendingPaymentsFile)
+}
+
+// resumePendingPayments reloads payments persisted by a previous instance and finishes processing them
+func (s *PaymentService) resumePendingPayments() {
+    if s.PendingPaymentsFile == "" {
+        return
+    }
+    data, err := os.ReadFile(s.PendingPaymentsFile)
     if err != nil {
-        log.Printf("Error updating order status: %v", err)
+        if !os.IsNotExist(err) {
+            log.Printf("Error reading pending payments: %v", err)
+        }
         return
     }
-    defer resp.Body.Close()
+
+    var pending []*shared.Payment
+    if err := json.Unmarshal(data, &pending); err != nil {
+        log.Printf("Error decoding pending payments: %v", err)
+        return
+    }
+
+    s.mutex.Lock()
+    for _, payment := range pending {
+        s.Payments[payment.ID] = payment
+    }
+    s.mutex.Unlock()
+
+    for _, payment := range pending {
+        s.startProcessing(context.Background(), payment.ID)
+    }
+    os.Remove(s.PendingPaymentsFile)
+    log.Printf("Resumed %d pending payments from %s", len(pending), s.PendingPaymentsFile)
+}
+
+func (s *PaymentService) updateOrderStatus(ctx context.Context, orderID, status string) {
+    if _, err := s.orders.Orders.UpdateStatus(ctx, orderID, status); err != nil {
+        logging.FromContext(ctx).Error("Error updating order status", "order_id", orderID, "error", err)
+    }
 }
 
 func (s *PaymentService) getPayment(w http.ResponseWriter, r *http.Request) {
+    caller := auth.Caller(w, r, s.CellID)
+    if caller == nil {
+        return
+    }
     vars := mux.Vars(r)
     paymentID := vars["id"]
 
@@ -130,61 +251,55 @@ func (s *PaymentService) getPayment(w http.ResponseWriter, r *http.Request) {
     payment, exists := s.Payments[paymentID]
     s.mutex.RUnlock()
 
-    w.Header().Set("Content-Type", "application/json")
-    if !exists {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]interface{}{
-            "success": false,
-            "error":   "Payment not found",
-            "cell_id": s.CellID,
-        })
+    // Hidden rather than forbidden, like other users' orders
+    if !exists || !caller.CanAccess(payment.UserID) {
+        shared.WriteError(w, s.CellID, shared.ErrorNotFound, "Payment not found")
         return
     }
 
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "data":    payment,
-        "cell_id": s.CellID,
-    })
+    shared.WriteData(w, http.StatusOK, s.CellID, payment)
 }
 
+// getAllPayments lists the caller's payments, or every payment for an admin
 func (s *PaymentService) getAllPayments(w http.ResponseWriter, r *http.Request) {
+    caller := auth.Caller(w, r, s.CellID)
+    if caller == nil {
+        return
+    }
+
     s.mutex.RLock()
-    payments := make([]*Payment, 0, len(s.Payments))
+    payments := make([]*shared.Payment, 0)
     for _, payment := range s.Payments {
-        payments = append(payments, payment)
+        if caller.CanAccess(payment.UserID) {
+            payments = append(payments, payment)
+        }
     }
     s.mutex.RUnlock()
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "data":    payments,
-        "cell_id": s.CellID,
-        "count":   len(payments),
-    })
+    shared.WriteList(w, s.CellID, payments, len(payments))
 }
 
 func (s *PaymentService) getPaymentsByOrder(w http.ResponseWriter, r *http.Request) {
+    caller := auth.Caller(w, r, s.CellID)
+    if caller == nil {
+        return
+    }
     vars := mux.Vars(r)
     orderID := vars["order_id"]
 
     s.mutex.RLock()
-    var orderPayments []*Payment
+    var orderPayments []*shared.Payment
     for _, payment := range s.Payments {
-        if payment.OrderID == orderID {
+        if payment.OrderID == orderID && caller.CanAccess(payment.UserID) {
             orderPayments = append(orderPayments, payment)
         }
     }
     s.mutex.RUnlock()
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success":  true,
-        "data":     orderPayments,
-        "cell_id":  s.CellID,
-        "count":    len(orderPayments),
-        "order_id": orderID,
+    count := len(orderPayments)
+    shared.WriteJSON(w, http.StatusOK, shared.PaymentsByOrderResponse{
+        ServiceResponse: shared.ServiceResponse{Success: true, Data: orderPayments, Count: &count, CellID: s.CellID},
+        OrderID:         orderID,
     })
 }
 
@@ -197,62 +312,49 @@ func (s *PaymentService) refundPayment(w http.ResponseWriter, r *http.Request) {
 
     payment, exists := s.Payments[paymentID]
     if !exists {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]interface{}{
-            "success": false,
-            "error":   "Payment not found",
-            "cell_id": s.CellID,
-        })
+        shared.WriteError(w, s.CellID, shared.ErrorNotFound, "Payment not found")
         return
     }
 
-    if payment.Status != "completed" {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]interface{}{
-            "success": false,
-            "error":   "Payment cannot be refunded",
-            "cell_id": s.CellID,
-        })
+    if payment.Status != shared.PaymentStatusCompleted {
+        shared.WriteError(w, s.CellID, shared.ErrorInvalidState, "Payment cannot be refunded")
         return
     }
 
-    payment.Status = "refunded"
+    payment.Status = shared.PaymentStatusRefunded
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "success": true,
-        "data":    payment,
-        "cell_id": s.CellID,
-    })
+    shared.WriteData(w, http.StatusOK, s.CellID, payment)
 }
 
-func (s *PaymentService) healthCheck(w http.ResponseWriter, r *http.Request) {
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "status":        "healthy",
-        "service":       "payment-service",
-        "cell_id":       s.CellID,
+// healthDetails adds the payment and pending counts to /health
+func (s *PaymentService) healthDetails() map[string]interface{} {
+    s.mutex.RLock()
+    defer s.mutex.RUnlock()
+    return map[string]interface{}{
         "payment_count": len(s.Payments),
-        "timestamp":     time.Now(),
-        "version":       "1.0.0",
-    })
+        "pending_count": s.pendingPayments.Load(),
+    }
 }
 
+var noIdentity = map[int]string{http.StatusUnauthorized: "No gateway verified the caller"}
+
 func main() {
     service := NewPaymentService()
     
-    r := mux.NewRouter()
-    
-    r.HandleFunc("/health", service.healthCheck).Methods("GET")
-    r.HandleFunc("/readiness", service.healthCheck).Methods("GET")
-    r.HandleFunc("/payments", service.createPayment).Methods("POST")
-    r.HandleFunc("/payments", service.getAllPayments).Methods("GET")
-    r.HandleFunc("/payments/{id}", service.getPayment).Methods("GET")
-    r.HandleFunc("/payments/{id}/refund", service.refundPayment).Methods("POST")
-    r.HandleFunc("/payments/order/{order_id}", service.getPaymentsByOrder).Methods("GET")
+    api := service.server
+    api.HandleHealth(service.healthDetails)
+    api.Route(openapi.Operation{ID: "createPayment", Method: "POST", Path: "/payments", Summary: "Start a payment for an order; it completes in the background", Request: openapi.PaymentCreate, Response: openapi.Data("Payment"), Status: http.StatusCreated, Errors: noIdentity}, service.createPayment)
+    api.Route(openapi.Operation{ID: "listPayments", Method: "GET", Path: "/payments", Summary: "List the caller's payments, or every payment for an admin", Response: openapi.List("Payment"), Errors: noIdentity}, service.getAllPayments)
+    api.Route(openapi.Operation{ID: "getPayment", Method: "GET", Path: "/payments/{id}", Summary: "Get one of the caller's payments", Response: openapi.Data("Payment"), Errors: noIdentity}, service.getPayment)
+    api.Route(openapi.Operation{ID: "refundPayment", Method: "POST", Path: "/payments/{id}/refund", Summary: "Refund a completed payment", Response: openapi.Data("Payment")}, service.refundPayment)
+    api.Route(openapi.Operation{ID: "listPaymentsByOrder", Method: "GET", Path: "/payments/order/{order_id}", Summary: "List the caller's payments for an order", Response: openapi.Ref("PaymentsByOrderResponse"), Errors: noIdentity}, service.getPaymentsByOrder)
     
     log.Printf("Cell B Payment Service starting on port %s", service.Port)
     log.Printf("Order Service URL: %s", service.OrderServiceURL)
     
-    log.Fatal(http.ListenAndServe(":"+service.Port, r))
+    service.resumePendingPayments()
+    service.server.Readiness.MarkWarm()
+    
+    service.server.OnShutdown(service.finishBackgroundWork)
+    service.server.Run(service.Port)
 }
@@ -74,6 +74,10 @@ deploy_cells() {
     echo -e "${BLUE}Creating namespaces...${NC}"
     kubectl apply -f namespaces.yaml
     
+    # Create the secrets that are not kept in the manifests
+    echo -e "${BLUE}Creating secrets...${NC}"
+    "$(dirname "$0")/../../scripts/create-secrets.sh"
+    
     # Create service accounts
     echo -e "${BLUE}Creating service accounts...${NC}"
     kubectl apply -f serviceaccounts.yaml
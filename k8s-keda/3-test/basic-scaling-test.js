@@ -27,6 +27,8 @@ export let options = {
 };
 
 const BASE_URL = 'http://localhost:8080';
+// Gateways require a token on most routes; pass an admin's as ACCESS_TOKEN
+const AUTH_HEADERS = __ENV.ACCESS_TOKEN ? { Authorization: `Bearer ${__ENV.ACCESS_TOKEN}` } : {};
 
 // Test endpoints for both cells
 const endpoints = [
@@ -46,10 +48,10 @@ export default function () {
   const endpoint = endpoints[Math.floor(Math.random() * endpoints.length)];
   
   const params = {
-    headers: {
+    headers: Object.assign({
       'Host': endpoint.host,
       'Content-Type': 'application/json',
-    },
+    }, AUTH_HEADERS),
   };
 
   console.log(`Testing ${endpoint.name}: ${endpoint.host}${endpoint.path}`);
@@ -22,6 +22,8 @@ export let options = {
 };
 
 const BASE_URL = 'http://localhost:8080';
+// Gateways require a token on most routes; pass an admin's as ACCESS_TOKEN
+const AUTH_HEADERS = __ENV.ACCESS_TOKEN ? { Authorization: `Bearer ${__ENV.ACCESS_TOKEN}` } : {};
 
 // Cross-cell endpoints - testing one cell accessing another cell's resources
 const crossCellEndpoints = [
@@ -44,10 +46,10 @@ export default function () {
   const endpoint = crossCellEndpoints[Math.floor(Math.random() * crossCellEndpoints.length)];
   
   const params = {
-    headers: {
+    headers: Object.assign({
       'Host': endpoint.host,
       'Content-Type': 'application/json',
-    },
+    }, AUTH_HEADERS),
   };
 
   if (endpoint.crossCell) {
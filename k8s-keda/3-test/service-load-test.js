@@ -24,6 +24,8 @@ export let options = {
 };
 
 const BASE_URL = 'http://localhost:8080';
+// Gateways require a token on most routes; pass an admin's as ACCESS_TOKEN
+const AUTH_HEADERS = __ENV.ACCESS_TOKEN ? { Authorization: `Bearer ${__ENV.ACCESS_TOKEN}` } : {};
 
 // Service endpoints that should trigger internal service scaling
 const serviceEndpoints = [
@@ -36,10 +38,11 @@ const serviceEndpoints = [
   { host: 'cell-b-gateway.local', path: '/payments', name: 'Payment Service', method: 'GET' },
   
   // Create operations to generate more load
-  { host: 'cell-a-gateway.local', path: '/users', name: 'Create User', method: 'POST', body: {
+  // Emails must be unique, so each request gets a fresh one
+  { host: 'cell-a-gateway.local', path: '/users', name: 'Create User', method: 'POST', body: () => ({
     name: `TestUser${Math.floor(Math.random() * 1000)}`,
-    email: `user${Math.floor(Math.random() * 1000)}@test.com`
-  }},
+    email: `user_${__VU}_${__ITER}_${Date.now()}@test.com`
+  })},
   { host: 'cell-a-gateway.local', path: '/products', name: 'Create Product', method: 'POST', body: {
     name: `Product${Math.floor(Math.random() * 1000)}`,
     price: Math.floor(Math.random() * 100) + 10,
@@ -51,17 +54,18 @@ export default function () {
   const endpoint = serviceEndpoints[Math.floor(Math.random() * serviceEndpoints.length)];
   
   const params = {
-    headers: {
+    headers: Object.assign({
       'Host': endpoint.host,
       'Content-Type': 'application/json',
-    },
+    }, AUTH_HEADERS),
   };
 
   let response;
   const startTime = Date.now();
 
   if (endpoint.method === 'POST' && endpoint.body) {
-    response = http.post(`${BASE_URL}${endpoint.path}`, JSON.stringify(endpoint.body), params);
+    const body = typeof endpoint.body === 'function' ? endpoint.body() : endpoint.body;
+    response = http.post(`${BASE_URL}${endpoint.path}`, JSON.stringify(body), params);
   } else {
     response = http.get(`${BASE_URL}${endpoint.path}`, params);
   }
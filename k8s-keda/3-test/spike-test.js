@@ -28,6 +28,8 @@ export let options = {
 };
 
 const BASE_URL = 'http://localhost:8080';
+// Gateways require a token on most routes; pass an admin's as ACCESS_TOKEN
+const AUTH_HEADERS = __ENV.ACCESS_TOKEN ? { Authorization: `Bearer ${__ENV.ACCESS_TOKEN}` } : {};
 
 // Focus on gateway endpoints for spike testing
 const gatewayEndpoints = [
@@ -39,10 +41,10 @@ export default function () {
   const endpoint = gatewayEndpoints[Math.floor(Math.random() * gatewayEndpoints.length)];
   
   const params = {
-    headers: {
+    headers: Object.assign({
       'Host': endpoint.host,
       'Content-Type': 'application/json',
-    },
+    }, AUTH_HEADERS),
   };
 
   const response = http.get(`${BASE_URL}${endpoint.path}`, params);
@@ -2,30 +2,25 @@
 
 echo "Building Cell-Based Architecture Components..."
 
+# Images build from the repository root so they can include the shared module
+cd "$(dirname "$0")/.."
+
 # Build Cell A
 echo "Building Cell A components..."
-cd cell-a/gateway
-docker build -t yashodperera/cell-a-gateway:latest .
+docker build -f cell-a/gateway/Dockerfile -t yashodperera/cell-a-gateway:latest .
 docker push yashodperera/cell-a-gateway:latest
-cd ../user-service
-docker build -t yashodperera/cell-a-user-service:latest .
+docker build -f cell-a/user-service/Dockerfile -t yashodperera/cell-a-user-service:latest .
 docker push yashodperera/cell-a-user-service:latest
-cd ../product-service
-docker build -t yashodperera/cell-a-product-service:latest .
+docker build -f cell-a/product-service/Dockerfile -t yashodperera/cell-a-product-service:latest .
 docker push yashodperera/cell-a-product-service:latest
-cd ../..
 
 # Build Cell B
 echo "Building Cell B components..."
-cd cell-b/gateway
-docker build -t yashodperera/cell-b-gateway:latest .
+docker build -f cell-b/gateway/Dockerfile -t yashodperera/cell-b-gateway:latest .
 docker push yashodperera/cell-b-gateway:latest
-cd ../order-service
-docker build -t yashodperera/cell-b-order-service:latest .
+docker build -f cell-b/order-service/Dockerfile -t yashodperera/cell-b-order-service:latest .
 docker push yashodperera/cell-b-order-service:latest
-cd ../payment-service
-docker build -t yashodperera/cell-b-payment-service:latest .
+docker build -f cell-b/payment-service/Dockerfile -t yashodperera/cell-b-payment-service:latest .
 docker push yashodperera/cell-b-payment-service:latest
-cd ../..
 
 echo "All cell components built successfully!"
\ No newline at end of file
@@ -0,0 +1,56 @@
+#!/bin/bash
+
+# Creates the secrets the cells need and that must not be committed, keeping
+# any that already exist so tokens and keys survive a redeploy
+
+set -e
+
+if kubectl -n cell-a get secret cell-a-jwt-signing-key >/dev/null 2>&1; then
+    echo "Secret cell-a/cell-a-jwt-signing-key already exists"
+else
+    echo "Creating the JWT signing key secret for user-service..."
+    KEY_DIR="$(mktemp -d)"
+    trap 'rm -rf "$KEY_DIR"' EXIT
+    openssl genpkey -algorithm RSA -pkeyopt rsa_keygen_bits:2048 -out "$KEY_DIR/signing-key.pem" 2>/dev/null
+    kubectl -n cell-a create secret generic cell-a-jwt-signing-key --from-file=signing-key.pem="$KEY_DIR/signing-key.pem"
+fi
+
+# Both gateways hold the key the cells sign cross-cell requests with, each
+# under the other cell's name; reuse one side's key if only it exists
+if kubectl -n cell-a get secret cell-signing-keys >/dev/null 2>&1 && \
+   kubectl -n cell-b get secret cell-signing-keys >/dev/null 2>&1; then
+    echo "Secret cell-signing-keys already exists in cell-a and cell-b"
+else
+    echo "Creating the cross-cell signing key secrets for the gateways..."
+    CELL_KEY=""
+    for cell in cell-a cell-b; do
+        if [ -z "$CELL_KEY" ]; then
+            CELL_KEY=$(kubectl -n "$cell" get secret cell-signing-keys -o jsonpath='{.data.CELL_SIGNING_KEYS}' 2>/dev/null | base64 -d | cut -d= -f2-)
+        fi
+    done
+    CELL_KEY=${CELL_KEY:-$(openssl rand -hex 32)}
+    kubectl -n cell-a create secret generic cell-signing-keys --from-literal=CELL_SIGNING_KEYS="cell-b=$CELL_KEY" \
+        --dry-run=client -o yaml | kubectl apply -f -
+    kubectl -n cell-b create secret generic cell-signing-keys --from-literal=CELL_SIGNING_KEYS="cell-a=$CELL_KEY" \
+        --dry-run=client -o yaml | kubectl apply -f -
+fi
+
+# Every gateway and service in both cells signs identity and caller headers
+# with one key
+if kubectl -n cell-a get secret identity-signing-key >/dev/null 2>&1 && \
+   kubectl -n cell-b get secret identity-signing-key >/dev/null 2>&1; then
+    echo "Secret identity-signing-key already exists in cell-a and cell-b"
+else
+    echo "Creating the identity signing key secrets..."
+    IDENTITY_KEY=""
+    for cell in cell-a cell-b; do
+        if [ -z "$IDENTITY_KEY" ]; then
+            IDENTITY_KEY=$(kubectl -n "$cell" get secret identity-signing-key -o jsonpath='{.data.IDENTITY_SIGNING_KEY}' 2>/dev/null | base64 -d)
+        fi
+    done
+    IDENTITY_KEY=${IDENTITY_KEY:-$(openssl rand -hex 32)}
+    for cell in cell-a cell-b; do
+        kubectl -n "$cell" create secret generic identity-signing-key --from-literal=IDENTITY_SIGNING_KEY="$IDENTITY_KEY" \
+            --dry-run=client -o yaml | kubectl apply -f -
+    done
+fi
@@ -5,6 +5,9 @@ echo "Deploying Cell A components only..."
 # Create Cell A namespace
 kubectl apply -f k8s/namespaces.yaml
 
+# Create the secrets that are not kept in the manifests
+"$(dirname "$0")/create-secrets.sh"
+
 # Deploy Cell A components
 echo "Deploying Cell A components to cell-a namespace..."
 kubectl apply -f k8s/cell-a/gateway.yaml
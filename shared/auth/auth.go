@@ -0,0 +1,158 @@
+// Package auth issues and checks the access tokens users authenticate with:
+// RS256 JWTs naming the user and their home cell, signed by user-service and
+// published as a JWKS so gateways can verify them without calling back.
+// Gateways pass the verified identity on to services in signed headers.
+package auth
+
+import (
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "math/big"
+    "os"
+    "time"
+
+    "cell-shared"
+    "github.com/golang-jwt/jwt/v5"
+    "github.com/google/uuid"
+)
+
+// Algorithm is the only signing algorithm tokens are issued or accepted with
+const Algorithm = "RS256"
+
+// RoleAdmin may use every route, including the ones that change the catalog
+// or refund payments
+const RoleAdmin = "admin"
+
+// Claims are the claims of an access token. The subject is the user ID and
+// Cell the cell that stores the user.
+type Claims struct {
+    Cell  string   `json:"cell"`
+    Email string   `json:"email,omitempty"`
+    Roles []string `json:"roles,omitempty"`
+    jwt.RegisteredClaims
+}
+
+// HasRole reports whether the token grants role
+func (c *Claims) HasRole(role string) bool {
+    return hasRole(c.Roles, role)
+}
+
+func hasRole(roles []string, role string) bool {
+    for _, r := range roles {
+        if r == role {
+            return true
+        }
+    }
+    return false
+}
+
+// Signer issues access tokens with one RSA key
+type Signer struct {
+    key    *rsa.PrivateKey
+    keyID  string
+    issuer string
+    ttl    time.Duration
+}
+
+// NewSigner returns a Signer whose tokens are valid for ttl
+func NewSigner(key *rsa.PrivateKey, issuer string, ttl time.Duration) *Signer {
+    return &Signer{key: key, keyID: KeyID(&key.PublicKey), issuer: issuer, ttl: ttl}
+}
+
+// TTL is how long the tokens the Signer issues are valid
+func (s *Signer) TTL() time.Duration {
+    return s.ttl
+}
+
+// Issue signs an access token for the user stored in cell
+func (s *Signer) Issue(userID, cell, email string, roles []string) (string, error) {
+    now := time.Now()
+    claims := Claims{
+        Cell:  cell,
+        Email: email,
+        Roles: roles,
+        RegisteredClaims: jwt.RegisteredClaims{
+            Issuer:    s.issuer,
+            Subject:   userID,
+            IssuedAt:  jwt.NewNumericDate(now),
+            NotBefore: jwt.NewNumericDate(now),
+            ExpiresAt: jwt.NewNumericDate(now.Add(s.ttl)),
+            ID:        uuid.New().String(),
+        },
+    }
+
+    token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+    token.Header["kid"] = s.keyID
+    return token.SignedString(s.key)
+}
+
+// JWKS is the key set tokens from the Signer verify against
+func (s *Signer) JWKS() shared.JWKS {
+    return shared.JWKS{Keys: []shared.JWK{PublicJWK(&s.key.PublicKey)}}
+}
+
+// PublicJWK encodes key as a signing JWK identified by its KeyID
+func PublicJWK(key *rsa.PublicKey) shared.JWK {
+    return shared.JWK{
+        KeyType:   "RSA",
+        Use:       "sig",
+        Algorithm: Algorithm,
+        KeyID:     KeyID(key),
+        N:         base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+        E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+    }
+}
+
+// KeyID is the RFC 7638 thumbprint of key, so every replica signing with
+// the same key advertises the same ID
+func KeyID(key *rsa.PublicKey) string {
+    // The members in lexicographic order, as the thumbprint requires
+    thumbprint, _ := json.Marshal(struct {
+        E   string `json:"e"`
+        Kty string `json:"kty"`
+        N   string `json:"n"`
+    }{
+        E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+        Kty: "RSA",
+        N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+    })
+    sum := sha256.Sum256(thumbprint)
+    return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// LoadKey reads an RSA private key from a PEM file in PKCS #1 or PKCS #8 form
+func LoadKey(path string) (*rsa.PrivateKey, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, fmt.Errorf("%s: no PEM block", path)
+    }
+
+    if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+        return key, nil
+    }
+    parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    key, ok := parsed.(*rsa.PrivateKey)
+    if !ok {
+        return nil, errors.New(path + ": not an RSA key")
+    }
+    return key, nil
+}
+
+// GenerateKey makes a fresh signing key, for when none is configured
+func GenerateKey() (*rsa.PrivateKey, error) {
+    return rsa.GenerateKey(rand.Reader, 2048)
+}
@@ -0,0 +1,366 @@
+package auth
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "cell-shared"
+    "cell-shared/config"
+    "cell-shared/logging"
+    "cell-shared/mtls"
+)
+
+// Headers every gateway and service signs its own calls with, naming itself
+// as <cell>/<service>. Like identity headers, they are only believed when
+// CallerSignatureHeader verifies. The signature covers the body's hash and a
+// nonce, so a captured call can be neither altered nor replayed.
+const (
+    CallerServiceHeader   = "X-Caller-Service"
+    CallerTimeHeader      = "X-Caller-Time"
+    CallerNonceHeader     = "X-Caller-Nonce"
+    CallerContentHeader   = "X-Caller-Content-SHA256"
+    CallerSignatureHeader = "X-Caller-Signature"
+)
+
+// defaultMaxCallerBodyBytes bounds the body read to check a caller
+// signature, matching the gateways' default body limit
+const defaultMaxCallerBodyBytes int64 = 1 << 20
+
+// AnyCaller in a CallerRule lets anyone through, including users and other
+// callers that do not name themselves
+const AnyCaller = "*"
+
+// CallerRule lists the workloads that may make requests matching Method and
+// Path, which match as in Rule. A caller is a <cell>/<service> name, a
+// <cell>/* for every workload in a cell, or AnyCaller.
+type CallerRule struct {
+    Method  string   `json:"method"`
+    Path    string   `json:"path"`
+    Callers []string `json:"callers"`
+}
+
+// CallerPolicy is an ordered list of caller rules; the first one that
+// matches decides, and a request no rule matches is denied
+type CallerPolicy []CallerRule
+
+// DefaultCallerPolicies mirror k8s/network-policies.yaml for each workload:
+// services only take calls from their own cell's gateway, order-service also
+// from payment-service, and gateways from anyone. The exception is reserving
+// stock, which only order-service does.
+var DefaultCallerPolicies = map[string]CallerPolicy{
+    "cell-a/gateway": {
+        {"PUT", "/products/{id}/stock", []string{"cell-b/order-service"}},
+        {"*", "/*", []string{AnyCaller}},
+    },
+    "cell-a/user-service": {
+        {"*", "/*", []string{"cell-a/gateway"}},
+    },
+    "cell-a/product-service": {
+        {"*", "/*", []string{"cell-a/gateway"}},
+    },
+    "cell-b/gateway": {
+        {"*", "/*", []string{AnyCaller}},
+    },
+    "cell-b/order-service": {
+        // Payment-service checks orders and marks them paid or refunded
+        {"GET", "/orders/{id}", []string{"cell-b/gateway", "cell-b/payment-service"}},
+        {"PUT", "/orders/{id}/status", []string{"cell-b/gateway", "cell-b/payment-service"}},
+        {"*", "/*", []string{"cell-b/gateway"}},
+    },
+    "cell-b/payment-service": {
+        {"*", "/*", []string{"cell-b/gateway"}},
+    },
+}
+
+// LoadCallerPolicy reads a JSON array of caller rules, which replaces the
+// workload's default policy
+func LoadCallerPolicy(path string) (CallerPolicy, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var policy CallerPolicy
+    if err := json.Unmarshal(data, &policy); err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    for i, rule := range policy {
+        if rule.Method == "" || !strings.HasPrefix(rule.Path, "/") || len(rule.Callers) == 0 {
+            return nil, fmt.Errorf("%s: rule %d needs a method, a path starting with / and callers", path, i)
+        }
+    }
+    return policy, nil
+}
+
+// Allows reports whether caller may make a request with method and path;
+// caller is "" for one that did not name itself
+func (p CallerPolicy) Allows(caller, method, path string) bool {
+    segments := split(path)
+    for _, rule := range p {
+        if (rule.Method == "*" || strings.EqualFold(rule.Method, method)) && matches(split(rule.Path), segments) {
+            return callerIn(rule.Callers, caller)
+        }
+    }
+    return false
+}
+
+func callerIn(allowed []string, caller string) bool {
+    for _, entry := range allowed {
+        if entry == AnyCaller || (caller != "" && entry == caller) {
+            return true
+        }
+        if cell, found := strings.CutSuffix(entry, "/*"); found && caller != "" && strings.HasPrefix(caller, cell+"/") {
+            return true
+        }
+    }
+    return false
+}
+
+// SignCaller sets the caller headers naming service as the maker of a
+// request with method, path and body, replacing any already there
+func (s *IdentitySigner) SignCaller(h http.Header, method, path, service string, body []byte) error {
+    nonce := make([]byte, 16)
+    if _, err := rand.Read(nonce); err != nil {
+        return err
+    }
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    digest := sha256.Sum256(body)
+    bodyHash := hex.EncodeToString(digest[:])
+    h.Set(CallerServiceHeader, service)
+    h.Set(CallerTimeHeader, timestamp)
+    h.Set(CallerNonceHeader, hex.EncodeToString(nonce))
+    h.Set(CallerContentHeader, bodyHash)
+    h.Set(CallerSignatureHeader, s.mac("caller", method, path, service, timestamp, h.Get(CallerNonceHeader), bodyHash))
+    return nil
+}
+
+// VerifyCaller returns the service named in h, or "" when there is none. It
+// fails like Verify does, and also when body does not match its signed hash
+// or the signature was already used. The nonce is only spent once
+// everything else checks out, so a mangled copy cannot block the genuine
+// request.
+func (s *IdentitySigner) VerifyCaller(h http.Header, method, path string, body []byte) (string, error) {
+    signature := h.Get(CallerSignatureHeader)
+    if signature == "" {
+        return "", nil
+    }
+    service, timestamp, nonce, bodyHash := h.Get(CallerServiceHeader), h.Get(CallerTimeHeader), h.Get(CallerNonceHeader), h.Get(CallerContentHeader)
+    if !hmac.Equal([]byte(signature), []byte(s.mac("caller", method, path, service, timestamp, nonce, bodyHash))) {
+        return "", errors.New("caller signature does not verify")
+    }
+    seconds, err := strconv.ParseInt(timestamp, 10, 64)
+    signedAt := time.Unix(seconds, 0)
+    if age := time.Since(signedAt); err != nil || age > s.maxAge || age < -s.maxAge {
+        return "", errors.New("caller signature has expired")
+    }
+    digest := sha256.Sum256(body)
+    if !hmac.Equal([]byte(bodyHash), []byte(hex.EncodeToString(digest[:]))) {
+        return "", errors.New("body does not match its signed hash")
+    }
+    if nonce == "" {
+        return "", errors.New("caller signature has no nonce")
+    }
+    if !s.firstUse(service+"\n"+nonce, signedAt.Add(s.maxAge)) {
+        return "", errors.New("caller signature was already used")
+    }
+    return service, nil
+}
+
+// firstUse records a nonce until its signature expires and reports whether
+// it had not been seen before. Once the map reaches pruneAt, expired nonces
+// are dropped, so it only holds what one IDENTITY_MAX_AGE of calls can replay.
+func (s *IdentitySigner) firstUse(nonce string, expires time.Time) bool {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    now := time.Now()
+    if expiry, seen := s.seen[nonce]; seen && now.Before(expiry) {
+        return false
+    }
+    if len(s.seen) >= s.pruneAt {
+        for n, expiry := range s.seen {
+            if !now.Before(expiry) {
+                delete(s.seen, n)
+            }
+        }
+        s.pruneAt = 2*len(s.seen) + 1024
+    }
+    s.seen[nonce] = expires
+    return true
+}
+
+// signedBody reads the body of an outbound request so its hash can be
+// signed, leaving it in place to be sent and re-sent
+func signedBody(req *http.Request) ([]byte, error) {
+    if req.Body == nil || req.Body == http.NoBody {
+        return nil, nil
+    }
+    if req.GetBody != nil {
+        body, err := req.GetBody()
+        if err != nil {
+            return nil, err
+        }
+        defer body.Close()
+        return io.ReadAll(body)
+    }
+    body, err := io.ReadAll(req.Body)
+    req.Body.Close()
+    if err != nil {
+        return nil, err
+    }
+    req.Body = io.NopCloser(bytes.NewReader(body))
+    req.GetBody = func() (io.ReadCloser, error) {
+        return io.NopCloser(bytes.NewReader(body)), nil
+    }
+    req.ContentLength = int64(len(body))
+    return body, nil
+}
+
+// outbound signs the caller headers on every call Transport makes; see
+// SignOutbound
+var outbound atomic.Pointer[outboundSigner]
+
+type outboundSigner struct {
+    signer  *IdentitySigner
+    service string
+}
+
+// SignOutbound makes every call through Transport name service as its
+// caller, signed with signer. Each process calls it once, for itself.
+func SignOutbound(signer *IdentitySigner, service string) {
+    outbound.Store(&outboundSigner{signer: signer, service: service})
+}
+
+// CallerGuard enforces this workload's caller policy. Callers are known by
+// the SPIFFE ID of their client certificate under mutual TLS, and otherwise
+// by the caller headers they signed.
+type CallerGuard struct {
+    service  string
+    cellID   string
+    enabled  bool
+    policy   CallerPolicy
+    signer   *IdentitySigner
+    maxBytes int64
+}
+
+// NewCallerGuard enforces SERVICE_POLICY_FILE, or else the default policy of
+// service, a <cell>/<service> name, unless SERVICE_AUTH_ENABLED is false. A
+// workload without a default policy takes calls from anyone. Signed bodies
+// over MAX_REQUEST_BODY_BYTES are refused.
+func NewCallerGuard(service, cellID string, signer *IdentitySigner) *CallerGuard {
+    g := &CallerGuard{
+        service:  service,
+        cellID:   cellID,
+        enabled:  config.Bool("SERVICE_AUTH_ENABLED", true),
+        policy:   DefaultCallerPolicies[service],
+        signer:   signer,
+        maxBytes: config.Int64("MAX_REQUEST_BODY_BYTES", defaultMaxCallerBodyBytes),
+    }
+    if !g.enabled {
+        log.Printf("SERVICE_AUTH_ENABLED is false; any workload may call %s", service)
+        return g
+    }
+    if path := config.Get("SERVICE_POLICY_FILE", ""); path != "" {
+        policy, err := LoadCallerPolicy(path)
+        if err != nil {
+            log.Fatalf("Loading service policy: %v", err)
+        }
+        g.policy = policy
+    }
+    if g.policy == nil {
+        g.policy = CallerPolicy{{"*", "/*", []string{AnyCaller}}}
+    }
+    return g
+}
+
+// Caller is the workload that made r: the one its client certificate names,
+// else the one its caller headers name, or "" for neither. Caller headers
+// that do not verify are logged and ignored. Checking them reads the body,
+// which is left for the handler to read again; it fails only when the body
+// is over the limit or cannot be read.
+func (g *CallerGuard) Caller(r *http.Request) (string, error) {
+    if id := mtls.PeerID(r); id != "" {
+        if uri, err := url.Parse(id); err == nil {
+            return strings.TrimPrefix(uri.Path, "/"), nil
+        }
+    }
+    if r.Header.Get(CallerSignatureHeader) == "" {
+        return "", nil
+    }
+
+    body, err := io.ReadAll(io.LimitReader(r.Body, g.maxBytes+1))
+    r.Body.Close()
+    if err != nil {
+        return "", err
+    }
+    if int64(len(body)) > g.maxBytes {
+        return "", &http.MaxBytesError{Limit: g.maxBytes}
+    }
+    r.Body = io.NopCloser(bytes.NewReader(body))
+
+    service, err := g.signer.VerifyCaller(r.Header, r.Method, r.URL.Path, body)
+    if err != nil {
+        logging.FromContext(r.Context()).Warn("Ignoring caller headers", "error", err)
+    }
+    return service, nil
+}
+
+type callerKey struct{}
+
+// WithCaller returns a copy of ctx made by caller, a <cell>/<service> name,
+// or by no workload when caller is ""
+func WithCaller(ctx context.Context, caller string) context.Context {
+    return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFromContext is the workload CallerGuard verified made the request,
+// or "" for one that did not name itself
+func CallerFromContext(ctx context.Context) string {
+    caller, _ := ctx.Value(callerKey{}).(string)
+    return caller
+}
+
+// Middleware lets a request through when the policy allows its caller, and
+// logs and refuses it with a 403 otherwise. The caller is put in the request
+// context even when the policy is not enforced.
+func (g *CallerGuard) Middleware(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        caller, err := g.Caller(r)
+        var maxBytesErr *http.MaxBytesError
+        if errors.As(err, &maxBytesErr) {
+            shared.WriteError(w, g.cellID, shared.ErrorPayloadTooLarge, "Request body too large")
+            return
+        }
+        if err != nil {
+            shared.WriteInvalid(w, g.cellID, []shared.FieldError{{Message: "could not be read"}})
+            return
+        }
+        r = r.WithContext(WithCaller(r.Context(), caller))
+        if !g.enabled || g.policy.Allows(caller, r.Method, r.URL.Path) {
+            next(w, r)
+            return
+        }
+
+        name := caller
+        if name == "" {
+            name = "Unidentified callers"
+        }
+        logging.FromContext(r.Context()).Warn("Denied caller", "caller", caller, "method", r.Method, "path", r.URL.Path)
+        shared.WriteError(w, g.cellID, shared.ErrorForbidden, fmt.Sprintf("%s may not call %s %s", name, r.Method, r.URL.Path))
+    }
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+    "net/http"
+    "testing"
+)
+
+const stockBody = `{"quantity":1}`
+
+func newCallerSigner(t *testing.T) *IdentitySigner {
+    t.Setenv("IDENTITY_SIGNING_KEY", "shared-key")
+    return NewIdentitySigner()
+}
+
+func TestVerifyCaller(t *testing.T) {
+    tests := []struct {
+        name        string
+        tamper      func(h http.Header)
+        method      string
+        path        string
+        body        string
+        wantService string
+        wantErr     bool
+    }{
+        {"signed", func(http.Header) {}, "PUT", "/products/p1/stock", stockBody, "cell-b/order-service", false},
+        {"unsigned", func(h http.Header) { h.Del(CallerSignatureHeader) }, "PUT", "/products/p1/stock", stockBody, "", false},
+        {"body changed", func(http.Header) {}, "PUT", "/products/p1/stock", `{"quantity":9}`, "", true},
+        {"path changed", func(http.Header) {}, "PUT", "/products/p2/stock", stockBody, "", true},
+        {"method changed", func(http.Header) {}, "POST", "/products/p1/stock", stockBody, "", true},
+        {"service changed", func(h http.Header) { h.Set(CallerServiceHeader, "cell-b/gateway") }, "PUT", "/products/p1/stock", stockBody, "", true},
+        {"nonce removed", func(h http.Header) { h.Del(CallerNonceHeader) }, "PUT", "/products/p1/stock", stockBody, "", true},
+        {"expired", func(h http.Header) { h.Set(CallerTimeHeader, "1") }, "PUT", "/products/p1/stock", stockBody, "", true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s := newCallerSigner(t)
+            h := http.Header{}
+            if err := s.SignCaller(h, "PUT", "/products/p1/stock", "cell-b/order-service", []byte(stockBody)); err != nil {
+                t.Fatal(err)
+            }
+            tt.tamper(h)
+
+            service, err := s.VerifyCaller(h, tt.method, tt.path, []byte(tt.body))
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("VerifyCaller() error = %v, want error %v", err, tt.wantErr)
+            }
+            if service != tt.wantService {
+                t.Errorf("VerifyCaller() = %q, want %q", service, tt.wantService)
+            }
+        })
+    }
+}
+
+func TestVerifyCallerSpendsNonceOnce(t *testing.T) {
+    s := newCallerSigner(t)
+    h := http.Header{}
+    if err := s.SignCaller(h, "PUT", "/products/p1/stock", "cell-b/order-service", []byte(stockBody)); err != nil {
+        t.Fatal(err)
+    }
+
+    steps := []struct {
+        name    string
+        body    string
+        wantErr bool
+    }{
+        // A tampered copy arriving first must not use up the nonce
+        {"tampered copy", `{"quantity":9}`, true},
+        {"genuine", stockBody, false},
+        {"replay", stockBody, true},
+    }
+    for _, step := range steps {
+        if _, err := s.VerifyCaller(h, "PUT", "/products/p1/stock", []byte(step.body)); (err != nil) != step.wantErr {
+            t.Fatalf("%s: VerifyCaller() error = %v, want error %v", step.name, err, step.wantErr)
+        }
+    }
+}
+
+func TestCallerPolicyAllows(t *testing.T) {
+    tests := []struct {
+        name     string
+        workload string
+        caller   string
+        method   string
+        path     string
+        want     bool
+    }{
+        {"order-service reserves stock", "cell-a/gateway", "cell-b/order-service", "PUT", "/products/p1/stock", true},
+        {"others may not reserve stock", "cell-a/gateway", "cell-b/payment-service", "PUT", "/products/p1/stock", false},
+        {"users may not reserve stock", "cell-a/gateway", "", "PUT", "/products/p1/stock", false},
+        {"gateway takes anyone", "cell-a/gateway", "", "GET", "/products", true},
+        {"service takes its gateway", "cell-a/user-service", "cell-a/gateway", "GET", "/users/u1", true},
+        {"service refuses the other gateway", "cell-a/user-service", "cell-b/gateway", "GET", "/users/u1", false},
+        {"service refuses anonymous", "cell-a/user-service", "", "GET", "/users/u1", false},
+        {"payment-service reads orders", "cell-b/order-service", "cell-b/payment-service", "get", "/orders/o1", true},
+        {"payment-service lists no orders", "cell-b/order-service", "cell-b/payment-service", "GET", "/orders", false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := DefaultCallerPolicies[tt.workload].Allows(tt.caller, tt.method, tt.path); got != tt.want {
+                t.Errorf("Allows(%q, %s %s) = %v, want %v", tt.caller, tt.method, tt.path, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestCallerIn(t *testing.T) {
+    tests := []struct {
+        name    string
+        allowed []string
+        caller  string
+        want    bool
+    }{
+        {"named", []string{"cell-b/order-service"}, "cell-b/order-service", true},
+        {"not named", []string{"cell-b/order-service"}, "cell-b/gateway", false},
+        {"whole cell", []string{"cell-b/*"}, "cell-b/gateway", true},
+        {"cell sharing a prefix", []string{"cell-b/*"}, "cell-bb/gateway", false},
+        {"anyone", []string{AnyCaller}, "", true},
+        {"anonymous", []string{"cell-b/*"}, "", false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := callerIn(tt.allowed, tt.caller); got != tt.want {
+                t.Errorf("callerIn(%v, %q) = %v, want %v", tt.allowed, tt.caller, got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,237 @@
+package auth
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "errors"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "cell-shared"
+    "cell-shared/config"
+    "cell-shared/logging"
+)
+
+// Headers a gateway passes the verified caller on in. They are only to be
+// believed when IdentitySignatureHeader verifies.
+const (
+    IdentityUserHeader      = "X-Identity-User"
+    IdentityCellHeader      = "X-Identity-Cell"
+    IdentityRolesHeader     = "X-Identity-Roles"
+    IdentityTimeHeader      = "X-Identity-Time"
+    IdentitySignatureHeader = "X-Identity-Signature"
+)
+
+var identityHeaders = []string{IdentityUserHeader, IdentityCellHeader, IdentityRolesHeader, IdentityTimeHeader, IdentitySignatureHeader}
+
+// developmentIdentityKey is used when IDENTITY_SIGNING_KEY is unset in dev
+// mode, so a local run works without setup; anyone who reads this can forge
+// identities
+const developmentIdentityKey = "development-only-identity-key"
+
+// Identity is the caller a gateway verified an access token for
+type Identity struct {
+    UserID string
+    Cell   string
+    Roles  []string
+}
+
+// HasRole reports whether the caller was granted role
+func (i *Identity) HasRole(role string) bool {
+    return hasRole(i.Roles, role)
+}
+
+// CanAccess reports whether the caller may see a record belonging to userID:
+// their own records, or every record for an admin
+func (i *Identity) CanAccess(userID string) bool {
+    return i.HasRole(RoleAdmin) || (i.UserID != "" && i.UserID == userID)
+}
+
+// IdentitySigner signs identity headers on gateways and verifies them on
+// services with a key they share
+type IdentitySigner struct {
+    key      []byte
+    maxAge   time.Duration
+    enforced bool
+
+    mutex   sync.Mutex
+    seen    map[string]time.Time // caller and nonce -> when the signature expires
+    pruneAt int
+}
+
+// NewIdentitySigner uses IDENTITY_SIGNING_KEY and accepts signatures up to
+// IDENTITY_MAX_AGE old. Only in dev mode may the key be unset. With
+// AUTH_ENABLED=false, requests without an identity act as an admin.
+func NewIdentitySigner() *IdentitySigner {
+    key := config.Get("IDENTITY_SIGNING_KEY", "")
+    if key == "" {
+        if !config.DevMode() {
+            log.Fatalf("IDENTITY_SIGNING_KEY is not set; give every gateway and service a shared key, or set DEV_MODE=true to use the development key")
+        }
+        log.Printf("IDENTITY_SIGNING_KEY is not set; using the development key, which lets anyone forge identity headers")
+        key = developmentIdentityKey
+    }
+    return &IdentitySigner{
+        key:      []byte(key),
+        maxAge:   config.Duration("IDENTITY_MAX_AGE", 5*time.Minute),
+        enforced: config.Bool("AUTH_ENABLED", true),
+        seen:     make(map[string]time.Time),
+        pruneAt:  1024,
+    }
+}
+
+// Sign sets the identity headers for a request with method and path,
+// replacing any the caller sent
+func (s *IdentitySigner) Sign(h http.Header, method, path string, id Identity) {
+    StripIdentity(h)
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    roles := strings.Join(id.Roles, ",")
+    h.Set(IdentityUserHeader, id.UserID)
+    h.Set(IdentityCellHeader, id.Cell)
+    if roles != "" {
+        h.Set(IdentityRolesHeader, roles)
+    }
+    h.Set(IdentityTimeHeader, timestamp)
+    h.Set(IdentitySignatureHeader, s.mac(method, path, id.UserID, id.Cell, roles, timestamp))
+}
+
+// Verify returns the identity in h, or nil when there is none. It fails when
+// the headers are there but their signature does not verify, has expired or
+// was made for another method or path.
+func (s *IdentitySigner) Verify(h http.Header, method, path string) (*Identity, error) {
+    signature := h.Get(IdentitySignatureHeader)
+    if signature == "" {
+        return nil, nil
+    }
+    user, cell, roles, timestamp := h.Get(IdentityUserHeader), h.Get(IdentityCellHeader), h.Get(IdentityRolesHeader), h.Get(IdentityTimeHeader)
+    if !hmac.Equal([]byte(signature), []byte(s.mac(method, path, user, cell, roles, timestamp))) {
+        return nil, errors.New("identity signature does not verify")
+    }
+    seconds, err := strconv.ParseInt(timestamp, 10, 64)
+    if age := time.Since(time.Unix(seconds, 0)); err != nil || age > s.maxAge || age < -s.maxAge {
+        return nil, errors.New("identity signature has expired")
+    }
+
+    id := &Identity{UserID: user, Cell: cell}
+    if roles != "" {
+        id.Roles = strings.Split(roles, ",")
+    }
+    return id, nil
+}
+
+func (s *IdentitySigner) mac(fields ...string) string {
+    h := hmac.New(sha256.New, s.key)
+    h.Write([]byte(strings.Join(fields, "\n")))
+    return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// StripIdentity removes identity headers, so only a gateway's own survive
+func StripIdentity(h http.Header) {
+    for _, header := range identityHeaders {
+        h.Del(header)
+    }
+}
+
+type identityKey struct{}
+type tokenKey struct{}
+type signerKey struct{}
+
+// Middleware puts the verified identity of each request, if any, and its
+// bearer token in the request context. Identity headers that do not verify
+// are logged and ignored, so the request is treated as anonymous.
+func (s *IdentitySigner) Middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ctx := context.WithValue(r.Context(), signerKey{}, s)
+        id, err := s.Verify(r.Header, r.Method, r.URL.Path)
+        if err != nil {
+            logging.FromContext(ctx).Warn("Ignoring identity headers", "error", err)
+        }
+        if id == nil && !s.enforced {
+            // Nothing checks tokens, so nobody can be told apart
+            id = &Identity{Roles: []string{RoleAdmin}}
+        }
+        if id != nil {
+            ctx = WithIdentity(ctx, id)
+        }
+        if token := BearerToken(r); token != "" {
+            ctx = context.WithValue(ctx, tokenKey{}, token)
+        }
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
+
+// WithIdentity returns a copy of ctx acting as id, or as nobody when id is nil
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+    return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFromContext is the caller the gateway verified, or nil for an
+// anonymous request
+func IdentityFromContext(ctx context.Context) *Identity {
+    id, _ := ctx.Value(identityKey{}).(*Identity)
+    return id
+}
+
+// Caller is the identity r acts as. Only requests a gateway verified a token
+// for have one, so for any other it writes a 401 and returns nil.
+func Caller(w http.ResponseWriter, r *http.Request, cellID string) *Identity {
+    id := IdentityFromContext(r.Context())
+    if id == nil {
+        shared.WriteError(w, cellID, shared.ErrorUnauthorized, "Request has no verified identity")
+    }
+    return id
+}
+
+// BearerToken is the token in the request's Authorization header, if any
+func BearerToken(r *http.Request) string {
+    scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+    if !found || !strings.EqualFold(scheme, "Bearer") {
+        return ""
+    }
+    return strings.TrimSpace(token)
+}
+
+// Transport passes the caller of the request in the context on to outbound
+// calls: the bearer token, so another cell's gateway accepts it, and the
+// identity, signed for the outbound method and path, so a service in the
+// same cell does. It also signs the caller headers naming this workload,
+// replacing any the request carried in.
+type Transport struct {
+    Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+    ctx := req.Context()
+    token, _ := ctx.Value(tokenKey{}).(string)
+    signer, _ := ctx.Value(signerKey{}).(*IdentitySigner)
+    id := IdentityFromContext(ctx)
+    self := outbound.Load()
+
+    addToken := token != "" && req.Header.Get("Authorization") == ""
+    addIdentity := signer != nil && id != nil && req.Header.Get(IdentitySignatureHeader) == ""
+    if addToken || addIdentity || self != nil {
+        req = req.Clone(ctx)
+        if addToken {
+            req.Header.Set("Authorization", "Bearer "+token)
+        }
+        if addIdentity {
+            signer.Sign(req.Header, req.Method, req.URL.Path, *id)
+        }
+        if self != nil {
+            body, err := signedBody(req)
+            if err != nil {
+                return nil, err
+            }
+            if err := self.signer.SignCaller(req.Header, req.Method, req.URL.Path, self.service, body); err != nil {
+                return nil, err
+            }
+        }
+    }
+    return t.Base.RoundTrip(req)
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+
+    "golang.org/x/crypto/bcrypt"
+)
+
+// MaxPasswordBytes is the longest password bcrypt hashes in full; longer
+// ones are rejected rather than silently truncated
+const MaxPasswordBytes = 72
+
+// Passwords hashes and checks passwords with bcrypt at one cost
+type Passwords struct {
+    cost  int
+    dummy []byte
+}
+
+// NewPasswords hashes at cost, which falls back to bcrypt's default when it
+// is outside the range bcrypt supports
+func NewPasswords(cost int) *Passwords {
+    if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+        cost = bcrypt.DefaultCost
+    }
+    dummy, _ := bcrypt.GenerateFromPassword([]byte("not a password"), cost)
+    return &Passwords{cost: cost, dummy: dummy}
+}
+
+// Hash hashes password, which must be at most MaxPasswordBytes long
+func (p *Passwords) Hash(password string) ([]byte, error) {
+    return bcrypt.GenerateFromPassword([]byte(password), p.cost)
+}
+
+// Check reports whether password matches hash. With a nil hash it still
+// spends the time of a comparison, so a login for an unknown email takes as
+// long as one with a wrong password.
+func (p *Passwords) Check(hash []byte, password string) bool {
+    if hash == nil {
+        bcrypt.CompareHashAndPassword(p.dummy, []byte(password))
+        return false
+    }
+    return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// NewRefreshToken returns an opaque random token and the hash to store it
+// under, so a leaked store does not leak usable tokens
+func NewRefreshToken() (token, hash string, err error) {
+    raw := make([]byte, 32)
+    if _, err := rand.Read(raw); err != nil {
+        return "", "", err
+    }
+    token = base64.RawURLEncoding.EncodeToString(raw)
+    return token, HashRefreshToken(token), nil
+}
+
+// HashRefreshToken is the key a refresh token is stored under
+func HashRefreshToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "strings"
+)
+
+// What a Rule can require; any other value is a role the token must grant
+const (
+    Public        = "public"
+    Authenticated = "authenticated"
+)
+
+// Rule is what a request needs to be let through. Method is an HTTP method
+// or "*". Path segments in braces match any one segment, and a final "*"
+// matches whatever follows, including nothing.
+type Rule struct {
+    Method  string `json:"method"`
+    Path    string `json:"path"`
+    Require string `json:"require"`
+}
+
+// Policy is an ordered list of rules; the first one that matches decides
+type Policy []Rule
+
+// DefaultPolicy lets anyone browse the catalog, register and log in, lets
+// signed-in users place and pay for orders and see their own, which the
+// services enforce, and keeps listing users, changing the catalog, order
+// statuses and refunds to admins
+var DefaultPolicy = Policy{
+    {"POST", "/auth/*", Public},
+    {"GET", "/.well-known/jwks.json", Public},
+
+    {"GET", "/products", Public},
+    {"GET", "/products/{id}", Public},
+    // Order-service reserves stock on behalf of the user placing the order
+    {"PUT", "/products/{id}/stock", Authenticated},
+    {"*", "/products/*", RoleAdmin},
+
+    {"*", "/users", RoleAdmin},
+    // User-service only lets users at their own record
+    {"*", "/users/{id}", Authenticated},
+
+    {"POST", "/orders", Authenticated},
+    {"GET", "/orders", Authenticated},
+    {"GET", "/orders/{id}", Authenticated},
+    {"*", "/orders/*", RoleAdmin},
+
+    {"POST", "/payments", Authenticated},
+    {"GET", "/payments", Authenticated},
+    {"GET", "/payments/{id}", Authenticated},
+    {"GET", "/payments/order/{order_id}", Authenticated},
+    {"*", "/payments/*", RoleAdmin},
+}
+
+// LoadPolicy reads a JSON array of rules, which replaces DefaultPolicy
+func LoadPolicy(path string) (Policy, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var policy Policy
+    if err := json.Unmarshal(data, &policy); err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    for i, rule := range policy {
+        if rule.Method == "" || !strings.HasPrefix(rule.Path, "/") || rule.Require == "" {
+            return nil, fmt.Errorf("%s: rule %d needs a method, a path starting with / and a requirement", path, i)
+        }
+    }
+    return policy, nil
+}
+
+// Requirement is what the first matching rule requires of a request, or
+// Authenticated when no rule matches
+func (p Policy) Requirement(method, path string) string {
+    segments := split(path)
+    for _, rule := range p {
+        if (rule.Method == "*" || strings.EqualFold(rule.Method, method)) && matches(split(rule.Path), segments) {
+            return rule.Require
+        }
+    }
+    return Authenticated
+}
+
+func split(path string) []string {
+    path = strings.Trim(path, "/")
+    if path == "" {
+        return nil
+    }
+    return strings.Split(path, "/")
+}
+
+func matches(pattern, segments []string) bool {
+    for i, part := range pattern {
+        if part == "*" && i == len(pattern)-1 {
+            return true
+        }
+        if i >= len(segments) {
+            return false
+        }
+        if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+            continue
+        }
+        if part != segments[i] {
+            return false
+        }
+    }
+    return len(pattern) == len(segments)
+}
@@ -0,0 +1,59 @@
+package auth
+
+import "testing"
+
+func TestPolicyRequirement(t *testing.T) {
+    tests := []struct {
+        name   string
+        method string
+        path   string
+        want   string
+    }{
+        {"browse catalog", "GET", "/products", Public},
+        {"view product", "GET", "/products/p1", Public},
+        {"trailing slash", "GET", "/products/", Public},
+        {"method case", "get", "/products/p1", Public},
+        {"log in", "POST", "/auth/login", Public},
+        {"final star matches nothing", "POST", "/auth", Public},
+        {"reserve stock", "PUT", "/products/p1/stock", Authenticated},
+        {"change catalog", "DELETE", "/products/p1", RoleAdmin},
+        {"list users", "GET", "/users", RoleAdmin},
+        {"own record", "GET", "/users/u1", Authenticated},
+        {"placeholder is one segment", "GET", "/users/u1/orders", Authenticated},
+        {"order status", "PUT", "/orders/o1/status", RoleAdmin},
+        {"payments by order", "GET", "/payments/order/o1", Authenticated},
+        {"refund", "POST", "/payments/p1/refund", RoleAdmin},
+        {"no rule", "GET", "/reports", Authenticated},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := DefaultPolicy.Requirement(tt.method, tt.path); got != tt.want {
+                t.Errorf("Requirement(%s %s) = %q, want %q", tt.method, tt.path, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestMatches(t *testing.T) {
+    tests := []struct {
+        pattern string
+        path    string
+        want    bool
+    }{
+        {"/products", "/products", true},
+        {"/products", "/products/p1", false},
+        {"/products/{id}", "/products/p1", true},
+        {"/products/{id}", "/products", false},
+        {"/products/*", "/products", true},
+        {"/products/*", "/products/p1/stock", true},
+        {"/*", "/", true},
+        {"/orders/{id}/status", "/orders/o1/items", false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.pattern+" "+tt.path, func(t *testing.T) {
+            if got := matches(split(tt.pattern), split(tt.path)); got != tt.want {
+                t.Errorf("matches(%s, %s) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,210 @@
+package auth
+
+import (
+    "context"
+    "crypto/rsa"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math/big"
+    "net/http"
+    "os"
+    "sync"
+    "time"
+
+    "cell-shared"
+    "github.com/golang-jwt/jwt/v5"
+)
+
+var (
+    // ErrKeysUnavailable means the JWKS could not be loaded, so no token can
+    // be verified; it is the key source failing, not the token
+    ErrKeysUnavailable = errors.New("signing keys unavailable")
+    // ErrUnknownKey means the token names a key the JWKS does not have
+    ErrUnknownKey = errors.New("unknown signing key")
+)
+
+// refetchInterval is the least time between two fetches of a remote JWKS, so
+// tokens with made-up key IDs cannot make the gateway hammer user-service
+const refetchInterval = 10 * time.Second
+
+// KeySet holds the public keys tokens are verified with. A remote set is
+// fetched on first use and again once it is older than its TTL or a token
+// names a key it does not know; when a refresh fails it keeps the keys it
+// has.
+type KeySet struct {
+    fetch func(ctx context.Context) (shared.JWKS, error)
+    ttl   time.Duration
+
+    mu      sync.Mutex
+    keys    map[string]*rsa.PublicKey
+    fetched time.Time
+    tried   time.Time
+
+    // refreshing is closed when the fetch in progress ends, and nil when
+    // there is none
+    refreshing chan struct{}
+}
+
+// NewFileKeySet reads a JWKS file once
+func NewFileKeySet(path string) (*KeySet, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var jwks shared.JWKS
+    if err := json.Unmarshal(data, &jwks); err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    keys := parseKeys(jwks)
+    if len(keys) == 0 {
+        return nil, fmt.Errorf("%s: no RS256 signing keys", path)
+    }
+    return &KeySet{keys: keys}, nil
+}
+
+// NewRemoteKeySet fetches the JWKS at url with client and refreshes it
+// every ttl
+func NewRemoteKeySet(url string, client *http.Client, ttl time.Duration) *KeySet {
+    fetch := func(ctx context.Context) (shared.JWKS, error) {
+        var jwks shared.JWKS
+        req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+        if err != nil {
+            return jwks, err
+        }
+        resp, err := client.Do(req)
+        if err != nil {
+            return jwks, err
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+            return jwks, fmt.Errorf("%s answered %d", url, resp.StatusCode)
+        }
+        return jwks, json.NewDecoder(resp.Body).Decode(&jwks)
+    }
+    return &KeySet{fetch: fetch, ttl: ttl}
+}
+
+// Key returns the key with ID kid. The JWKS is fetched without holding the
+// lock, so only requests for a key the set does not have yet wait for it.
+func (k *KeySet) Key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+    k.mu.Lock()
+    _, known := k.keys[kid]
+    stale := k.fetch != nil && time.Since(k.fetched) > k.ttl
+    refreshing, claimed := k.refreshing, false
+    if (!known || stale) && k.fetch != nil && refreshing == nil && time.Since(k.tried) >= refetchInterval {
+        k.tried = time.Now()
+        k.refreshing = make(chan struct{})
+        refreshing, claimed = k.refreshing, true
+    }
+    k.mu.Unlock()
+
+    if claimed {
+        if err := k.refresh(ctx, refreshing); err != nil {
+            return nil, err
+        }
+    } else if !known && refreshing != nil {
+        select {
+        case <-refreshing:
+        case <-ctx.Done():
+            return nil, fmt.Errorf("%w: %v", ErrKeysUnavailable, ctx.Err())
+        }
+    }
+
+    k.mu.Lock()
+    defer k.mu.Unlock()
+    key, known := k.keys[kid]
+    if !known {
+        if k.keys == nil {
+            return nil, ErrKeysUnavailable
+        }
+        return nil, ErrUnknownKey
+    }
+    return key, nil
+}
+
+// refresh fetches the JWKS and swaps its keys in, keeping the old ones when
+// the fetch fails, then wakes the requests waiting on done
+func (k *KeySet) refresh(ctx context.Context, done chan struct{}) error {
+    jwks, err := k.fetch(ctx)
+    var keys map[string]*rsa.PublicKey
+    if err == nil {
+        if keys = parseKeys(jwks); keys == nil {
+            err = errors.New("no RS256 signing keys")
+        }
+    }
+
+    k.mu.Lock()
+    defer k.mu.Unlock()
+    defer close(done)
+    k.refreshing = nil
+    if keys != nil {
+        k.keys, k.fetched = keys, time.Now()
+    }
+    if k.keys == nil {
+        // Without any keys every request fails, so try again sooner
+        k.tried = time.Now().Add(time.Second - refetchInterval)
+        return fmt.Errorf("%w: %v", ErrKeysUnavailable, err)
+    }
+    return nil
+}
+
+// parseKeys decodes the RS256 signing keys of jwks by key ID, skipping any
+// other kind of key
+func parseKeys(jwks shared.JWKS) map[string]*rsa.PublicKey {
+    keys := make(map[string]*rsa.PublicKey)
+    for _, jwk := range jwks.Keys {
+        if jwk.KeyType != "RSA" || (jwk.Algorithm != "" && jwk.Algorithm != Algorithm) || (jwk.Use != "" && jwk.Use != "sig") {
+            continue
+        }
+        n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+        e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+        if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+            continue
+        }
+        keys[jwk.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+    }
+    if len(keys) == 0 {
+        return nil
+    }
+    return keys
+}
+
+// Verifier checks access tokens against a KeySet
+type Verifier struct {
+    keys    *KeySet
+    options []jwt.ParserOption
+}
+
+// NewVerifier accepts RS256 tokens signed by a key in keys that have not
+// expired. When issuer is set, tokens must name it.
+func NewVerifier(keys *KeySet, issuer string) *Verifier {
+    options := []jwt.ParserOption{
+        jwt.WithValidMethods([]string{Algorithm}),
+        jwt.WithExpirationRequired(),
+        jwt.WithIssuedAt(),
+        jwt.WithLeeway(30 * time.Second),
+    }
+    if issuer != "" {
+        options = append(options, jwt.WithIssuer(issuer))
+    }
+    return &Verifier{keys: keys, options: options}
+}
+
+// Verify returns the claims of a valid token. The error wraps
+// ErrKeysUnavailable when the token could not be checked at all.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+    claims := &Claims{}
+    _, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+        kid, _ := t.Header["kid"].(string)
+        return v.keys.Key(ctx, kid)
+    }, v.options...)
+    if err != nil {
+        return nil, err
+    }
+    if claims.Subject == "" {
+        return nil, errors.New("token has no subject")
+    }
+    return claims, nil
+}
@@ -0,0 +1,287 @@
+// Package client is a typed Go client for the cell APIs. It works against a
+// gateway or a service directly, decodes ServiceResponse envelopes into the
+// shared types and turns failed responses into *Error.
+//
+//     api := client.New("http://cell-a-gateway:8010", client.WithHTTPClient(server.NewClient(30*time.Second)))
+//     product, err := api.Products.ReserveStock(ctx, productID, 2)
+package client
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+
+    "cell-shared"
+)
+
+// Client calls the user, auth, product, order and payment APIs behind one
+// base URL
+type Client struct {
+    Users    *Users
+    Auth     *Auth
+    Products *Products
+    Orders   *Orders
+    Payments *Payments
+
+    baseURL    string
+    httpClient *http.Client
+    host       string
+    headers    http.Header
+}
+
+type options struct {
+    httpClient *http.Client
+    host       string
+    headers    http.Header
+    attempts   int
+    backoff    time.Duration
+}
+
+// Option configures a Client
+type Option func(*options)
+
+// WithHTTPClient sends requests through c, so callers can plug in their own
+// timeouts and transports; services pass server.NewClient to keep tracing
+// and request IDs
+func WithHTTPClient(c *http.Client) Option {
+    return func(o *options) {
+        o.httpClient = c
+    }
+}
+
+// WithHost overrides the Host header, for reaching a gateway through an
+// ingress or load balancer by address
+func WithHost(host string) Option {
+    return func(o *options) {
+        o.host = host
+    }
+}
+
+// WithHeader adds a header to every request
+func WithHeader(key, value string) Option {
+    return func(o *options) {
+        o.headers.Add(key, value)
+    }
+}
+
+// WithRetry retries safe requests up to attempts times in total, see
+// RetryTransport
+func WithRetry(attempts int, backoff time.Duration) Option {
+    return func(o *options) {
+        o.attempts = attempts
+        o.backoff = backoff
+    }
+}
+
+func New(baseURL string, opts ...Option) *Client {
+    o := &options{
+        httpClient: &http.Client{Timeout: 30 * time.Second},
+        headers:    make(http.Header),
+    }
+    for _, opt := range opts {
+        opt(o)
+    }
+
+    httpClient := o.httpClient
+    if o.attempts > 1 {
+        // Copy so the caller's client is left as it was
+        wrapped := *httpClient
+        wrapped.Transport = &RetryTransport{Base: httpClient.Transport, Attempts: o.attempts, Backoff: o.backoff}
+        httpClient = &wrapped
+    }
+
+    c := &Client{
+        baseURL:    strings.TrimRight(baseURL, "/"),
+        httpClient: httpClient,
+        host:       o.host,
+        headers:    o.headers,
+    }
+    c.Users = &Users{c: c}
+    c.Auth = &Auth{c: c}
+    c.Products = &Products{c: c}
+    c.Orders = &Orders{c: c}
+    c.Payments = &Payments{c: c}
+    return c
+}
+
+// Error is a request the API answered with a failure, carrying the status
+// code and the error from the envelope
+type Error struct {
+    StatusCode   int
+    Code         string
+    Message      string
+    Details      []shared.FieldError
+    CellID       string
+    RequestID    string
+    Retryable    bool
+    Upstream     string
+    UpstreamCell string
+    Reason       string
+}
+
+func (e *Error) Error() string {
+    message := e.Message
+    if e.Code != "" {
+        message = e.Code + ": " + message
+    }
+    if e.Upstream != "" {
+        message += fmt.Sprintf(" (%s in %s %s)", e.Upstream, e.UpstreamCell, e.Reason)
+    }
+    if message == "" {
+        return fmt.Sprintf("request failed with status %d", e.StatusCode)
+    }
+    return fmt.Sprintf("request failed with status %d: %s", e.StatusCode, message)
+}
+
+// StatusCode returns the HTTP status of an *Error in err's chain, or 0 when
+// the request never got an answer
+func StatusCode(err error) int {
+    var apiErr *Error
+    if errors.As(err, &apiErr) {
+        return apiErr.StatusCode
+    }
+    return 0
+}
+
+// Code returns the error code of an *Error in err's chain, or "" when the
+// request never got an answer
+func Code(err error) string {
+    var apiErr *Error
+    if errors.As(err, &apiErr) {
+        return apiErr.Code
+    }
+    return ""
+}
+
+// IsRetryable reports whether the API marked the failure as worth retrying
+func IsRetryable(err error) bool {
+    var apiErr *Error
+    return errors.As(err, &apiErr) && apiErr.Retryable
+}
+
+// UpstreamError describes err, from a call to upstream in upstreamCell, as
+// the error to answer the caller with. An upstream that answered keeps its
+// code as the reason and its retryable flag; one that did not is classified
+// by shared.UpstreamError.
+func UpstreamError(message, upstream, upstreamCell string, err error) *shared.Error {
+    var apiErr *Error
+    if !errors.As(err, &apiErr) {
+        return shared.UpstreamError(message, upstream, upstreamCell, err)
+    }
+
+    e := shared.NewError(shared.ErrorUpstreamUnavailable, message)
+    if apiErr.Code == shared.ErrorUpstreamTimeout {
+        e.Code = shared.ErrorUpstreamTimeout
+    }
+    e.Upstream = upstream
+    e.UpstreamCell = upstreamCell
+    e.Reason = fmt.Sprintf("answered %d", apiErr.StatusCode)
+    if apiErr.Code != "" {
+        e.Reason += " " + apiErr.Code
+    }
+    e.Retryable = apiErr.Retryable || apiErr.StatusCode >= http.StatusInternalServerError
+    return e
+}
+
+// IsNotFound reports whether the API answered 404
+func IsNotFound(err error) bool {
+    return StatusCode(err) == http.StatusNotFound
+}
+
+// IsRejected reports whether the API answered with a 4xx, meaning the
+// request itself was refused rather than the API being unavailable
+func IsRejected(err error) bool {
+    status := StatusCode(err)
+    return status >= 400 && status < 500
+}
+
+// envelope is shared.ServiceResponse with data left undecoded
+type envelope struct {
+    Success bool            `json:"success"`
+    Data    json.RawMessage `json:"data"`
+    Error   *shared.Error   `json:"error"`
+    CellID  string          `json:"cell_id"`
+}
+
+// do sends body as JSON and decodes the envelope's data into out
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+    var reader io.Reader
+    if body != nil {
+        data, err := json.Marshal(body)
+        if err != nil {
+            return fmt.Errorf("encoding request: %w", err)
+        }
+        reader = bytes.NewReader(data)
+    }
+
+    req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+    if err != nil {
+        return err
+    }
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    req.Header.Set("Accept", "application/json")
+    for key, values := range c.headers {
+        for _, value := range values {
+            req.Header.Add(key, value)
+        }
+    }
+    if c.host != "" {
+        req.Host = c.host
+    }
+
+    resp, err := c.httpClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    raw, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return fmt.Errorf("reading response: %w", err)
+    }
+
+    var env envelope
+    if err := json.Unmarshal(raw, &env); err != nil {
+        // Proxies in front of the cells may still answer in plain text
+        if resp.StatusCode >= 400 {
+            return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(raw))}
+        }
+        return fmt.Errorf("decoding response: %w", err)
+    }
+    if resp.StatusCode >= 400 || !env.Success {
+        apiErr := &Error{StatusCode: resp.StatusCode, CellID: env.CellID}
+        if e := env.Error; e != nil {
+            apiErr.Code = e.Code
+            apiErr.Message = e.Message
+            apiErr.Details = e.Details
+            apiErr.CellID = e.CellID
+            apiErr.RequestID = e.RequestID
+            apiErr.Retryable = e.Retryable
+            apiErr.Upstream = e.Upstream
+            apiErr.UpstreamCell = e.UpstreamCell
+            apiErr.Reason = e.Reason
+        }
+        return apiErr
+    }
+
+    if out != nil && len(env.Data) > 0 {
+        if err := json.Unmarshal(env.Data, out); err != nil {
+            return fmt.Errorf("decoding response data: %w", err)
+        }
+    }
+    return nil
+}
+
+// escape makes an ID safe to use as one path segment
+func escape(id string) string {
+    return url.PathEscape(id)
+}
@@ -0,0 +1,245 @@
+package client
+
+import (
+    "context"
+    "net/http"
+    "net/url"
+
+    "cell-shared"
+)
+
+// Users calls /users on Cell A
+type Users struct {
+    c *Client
+}
+
+func (u *Users) Create(ctx context.Context, user shared.User) (*shared.User, error) {
+    var created shared.User
+    if err := u.c.do(ctx, http.MethodPost, "/users", user, &created); err != nil {
+        return nil, err
+    }
+    return &created, nil
+}
+
+func (u *Users) Get(ctx context.Context, id string) (*shared.User, error) {
+    var user shared.User
+    if err := u.c.do(ctx, http.MethodGet, "/users/"+escape(id), nil, &user); err != nil {
+        return nil, err
+    }
+    return &user, nil
+}
+
+func (u *Users) List(ctx context.Context) ([]shared.User, error) {
+    var users []shared.User
+    if err := u.c.do(ctx, http.MethodGet, "/users", nil, &users); err != nil {
+        return nil, err
+    }
+    return users, nil
+}
+
+// FindByEmail returns the user with email, compared case-insensitively, or
+// nil when there is none
+func (u *Users) FindByEmail(ctx context.Context, email string) (*shared.User, error) {
+    var users []shared.User
+    if err := u.c.do(ctx, http.MethodGet, "/users?email="+url.QueryEscape(email), nil, &users); err != nil {
+        return nil, err
+    }
+    if len(users) == 0 {
+        return nil, nil
+    }
+    return &users[0], nil
+}
+
+// Update changes the fields set in updates
+func (u *Users) Update(ctx context.Context, id string, updates shared.UserUpdate) (*shared.User, error) {
+    var user shared.User
+    if err := u.c.do(ctx, http.MethodPut, "/users/"+escape(id), updates, &user); err != nil {
+        return nil, err
+    }
+    return &user, nil
+}
+
+func (u *Users) Delete(ctx context.Context, id string) error {
+    return u.c.do(ctx, http.MethodDelete, "/users/"+escape(id), nil, nil)
+}
+
+// Auth calls /auth on Cell A
+type Auth struct {
+    c *Client
+}
+
+// Register creates a user who can log in with the password
+func (a *Auth) Register(ctx context.Context, registration shared.Registration) (*shared.User, error) {
+    var user shared.User
+    if err := a.c.do(ctx, http.MethodPost, "/auth/register", registration, &user); err != nil {
+        return nil, err
+    }
+    return &user, nil
+}
+
+// Login trades an email and password for tokens. Wrong credentials fail
+// with shared.ErrorUnauthorized.
+func (a *Auth) Login(ctx context.Context, email, password string) (*shared.Tokens, error) {
+    var tokens shared.Tokens
+    if err := a.c.do(ctx, http.MethodPost, "/auth/login", shared.Credentials{Email: email, Password: password}, &tokens); err != nil {
+        return nil, err
+    }
+    return &tokens, nil
+}
+
+// Refresh trades a refresh token, which stops working, for new tokens
+func (a *Auth) Refresh(ctx context.Context, refreshToken string) (*shared.Tokens, error) {
+    var tokens shared.Tokens
+    if err := a.c.do(ctx, http.MethodPost, "/auth/refresh", shared.RefreshRequest{RefreshToken: refreshToken}, &tokens); err != nil {
+        return nil, err
+    }
+    return &tokens, nil
+}
+
+// Logout revokes a refresh token
+func (a *Auth) Logout(ctx context.Context, refreshToken string) error {
+    return a.c.do(ctx, http.MethodPost, "/auth/logout", shared.RefreshRequest{RefreshToken: refreshToken}, nil)
+}
+
+// Products calls /products on Cell A
+type Products struct {
+    c *Client
+}
+
+func (p *Products) Create(ctx context.Context, product shared.Product) (*shared.Product, error) {
+    var created shared.Product
+    if err := p.c.do(ctx, http.MethodPost, "/products", product, &created); err != nil {
+        return nil, err
+    }
+    return &created, nil
+}
+
+func (p *Products) Get(ctx context.Context, id string) (*shared.Product, error) {
+    var product shared.Product
+    if err := p.c.do(ctx, http.MethodGet, "/products/"+escape(id), nil, &product); err != nil {
+        return nil, err
+    }
+    return &product, nil
+}
+
+func (p *Products) List(ctx context.Context) ([]shared.Product, error) {
+    var products []shared.Product
+    if err := p.c.do(ctx, http.MethodGet, "/products", nil, &products); err != nil {
+        return nil, err
+    }
+    return products, nil
+}
+
+// Update changes the fields set in updates
+func (p *Products) Update(ctx context.Context, id string, updates shared.ProductUpdate) (*shared.Product, error) {
+    var product shared.Product
+    if err := p.c.do(ctx, http.MethodPut, "/products/"+escape(id), updates, &product); err != nil {
+        return nil, err
+    }
+    return &product, nil
+}
+
+func (p *Products) Delete(ctx context.Context, id string) error {
+    return p.c.do(ctx, http.MethodDelete, "/products/"+escape(id), nil, nil)
+}
+
+// ReserveStock takes quantity units out of stock and returns the product as
+// it is afterwards. It fails with a 400 when there is not enough stock.
+func (p *Products) ReserveStock(ctx context.Context, id string, quantity int) (*shared.Product, error) {
+    var product shared.Product
+    if err := p.c.do(ctx, http.MethodPut, "/products/"+escape(id)+"/stock", shared.StockUpdate{Quantity: quantity}, &product); err != nil {
+        return nil, err
+    }
+    return &product, nil
+}
+
+// Orders calls /orders on Cell B
+type Orders struct {
+    c *Client
+}
+
+// Create places an order, reserving its stock in Cell A
+func (o *Orders) Create(ctx context.Context, order shared.Order) (*shared.Order, error) {
+    var created shared.Order
+    if err := o.c.do(ctx, http.MethodPost, "/orders", order, &created); err != nil {
+        return nil, err
+    }
+    return &created, nil
+}
+
+func (o *Orders) Get(ctx context.Context, id string) (*shared.Order, error) {
+    var order shared.Order
+    if err := o.c.do(ctx, http.MethodGet, "/orders/"+escape(id), nil, &order); err != nil {
+        return nil, err
+    }
+    return &order, nil
+}
+
+func (o *Orders) List(ctx context.Context) ([]shared.Order, error) {
+    var orders []shared.Order
+    if err := o.c.do(ctx, http.MethodGet, "/orders", nil, &orders); err != nil {
+        return nil, err
+    }
+    return orders, nil
+}
+
+func (o *Orders) UpdateStatus(ctx context.Context, id, status string) (*shared.Order, error) {
+    var order shared.Order
+    if err := o.c.do(ctx, http.MethodPut, "/orders/"+escape(id)+"/status", shared.OrderStatusUpdate{Status: status}, &order); err != nil {
+        return nil, err
+    }
+    return &order, nil
+}
+
+func (o *Orders) Delete(ctx context.Context, id string) error {
+    return o.c.do(ctx, http.MethodDelete, "/orders/"+escape(id), nil, nil)
+}
+
+// Payments calls /payments on Cell B
+type Payments struct {
+    c *Client
+}
+
+// Create starts a payment for an existing order; it is processed in the
+// background and starts out as shared.PaymentStatusProcessing
+func (p *Payments) Create(ctx context.Context, payment shared.Payment) (*shared.Payment, error) {
+    var created shared.Payment
+    if err := p.c.do(ctx, http.MethodPost, "/payments", payment, &created); err != nil {
+        return nil, err
+    }
+    return &created, nil
+}
+
+func (p *Payments) Get(ctx context.Context, id string) (*shared.Payment, error) {
+    var payment shared.Payment
+    if err := p.c.do(ctx, http.MethodGet, "/payments/"+escape(id), nil, &payment); err != nil {
+        return nil, err
+    }
+    return &payment, nil
+}
+
+func (p *Payments) List(ctx context.Context) ([]shared.Payment, error) {
+    var payments []shared.Payment
+    if err := p.c.do(ctx, http.MethodGet, "/payments", nil, &payments); err != nil {
+        return nil, err
+    }
+    return payments, nil
+}
+
+func (p *Payments) ListByOrder(ctx context.Context, orderID string) ([]shared.Payment, error) {
+    var payments []shared.Payment
+    if err := p.c.do(ctx, http.MethodGet, "/payments/order/"+escape(orderID), nil, &payments); err != nil {
+        return nil, err
+    }
+    return payments, nil
+}
+
+// Refund refunds a completed payment. It fails with a 400 while the payment
+// is still processing or was already refunded.
+func (p *Payments) Refund(ctx context.Context, id string) (*shared.Payment, error) {
+    var payment shared.Payment
+    if err := p.c.do(ctx, http.MethodPost, "/payments/"+escape(id)+"/refund", nil, &payment); err != nil {
+        return nil, err
+    }
+    return &payment, nil
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+    "net/http"
+    "time"
+)
+
+// RetryTransport retries GET and HEAD requests that failed to connect or were
+// answered with 502, 503 or 504, waiting Backoff and then twice as long
+// before each further attempt. Other methods are sent once: a repeated PUT
+// /products/{id}/stock would take the stock twice.
+type RetryTransport struct {
+    Base     http.RoundTripper
+    Attempts int
+    Backoff  time.Duration
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    base := t.Base
+    if base == nil {
+        base = http.DefaultTransport
+    }
+    if t.Attempts <= 1 || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+        return base.RoundTrip(req)
+    }
+
+    backoff := t.Backoff
+    for attempt := 1; ; attempt++ {
+        resp, err := base.RoundTrip(req)
+        if attempt >= t.Attempts || !retryable(resp, err) {
+            return resp, err
+        }
+        if resp != nil {
+            resp.Body.Close()
+        }
+
+        select {
+        case <-req.Context().Done():
+            return nil, req.Context().Err()
+        case <-time.After(backoff):
+        }
+        backoff *= 2
+    }
+}
+
+func retryable(resp *http.Response, err error) bool {
+    if err != nil {
+        return true
+    }
+    switch resp.StatusCode {
+    case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+        return true
+    }
+    return false
+}
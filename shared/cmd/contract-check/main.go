@@ -0,0 +1,312 @@
+// contract-check validates a response body read from stdin against the
+// shared wire types, which makes them the contract every service is held to:
+//
+//     curl -s localhost:8011/users/123 | contract-check user
+//
+// Data objects must carry exactly the fields of the shared type, each with
+// the right JSON type; envelopes may only use ServiceResponse fields. It
+// prints every divergence and exits 1 when there are any.
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "math"
+    "os"
+    "reflect"
+    "sort"
+    "strings"
+    "time"
+
+    "cell-shared"
+)
+
+// shape describes one kind of response body
+type shape struct {
+    envelope reflect.Type // nil for bodies that are not a ServiceResponse
+    data     reflect.Type // type of data, or of each element when list is set
+    list     bool
+    success  bool
+    details  bool // a 400 that must list field errors
+    upstream bool // a failure that must name the upstream and why it failed
+}
+
+var (
+    responseType = reflect.TypeOf(shared.ServiceResponse{})
+    timeType     = reflect.TypeOf(time.Time{})
+)
+
+var shapes = map[string]shape{
+    "user":              {envelope: responseType, data: reflect.TypeOf(shared.User{}), success: true},
+    "users":             {envelope: responseType, data: reflect.TypeOf(shared.User{}), list: true, success: true},
+    "product":           {envelope: responseType, data: reflect.TypeOf(shared.Product{}), success: true},
+    "products":          {envelope: responseType, data: reflect.TypeOf(shared.Product{}), list: true, success: true},
+    "order":             {envelope: responseType, data: reflect.TypeOf(shared.Order{}), success: true},
+    "orders":            {envelope: responseType, data: reflect.TypeOf(shared.Order{}), list: true, success: true},
+    "payment":           {envelope: responseType, data: reflect.TypeOf(shared.Payment{}), success: true},
+    "payments":          {envelope: responseType, data: reflect.TypeOf(shared.Payment{}), list: true, success: true},
+    "payments-by-order": {envelope: reflect.TypeOf(shared.PaymentsByOrderResponse{}), data: reflect.TypeOf(shared.Payment{}), list: true, success: true},
+    "tokens":            {envelope: responseType, data: reflect.TypeOf(shared.Tokens{}), success: true},
+    "message":           {envelope: responseType, success: true},
+    "error":             {envelope: responseType, success: false},
+    "invalid":           {envelope: responseType, success: false, details: true},
+    "upstream-error":    {envelope: responseType, success: false, upstream: true},
+    "health":            {data: reflect.TypeOf(shared.Health{})},
+    "jwks":              {data: reflect.TypeOf(shared.JWKS{})},
+}
+
+func main() {
+    if len(os.Args) != 2 {
+        fmt.Fprintf(os.Stderr, "usage: contract-check <%s> < body.json\n", strings.Join(shapeNames(), "|"))
+        os.Exit(2)
+    }
+    s, ok := shapes[os.Args[1]]
+    if !ok {
+        fmt.Fprintf(os.Stderr, "unknown shape %q\n", os.Args[1])
+        os.Exit(2)
+    }
+
+    body, err := io.ReadAll(os.Stdin)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "reading body: %v\n", err)
+        os.Exit(2)
+    }
+
+    problems := check(s, body)
+    for _, problem := range problems {
+        fmt.Println(problem)
+    }
+    if len(problems) > 0 {
+        os.Exit(1)
+    }
+}
+
+func shapeNames() []string {
+    names := make([]string, 0, len(shapes))
+    for name := range shapes {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+func check(s shape, body []byte) []string {
+    var doc interface{}
+    if err := json.Unmarshal(body, &doc); err != nil {
+        return []string{fmt.Sprintf("body is not JSON: %v", err)}
+    }
+
+    // /health bodies carry service-specific fields next to the shared ones,
+    // and the JWKS is served bare for JWT libraries
+    if s.envelope == nil {
+        return checkValue("$", doc, s.data, true)
+    }
+
+    problems := checkValue("$", doc, s.envelope, false)
+    object, _ := doc.(map[string]interface{})
+    if object == nil {
+        return problems
+    }
+
+    if success, _ := object["success"].(bool); success != s.success {
+        problems = append(problems, fmt.Sprintf("$.success: got %v, want %v", success, s.success))
+    }
+    if !s.success {
+        failure, _ := object["error"].(map[string]interface{})
+        if failure == nil {
+            return append(problems, "$.error: missing on a failed response")
+        }
+        required := []string{"code", "message", "cell_id", "request_id"}
+        if s.upstream {
+            required = append(required, "upstream", "upstream_cell", "reason")
+        }
+        for _, field := range required {
+            if text, _ := failure[field].(string); text == "" {
+                problems = append(problems, fmt.Sprintf("$.error.%s: missing on a failed response", field))
+            }
+        }
+        if details, _ := failure["details"].([]interface{}); s.details && len(details) == 0 {
+            problems = append(problems, "$.error.details: missing on a rejected request")
+        }
+        return problems
+    }
+
+    data, hasData := object["data"]
+    switch {
+    case s.data == nil:
+        if hasData {
+            problems = append(problems, "$.data: unexpected on a message response")
+        }
+    case s.list:
+        items, isArray := data.([]interface{})
+        if !isArray {
+            // A nil Go slice encodes as null; it is still an empty list
+            if data != nil {
+                problems = append(problems, fmt.Sprintf("$.data: got %s, want array", jsonKind(data)))
+            }
+        }
+        for i, item := range items {
+            problems = append(problems, checkValue(fmt.Sprintf("$.data[%d]", i), item, s.data, false)...)
+        }
+        if count, isNumber := object["count"].(float64); !isNumber || int(count) != len(items) {
+            problems = append(problems, fmt.Sprintf("$.count: got %v, want %d", object["count"], len(items)))
+        }
+    default:
+        if !hasData {
+            problems = append(problems, "$.data: missing")
+        } else {
+            problems = append(problems, checkValue("$.data", data, s.data, false)...)
+        }
+    }
+    return problems
+}
+
+// checkValue reports where v, decoded from JSON, does not match how t
+// encodes. Struct fields without omitempty are required, and fields the
+// type does not declare are rejected unless allowExtra is set.
+func checkValue(path string, v interface{}, t reflect.Type, allowExtra bool) []string {
+    if t == timeType {
+        text, isString := v.(string)
+        if !isString {
+            return []string{fmt.Sprintf("%s: got %s, want RFC 3339 timestamp", path, jsonKind(v))}
+        }
+        if _, err := time.Parse(time.RFC3339Nano, text); err != nil {
+            return []string{fmt.Sprintf("%s: %q is not an RFC 3339 timestamp", path, text)}
+        }
+        return nil
+    }
+
+    switch t.Kind() {
+    case reflect.Interface:
+        return nil
+    case reflect.Ptr:
+        if v == nil {
+            return nil
+        }
+        return checkValue(path, v, t.Elem(), allowExtra)
+    case reflect.String:
+        if _, ok := v.(string); !ok {
+            return []string{fmt.Sprintf("%s: got %s, want string", path, jsonKind(v))}
+        }
+    case reflect.Bool:
+        if _, ok := v.(bool); !ok {
+            return []string{fmt.Sprintf("%s: got %s, want boolean", path, jsonKind(v))}
+        }
+    case reflect.Int, reflect.Int32, reflect.Int64:
+        if n, ok := v.(float64); !ok || n != math.Trunc(n) {
+            return []string{fmt.Sprintf("%s: got %s, want integer", path, jsonKind(v))}
+        }
+    case reflect.Float32, reflect.Float64:
+        if _, ok := v.(float64); !ok {
+            return []string{fmt.Sprintf("%s: got %s, want number", path, jsonKind(v))}
+        }
+    case reflect.Slice:
+        items, ok := v.([]interface{})
+        if !ok {
+            return []string{fmt.Sprintf("%s: got %s, want array", path, jsonKind(v))}
+        }
+        var problems []string
+        for i, item := range items {
+            problems = append(problems, checkValue(fmt.Sprintf("%s[%d]", path, i), item, t.Elem(), false)...)
+        }
+        return problems
+    case reflect.Struct:
+        object, ok := v.(map[string]interface{})
+        if !ok {
+            return []string{fmt.Sprintf("%s: got %s, want object", path, jsonKind(v))}
+        }
+        return checkObject(path, object, t, allowExtra)
+    }
+    return nil
+}
+
+func checkObject(path string, object map[string]interface{}, t reflect.Type, allowExtra bool) []string {
+    var problems []string
+    declared := make(map[string]bool)
+    for _, f := range jsonFields(t) {
+        declared[f.name] = true
+        value, present := object[f.name]
+        if !present {
+            if !f.optional {
+                problems = append(problems, fmt.Sprintf("%s.%s: missing", path, f.name))
+            }
+            continue
+        }
+        problems = append(problems, checkValue(path+"."+f.name, value, f.typ, false)...)
+    }
+
+    if !allowExtra {
+        for _, key := range sortedKeys(object) {
+            if !declared[key] {
+                problems = append(problems, fmt.Sprintf("%s.%s: not in the shared %s type", path, key, t.Name()))
+            }
+        }
+    }
+    return problems
+}
+
+type jsonField struct {
+    name     string
+    optional bool
+    typ      reflect.Type
+}
+
+// jsonFields lists the JSON fields of a struct the way encoding/json sees
+// them, flattening embedded structs
+func jsonFields(t reflect.Type) []jsonField {
+    var fields []jsonField
+    for i := 0; i < t.NumField(); i++ {
+        f := t.Field(i)
+        if f.Anonymous && f.Type.Kind() == reflect.Struct {
+            fields = append(fields, jsonFields(f.Type)...)
+            continue
+        }
+        if !f.IsExported() {
+            continue
+        }
+        tag := strings.Split(f.Tag.Get("json"), ",")
+        if tag[0] == "-" {
+            continue
+        }
+        name := tag[0]
+        if name == "" {
+            name = f.Name
+        }
+        optional := false
+        for _, option := range tag[1:] {
+            if option == "omitempty" {
+                optional = true
+            }
+        }
+        fields = append(fields, jsonField{name: name, optional: optional, typ: f.Type})
+    }
+    return fields
+}
+
+func sortedKeys(object map[string]interface{}) []string {
+    keys := make([]string, 0, len(object))
+    for key := range object {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+func jsonKind(v interface{}) string {
+    switch v.(type) {
+    case nil:
+        return "null"
+    case string:
+        return "string"
+    case bool:
+        return "boolean"
+    case float64:
+        return "number"
+    case []interface{}:
+        return "array"
+    case map[string]interface{}:
+        return "object"
+    }
+    return fmt.Sprintf("%T", v)
+}
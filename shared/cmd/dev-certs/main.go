@@ -0,0 +1,179 @@
+// dev-certs creates a local CA and a certificate for every gateway and
+// service, for trying mutual TLS without a real PKI:
+//
+//     go run ./cmd/dev-certs -out ../certs
+//
+// Each workload gets <out>/<cell>-<service>/tls.crt and tls.key, with its
+// SPIFFE ID as a URI SAN and its Docker and Kubernetes host names as DNS
+// SANs. The CA in <out>/ca.crt and ca.key is reused when it exists, so
+// running again with -workloads rotates or adds certificates that peers
+// already trust.
+package main
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "errors"
+    "flag"
+    "fmt"
+    "math/big"
+    "net"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "cell-shared/mtls"
+)
+
+const defaultWorkloads = "cell-a/gateway,cell-a/user-service,cell-a/product-service,cell-b/gateway,cell-b/order-service,cell-b/payment-service"
+
+func main() {
+    out := flag.String("out", "certs", "directory to write the CA and certificates to")
+    trustDomain := flag.String("trust-domain", mtls.DefaultTrustDomain, "SPIFFE trust domain")
+    workloads := flag.String("workloads", defaultWorkloads, "comma-separated cell/service pairs to issue certificates for")
+    validity := flag.Duration("validity", 30*24*time.Hour, "how long the workload certificates are valid")
+    flag.Parse()
+
+    if err := run(*out, *trustDomain, strings.Split(*workloads, ","), *validity); err != nil {
+        fmt.Fprintln(os.Stderr, "dev-certs:", err)
+        os.Exit(1)
+    }
+}
+
+func run(out, trustDomain string, workloads []string, validity time.Duration) error {
+    if err := os.MkdirAll(out, 0o755); err != nil {
+        return err
+    }
+    ca, caKey, err := loadOrCreateCA(out)
+    if err != nil {
+        return err
+    }
+
+    for _, workload := range workloads {
+        cell, service, found := strings.Cut(strings.TrimSpace(workload), "/")
+        if !found || cell == "" || service == "" || strings.Contains(service, "/") {
+            return fmt.Errorf("workload %q is not cell/service", workload)
+        }
+        id, _ := url.Parse(mtls.ID(trustDomain, cell, service))
+        name := cell + "-" + service
+
+        key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+        if err != nil {
+            return err
+        }
+        template := &x509.Certificate{
+            Subject:     pkix.Name{CommonName: name},
+            NotBefore:   time.Now().Add(-time.Minute),
+            NotAfter:    time.Now().Add(validity),
+            KeyUsage:    x509.KeyUsageDigitalSignature,
+            ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+            URIs:        []*url.URL{id},
+            DNSNames:    []string{"localhost", name, name + "." + cell, name + "." + cell + ".svc.cluster.local"},
+            IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+        }
+        dir := filepath.Join(out, name)
+        if err := os.MkdirAll(dir, 0o755); err != nil {
+            return err
+        }
+        if err := issue(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), template, key, ca, caKey); err != nil {
+            return err
+        }
+        fmt.Printf("%s/tls.crt  %s\n", dir, id)
+    }
+    return nil
+}
+
+// loadOrCreateCA reads ca.crt and ca.key from dir, creating them first when
+// they do not exist
+func loadOrCreateCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+    certPath, keyPath := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+    certPEM, err := os.ReadFile(certPath)
+    if errors.Is(err, os.ErrNotExist) {
+        key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+        if err != nil {
+            return nil, nil, err
+        }
+        template := &x509.Certificate{
+            Subject:               pkix.Name{CommonName: "cells development CA"},
+            NotBefore:             time.Now().Add(-time.Minute),
+            NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+            KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+            BasicConstraintsValid: true,
+            IsCA:                  true,
+        }
+        if err := issue(certPath, keyPath, template, key, nil, nil); err != nil {
+            return nil, nil, err
+        }
+        fmt.Printf("%s  new CA\n", certPath)
+        return loadOrCreateCA(dir)
+    }
+    if err != nil {
+        return nil, nil, err
+    }
+
+    keyPEM, err := os.ReadFile(keyPath)
+    if err != nil {
+        return nil, nil, err
+    }
+    certBlock, _ := pem.Decode(certPEM)
+    keyBlock, _ := pem.Decode(keyPEM)
+    if certBlock == nil || keyBlock == nil {
+        return nil, nil, fmt.Errorf("%s or %s is not PEM", certPath, keyPath)
+    }
+    ca, err := x509.ParseCertificate(certBlock.Bytes)
+    if err != nil {
+        return nil, nil, err
+    }
+    key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+    if err != nil {
+        return nil, nil, err
+    }
+    signer, ok := key.(crypto.Signer)
+    if !ok {
+        return nil, nil, fmt.Errorf("%s cannot sign", keyPath)
+    }
+    return ca, signer, nil
+}
+
+// issue signs template with the CA, or self-signs it when ca is nil, and
+// writes the certificate and key to certPath and keyPath
+func issue(certPath, keyPath string, template *x509.Certificate, key *ecdsa.PrivateKey, ca *x509.Certificate, caKey crypto.Signer) error {
+    serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+    if err != nil {
+        return err
+    }
+    template.SerialNumber = serial
+    if ca == nil {
+        ca, caKey = template, key
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+    if err != nil {
+        return err
+    }
+    keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+    if err != nil {
+        return err
+    }
+
+    // Written beside the old files and renamed over them, so a service
+    // reloading mid-rotation never reads half a file
+    if err := writePEM(keyPath, "PRIVATE KEY", keyDER, 0o600); err != nil {
+        return err
+    }
+    return writePEM(certPath, "CERTIFICATE", der, 0o644)
+}
+
+func writePEM(path, blockType string, der []byte, mode os.FileMode) error {
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), mode); err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}
@@ -0,0 +1,88 @@
+// Package config reads service settings from environment variables, falling
+// back to a default when a variable is unset or invalid
+package config
+
+import (
+    "log"
+    "os"
+    "strconv"
+    "time"
+)
+
+// Get returns the variable, or defaultValue when it is unset or empty
+func Get(key, defaultValue string) string {
+    if value := os.Getenv(key); value != "" {
+        return value
+    }
+    return defaultValue
+}
+
+// Bool accepts anything strconv.ParseBool does
+func Bool(key string, defaultValue bool) bool {
+    value := os.Getenv(key)
+    if value == "" {
+        return defaultValue
+    }
+    parsed, err := strconv.ParseBool(value)
+    if err != nil {
+        log.Printf("Invalid value %q for %s, using default %t", value, key, defaultValue)
+        return defaultValue
+    }
+    return parsed
+}
+
+// Int64 accepts positive integers only
+func Int64(key string, defaultValue int64) int64 {
+    value := os.Getenv(key)
+    if value == "" {
+        return defaultValue
+    }
+    parsed, err := strconv.ParseInt(value, 10, 64)
+    if err != nil || parsed <= 0 {
+        log.Printf("Invalid value %q for %s, using default %d", value, key, defaultValue)
+        return defaultValue
+    }
+    return parsed
+}
+
+// Float accepts non-negative numbers only
+func Float(key string, defaultValue float64) float64 {
+    value := os.Getenv(key)
+    if value == "" {
+        return defaultValue
+    }
+    parsed, err := strconv.ParseFloat(value, 64)
+    if err != nil || parsed < 0 {
+        log.Printf("Invalid value %q for %s, using default %g", value, key, defaultValue)
+        return defaultValue
+    }
+    return parsed
+}
+
+// Duration accepts positive Go durations such as "500ms" or "30s"
+func Duration(key string, defaultValue time.Duration) time.Duration {
+    value := os.Getenv(key)
+    if value == "" {
+        return defaultValue
+    }
+    parsed, err := time.ParseDuration(value)
+    if err != nil || parsed <= 0 {
+        log.Printf("Invalid value %q for %s, using default %s", value, key, defaultValue)
+        return defaultValue
+    }
+    return parsed
+}
+
+// DurationOrZero is Duration but accepts 0 to switch a feature off
+func DurationOrZero(key string, defaultValue time.Duration) time.Duration {
+    if os.Getenv(key) == "0" {
+        return 0
+    }
+    return Duration(key, defaultValue)
+}
+
+// DevMode reports whether DEV_MODE is set, which lets services fall back to
+// throwaway secrets that are unsafe outside a single local process
+func DevMode() bool {
+    return Bool("DEV_MODE", false)
+}
@@ -0,0 +1,111 @@
+package shared
+
+import (
+    "context"
+    "errors"
+    "net"
+    "net/http"
+    "syscall"
+)
+
+// Error codes. Clients branch on the code, not the message, which is meant
+// for people and may change.
+const (
+    ErrorInvalidRequest      = "invalid_request"
+    ErrorNotFound            = "not_found"
+    ErrorUnauthorized        = "unauthorized"
+    ErrorForbidden           = "forbidden"
+    ErrorConflict            = "conflict"
+    ErrorInsufficientStock   = "insufficient_stock"
+    ErrorInvalidState        = "invalid_state"
+    ErrorPayloadTooLarge     = "payload_too_large"
+    ErrorRateLimited         = "rate_limited"
+    ErrorOverloaded          = "overloaded"
+    ErrorUpstreamUnavailable = "upstream_unavailable"
+    ErrorUpstreamTimeout     = "upstream_timeout"
+    ErrorUpstreamResponse    = "upstream_bad_response"
+    ErrorClientClosed        = "client_closed_request"
+    ErrorLoopDetected        = "loop_detected"
+    ErrorInternal            = "internal"
+    ErrorRouteNotFound       = "route_not_found"
+    ErrorMethodNotAllowed    = "method_not_allowed"
+)
+
+// StatusClientClosedRequest is nginx's status for a request the client gave
+// up on before it was answered; no client sees it, but logs and metrics do
+const StatusClientClosedRequest = 499
+
+// retryableCodes are the failures that may succeed if the same request is
+// sent again later
+var retryableCodes = map[string]bool{
+    ErrorRateLimited:         true,
+    ErrorOverloaded:          true,
+    ErrorUpstreamUnavailable: true,
+    ErrorUpstreamTimeout:     true,
+}
+
+// NewError builds an Error for code, marking it retryable when the code is
+func NewError(code, message string) *Error {
+    return &Error{Code: code, Message: message, Retryable: retryableCodes[code]}
+}
+
+// UpstreamError builds the Error for a call to upstream in upstreamCell that
+// got no usable answer, classifying err into a code and a reason that does
+// not leak addresses. A call cut short because our own caller went away is
+// not the upstream's fault, so it is not retryable.
+func UpstreamError(message, upstream, upstreamCell string, err error) *Error {
+    code, reason := ErrorUpstreamUnavailable, "unreachable"
+    var netErr net.Error
+    var dnsErr *net.DNSError
+    switch {
+    case errors.Is(err, context.Canceled):
+        code, reason = ErrorClientClosed, "request cancelled"
+    case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+        code, reason = ErrorUpstreamTimeout, "timed out"
+    case errors.Is(err, syscall.ECONNREFUSED):
+        reason = "connection refused"
+    case errors.Is(err, syscall.ECONNRESET):
+        reason = "connection reset"
+    case errors.As(err, &dnsErr):
+        reason = "host not found"
+    }
+
+    e := NewError(code, message)
+    e.Upstream = upstream
+    e.UpstreamCell = upstreamCell
+    e.Reason = reason
+    return e
+}
+
+// StatusFor is the HTTP status a failure with code is answered with
+func StatusFor(code string) int {
+    switch code {
+    case ErrorInvalidRequest, ErrorInsufficientStock, ErrorInvalidState:
+        return http.StatusBadRequest
+    case ErrorUnauthorized:
+        return http.StatusUnauthorized
+    case ErrorForbidden:
+        return http.StatusForbidden
+    case ErrorNotFound, ErrorRouteNotFound:
+        return http.StatusNotFound
+    case ErrorMethodNotAllowed:
+        return http.StatusMethodNotAllowed
+    case ErrorConflict:
+        return http.StatusConflict
+    case ErrorPayloadTooLarge:
+        return http.StatusRequestEntityTooLarge
+    case ErrorRateLimited:
+        return http.StatusTooManyRequests
+    case ErrorClientClosed:
+        return StatusClientClosedRequest
+    case ErrorOverloaded, ErrorUpstreamUnavailable:
+        return http.StatusServiceUnavailable
+    case ErrorUpstreamTimeout:
+        return http.StatusGatewayTimeout
+    case ErrorUpstreamResponse:
+        return http.StatusBadGateway
+    case ErrorLoopDetected:
+        return http.StatusLoopDetected
+    }
+    return http.StatusInternalServerError
+}
@@ -0,0 +1,135 @@
+package gateway
+
+import (
+    "context"
+    "errors"
+    "log"
+    "sync"
+    "time"
+
+    "cell-shared/config"
+)
+
+var (
+    ErrActivationQueueFull = errors.New("activation queue full")
+    ErrActivationTimeout   = errors.New("upstream did not become ready in time")
+)
+
+// upstreamActivation tracks the requests waiting on one upstream
+type upstreamActivation struct {
+    name     string
+    waiting  int
+    probing  bool
+    released chan struct{}
+}
+
+// Activator holds requests for upstreams that are scaled to zero or otherwise
+// unhealthy in a bounded queue, polls their readiness with backoff and
+// releases the queue once they answer. Whether an upstream needs activating
+// is decided by the HealthChecker.
+type Activator struct {
+    health         *HealthChecker
+    queueSize      int
+    maxWait        time.Duration
+    initialBackoff time.Duration
+    maxBackoff     time.Duration
+    upstreams      map[string]*upstreamActivation
+    mutex          sync.Mutex
+}
+
+func NewActivator(health *HealthChecker) *Activator {
+    return &Activator{
+        health:         health,
+        queueSize:      int(config.Int64("ACTIVATOR_QUEUE_SIZE", 100)),
+        maxWait:        config.Duration("ACTIVATOR_MAX_WAIT", 30*time.Second),
+        initialBackoff: config.Duration("ACTIVATOR_INITIAL_BACKOFF", 200*time.Millisecond),
+        maxBackoff:     config.Duration("ACTIVATOR_MAX_BACKOFF", 5*time.Second),
+        upstreams:      make(map[string]*upstreamActivation),
+    }
+}
+
+func (a *Activator) upstream(name string) *upstreamActivation {
+    state, exists := a.upstreams[name]
+    if !exists {
+        state = &upstreamActivation{name: name}
+        a.upstreams[name] = state
+    }
+    return state
+}
+
+// Wait returns once the upstream is known to be ready, queueing the caller
+// while a readiness probe is in progress
+func (a *Activator) Wait(ctx context.Context, name string) error {
+    if a.health.IsHealthy(name) {
+        return nil
+    }
+
+    a.mutex.Lock()
+    state := a.upstream(name)
+    if state.waiting >= a.queueSize {
+        a.mutex.Unlock()
+        return ErrActivationQueueFull
+    }
+    state.waiting++
+    if !state.probing {
+        state.probing = true
+        state.released = make(chan struct{})
+        go a.probe(state)
+    }
+    released := state.released
+    a.mutex.Unlock()
+
+    defer func() {
+        a.mutex.Lock()
+        state.waiting--
+        a.mutex.Unlock()
+    }()
+
+    select {
+    case <-released:
+        if a.health.IsHealthy(name) {
+            return nil
+        }
+        return ErrActivationTimeout
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// probe polls the upstream's health endpoint with exponential backoff until
+// it is ready or maxWait elapses, then releases everyone queued on it
+func (a *Activator) probe(state *upstreamActivation) {
+    log.Printf("Activating service: %s", state.name)
+
+    deadline := time.Now().Add(a.maxWait)
+    backoff := a.initialBackoff
+    ready := false
+    for {
+        if a.health.Check(state.name) {
+            ready = true
+            break
+        }
+        if time.Now().Add(backoff).After(deadline) {
+            break
+        }
+        time.Sleep(backoff)
+        backoff *= 2
+        if backoff > a.maxBackoff {
+            backoff = a.maxBackoff
+        }
+    }
+
+    if ready {
+        a.health.MarkHealthy(state.name)
+    }
+
+    a.mutex.Lock()
+    if ready {
+        log.Printf("Service %s is now healthy, releasing %d queued requests", state.name, state.waiting)
+    } else {
+        log.Printf("Service %s did not become ready within %s", state.name, a.maxWait)
+    }
+    state.probing = false
+    close(state.released)
+    a.mutex.Unlock()
+}
@@ -0,0 +1,160 @@
+package gateway
+
+import (
+    "context"
+    "errors"
+    "log"
+    "net/http"
+    "time"
+
+    "cell-shared"
+    "cell-shared/auth"
+    "cell-shared/config"
+    "cell-shared/logging"
+    "cell-shared/server"
+)
+
+// Authorizer verifies access tokens on proxied routes, enforces the access
+// policy and makes the verified caller the identity the proxy passes on
+type Authorizer struct {
+    cellID       string
+    enabled      bool
+    policy       auth.Policy
+    verifier     *auth.Verifier
+    keysUpstream string
+}
+
+// NewAuthorizer verifies tokens with the keys in JWKS_FILE, or else the ones
+// served at JWKS_URL, which defaults to the JWKS of keysUpstream at jwksURL,
+// fetched with jwksHost as the Host when it is set
+func NewAuthorizer(cellID, keysUpstream, jwksURL, jwksHost string) *Authorizer {
+    a := &Authorizer{
+        cellID:       cellID,
+        enabled:      config.Bool("AUTH_ENABLED", true),
+        policy:       auth.DefaultPolicy,
+        keysUpstream: keysUpstream,
+    }
+    if !a.enabled {
+        log.Printf("AUTH_ENABLED is false; every route is open to anonymous callers")
+        return a
+    }
+
+    if path := config.Get("AUTH_POLICY_FILE", ""); path != "" {
+        policy, err := auth.LoadPolicy(path)
+        if err != nil {
+            log.Fatalf("Loading access policy: %v", err)
+        }
+        a.policy = policy
+    }
+
+    var keys *auth.KeySet
+    if path := config.Get("JWKS_FILE", ""); path != "" {
+        var err error
+        if keys, err = auth.NewFileKeySet(path); err != nil {
+            log.Fatalf("Loading JWKS: %v", err)
+        }
+    } else {
+        client := server.NewClient(config.Duration("JWKS_FETCH_TIMEOUT", 5*time.Second))
+        if url := config.Get("JWKS_URL", ""); url != "" {
+            jwksURL = url
+        } else if jwksHost != "" {
+            client.Transport = &hostTransport{host: jwksHost, next: client.Transport}
+        }
+        keys = auth.NewRemoteKeySet(jwksURL, client, config.Duration("JWKS_REFRESH_INTERVAL", 5*time.Minute))
+    }
+    a.verifier = auth.NewVerifier(keys, config.Get("JWT_ISSUER", "user-service"))
+    return a
+}
+
+// verifiedToken is the outcome of checking a request's bearer token
+type verifiedToken struct {
+    claims *auth.Claims
+    err    error
+}
+
+type verifiedTokenKey struct{}
+
+// Authenticate verifies the request's bearer token, if it has one, and
+// passes the outcome on to Middleware. A valid token's caller becomes the
+// request's identity here, so the rate limiter can key on it, but nothing is
+// rejected until Middleware runs.
+func (a *Authorizer) Authenticate(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        // Only the identity this gateway verifies may reach upstreams
+        auth.StripIdentity(r.Header)
+        if !a.enabled {
+            next(w, r)
+            return
+        }
+        ctx := auth.WithIdentity(r.Context(), nil)
+        if token := auth.BearerToken(r); token != "" {
+            claims, err := a.verifier.Verify(ctx, token)
+            ctx = context.WithValue(ctx, verifiedTokenKey{}, &verifiedToken{claims: claims, err: err})
+            if err == nil {
+                ctx = auth.WithIdentity(ctx, &auth.Identity{UserID: claims.Subject, Cell: claims.Cell, Roles: claims.Roles})
+            }
+        }
+        next(w, r.WithContext(ctx))
+    }
+}
+
+// Middleware lets a request Authenticate checked through when the policy
+// allows it. Missing and invalid tokens get a 401, tokens without the
+// required role a 403, and a token sent to a public route must still be
+// valid.
+func (a *Authorizer) Middleware(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if !a.enabled {
+            next(w, r)
+            return
+        }
+
+        require := a.policy.Requirement(r.Method, r.URL.Path)
+        token, _ := r.Context().Value(verifiedTokenKey{}).(*verifiedToken)
+        if token == nil {
+            if require == auth.Public {
+                next(w, r)
+                return
+            }
+            w.Header().Set("WWW-Authenticate", `Bearer realm="cells"`)
+            shared.WriteError(w, a.cellID, shared.ErrorUnauthorized, "Missing bearer token")
+            return
+        }
+
+        if errors.Is(token.err, auth.ErrKeysUnavailable) {
+            logging.FromContext(r.Context()).Error("Cannot verify access token", "error", token.err)
+            e := shared.NewError(shared.ErrorUpstreamUnavailable, "Cannot verify access token")
+            e.Upstream = a.keysUpstream
+            e.UpstreamCell = upstreamCell(a.cellID, a.keysUpstream)
+            e.Reason = "signing keys unavailable"
+            w.Header().Set("Retry-After", "5")
+            shared.WriteFailure(w, a.cellID, e)
+            return
+        }
+        if token.err != nil {
+            logging.FromContext(r.Context()).Info("Rejected access token", "error", token.err)
+            w.Header().Set("WWW-Authenticate", `Bearer realm="cells", error="invalid_token"`)
+            shared.WriteError(w, a.cellID, shared.ErrorUnauthorized, "Invalid or expired access token")
+            return
+        }
+
+        if require != auth.Public && require != auth.Authenticated && !token.claims.HasRole(require) {
+            w.Header().Set("WWW-Authenticate", `Bearer realm="cells", error="insufficient_scope"`)
+            shared.WriteError(w, a.cellID, shared.ErrorForbidden, "Requires the "+require+" role")
+            return
+        }
+        next(w, r)
+    }
+}
+
+// hostTransport sends every request with host as its Host
+type hostTransport struct {
+    host string
+    next http.RoundTripper
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    req = req.Clone(req.Context())
+    req.Host = t.host
+    return t.next.RoundTrip(req)
+}
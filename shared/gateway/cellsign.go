@@ -0,0 +1,237 @@
+package gateway
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "cell-shared"
+    "cell-shared/config"
+    "cell-shared/logging"
+)
+
+// Headers a gateway signs the requests it forwards to another cell's gateway
+// with. X-Source-Cell and X-Gateway-ID name the sender, and X-Cell-Client the
+// client it took the request from; they are only believed when
+// CellSignatureHeader verifies. X-Cell-Nonce makes each signature single-use.
+const (
+    SourceCellHeader    = "X-Source-Cell"
+    GatewayIDHeader     = "X-Gateway-ID"
+    CellClientHeader    = "X-Cell-Client"
+    CellTimeHeader      = "X-Cell-Time"
+    CellNonceHeader     = "X-Cell-Nonce"
+    ContentSHA256Header = "X-Content-SHA256"
+    CellSignatureHeader = "X-Cell-Signature"
+)
+
+var cellHeaders = []string{SourceCellHeader, GatewayIDHeader, CellClientHeader, CellTimeHeader, CellNonceHeader, ContentSHA256Header, CellSignatureHeader}
+
+// developmentCellKey is used for every peer when CELL_SIGNING_KEYS is unset
+// in dev mode, so a local run works without setup; anyone who reads this can
+// pose as a cell
+const developmentCellKey = "development-only-cell-key"
+
+// CellSigner signs requests to the other cell's gateway and verifies the
+// ones it sends, with a key each pair of cells shares
+type CellSigner struct {
+    cellID string
+    keys   map[string][]byte
+    window time.Duration
+
+    mutex   sync.Mutex
+    seen    map[string]time.Time // source cell and nonce -> when the signature expires
+    pruneAt int
+}
+
+// NewCellSigner reads the key for each peer cell from CELL_SIGNING_KEYS, as
+// comma-separated cell=key pairs, and accepts signatures made up to
+// CELL_SIGNATURE_WINDOW before or after now. Only in dev mode may the keys be
+// unset.
+func NewCellSigner(cellID string) *CellSigner {
+    c := &CellSigner{
+        cellID:  cellID,
+        window:  config.Duration("CELL_SIGNATURE_WINDOW", 30*time.Second),
+        seen:    make(map[string]time.Time),
+        pruneAt: 1024,
+    }
+    pairs := config.Get("CELL_SIGNING_KEYS", "")
+    if pairs == "" {
+        if !config.DevMode() {
+            log.Fatalf("CELL_SIGNING_KEYS is not set; give each pair of cells a shared key, or set DEV_MODE=true to use the development key")
+        }
+        log.Printf("CELL_SIGNING_KEYS is not set; using the development key, which lets anyone pose as another cell")
+        return c
+    }
+    c.keys = make(map[string][]byte)
+    for _, pair := range strings.Split(pairs, ",") {
+        if pair = strings.TrimSpace(pair); pair == "" {
+            continue
+        }
+        cell, key, found := strings.Cut(pair, "=")
+        if !found || cell == "" || key == "" {
+            log.Fatalf("CELL_SIGNING_KEYS: %q is not cell=key", pair)
+        }
+        c.keys[cell] = []byte(key)
+    }
+    return c
+}
+
+// key is the key shared with peer, or nil when there is none; in dev mode
+// without CELL_SIGNING_KEYS every peer shares the development key
+func (c *CellSigner) key(peer string) []byte {
+    if c.keys == nil {
+        return []byte(developmentCellKey)
+    }
+    return c.keys[peer]
+}
+
+// Sign names this gateway as the sender of req, which goes to peer's
+// gateway on behalf of client, and signs it. The body is read into memory to
+// hash it, so a body over its limit fails here.
+func (c *CellSigner) Sign(req *http.Request, peer, client string) error {
+    key := c.key(peer)
+    if key == nil {
+        return fmt.Errorf("no CELL_SIGNING_KEYS entry for %s", peer)
+    }
+    var body []byte
+    if req.Body != nil {
+        var err error
+        if body, err = io.ReadAll(req.Body); err != nil {
+            return err
+        }
+        req.Body.Close()
+    }
+    req.Body = io.NopCloser(bytes.NewReader(body))
+    req.GetBody = func() (io.ReadCloser, error) {
+        return io.NopCloser(bytes.NewReader(body)), nil
+    }
+    req.ContentLength = int64(len(body))
+
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    nonce := make([]byte, 16)
+    if _, err := rand.Read(nonce); err != nil {
+        return err
+    }
+    digest := sha256.Sum256(body)
+    bodyHash := hex.EncodeToString(digest[:])
+    req.Header.Set(SourceCellHeader, c.cellID)
+    req.Header.Set(GatewayIDHeader, c.cellID)
+    req.Header.Set(CellClientHeader, client)
+    req.Header.Set(CellTimeHeader, timestamp)
+    req.Header.Set(CellNonceHeader, hex.EncodeToString(nonce))
+    req.Header.Set(ContentSHA256Header, bodyHash)
+    req.Header.Set(CellSignatureHeader, mac(key, req.Method, req.URL.RequestURI(), timestamp, req.Header.Get(CellNonceHeader), bodyHash, c.cellID, c.cellID, client))
+    return nil
+}
+
+// Verify checks the signature on r, reading up to maxBytes of its body to
+// hash and leaving the body for the handler to read again. It returns the
+// sending cell.
+func (c *CellSigner) Verify(r *http.Request, maxBytes int64) (string, error) {
+    source, gatewayID, client, timestamp := r.Header.Get(SourceCellHeader), r.Header.Get(GatewayIDHeader), r.Header.Get(CellClientHeader), r.Header.Get(CellTimeHeader)
+    nonce, bodyHash, signature := r.Header.Get(CellNonceHeader), r.Header.Get(ContentSHA256Header), r.Header.Get(CellSignatureHeader)
+    key := c.key(source)
+    if source == "" || source == c.cellID || key == nil {
+        return "", fmt.Errorf("no key shared with cell %q", source)
+    }
+    if !hmac.Equal([]byte(signature), []byte(mac(key, r.Method, r.URL.RequestURI(), timestamp, nonce, bodyHash, source, gatewayID, client))) {
+        return "", errors.New("signature does not verify")
+    }
+    seconds, err := strconv.ParseInt(timestamp, 10, 64)
+    signedAt := time.Unix(seconds, 0)
+    if age := time.Since(signedAt); err != nil || age > c.window || age < -c.window {
+        return "", errors.New("signature is outside the replay window")
+    }
+
+    body, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+    r.Body.Close()
+    if err != nil {
+        return "", err
+    }
+    if int64(len(body)) > maxBytes {
+        return "", &http.MaxBytesError{Limit: maxBytes}
+    }
+    r.Body = io.NopCloser(bytes.NewReader(body))
+    digest := sha256.Sum256(body)
+    if !hmac.Equal([]byte(bodyHash), []byte(hex.EncodeToString(digest[:]))) {
+        return "", errors.New("body does not match its signed hash")
+    }
+    // Spend the nonce last, so a truncated or tampered copy cannot get the
+    // genuine request refused as a replay
+    if nonce == "" {
+        return "", errors.New("signature has no nonce")
+    }
+    if !c.firstUse(source+"\n"+nonce, signedAt.Add(c.window)) {
+        return "", errors.New("signature was already used")
+    }
+    return source, nil
+}
+
+// firstUse records a nonce until its signature expires and reports whether
+// it had not been seen before. Once the map reaches pruneAt, expired nonces
+// are dropped, so it only holds what one window's traffic can replay.
+func (c *CellSigner) firstUse(nonce string, expires time.Time) bool {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    now := time.Now()
+    if expiry, seen := c.seen[nonce]; seen && now.Before(expiry) {
+        return false
+    }
+    if len(c.seen) >= c.pruneAt {
+        for n, expiry := range c.seen {
+            if !now.Before(expiry) {
+                delete(c.seen, n)
+            }
+        }
+        c.pruneAt = 2*len(c.seen) + 1024
+    }
+    c.seen[nonce] = expires
+    return true
+}
+
+// Middleware lets signed requests through only when the signature verifies,
+// and strips the cell headers from every other request, so external callers
+// cannot pose as another cell
+func (c *CellSigner) Middleware(maxBytes int64, next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get(CellSignatureHeader) == "" {
+            for _, header := range cellHeaders {
+                r.Header.Del(header)
+            }
+            next(w, r)
+            return
+        }
+
+        _, err := c.Verify(r, maxBytes)
+        var maxBytesErr *http.MaxBytesError
+        if errors.As(err, &maxBytesErr) {
+            shared.WriteError(w, c.cellID, shared.ErrorPayloadTooLarge, "Request body too large")
+            return
+        }
+        if err != nil {
+            logging.FromContext(r.Context()).Warn("Rejected cross-cell request", "source_cell", r.Header.Get(SourceCellHeader), "error", err)
+            shared.WriteError(w, c.cellID, shared.ErrorUnauthorized, "Invalid cross-cell signature")
+            return
+        }
+        next(w, r)
+    }
+}
+
+func mac(key []byte, fields ...string) string {
+    h := hmac.New(sha256.New, key)
+    h.Write([]byte(strings.Join(fields, "\n")))
+    return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
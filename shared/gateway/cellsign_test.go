@@ -0,0 +1,97 @@
+package gateway
+
+import (
+    "io"
+    "net/http"
+    "strings"
+    "testing"
+)
+
+const stockBody = `{"quantity":1}`
+
+// signedStockRequest returns a stock update cell-b signed for cell-a, and a
+// function making copies of it with the same headers and another body
+func signedStockRequest(t *testing.T, sender *CellSigner) (*http.Request, func(body string) *http.Request) {
+    t.Helper()
+    req, err := http.NewRequest(http.MethodPut, "http://cell-a-gateway/products/p1/stock", strings.NewReader(stockBody))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := sender.Sign(req, "cell-a", "203.0.113.1"); err != nil {
+        t.Fatal(err)
+    }
+    copyWith := func(body string) *http.Request {
+        r, err := http.NewRequest(req.Method, req.URL.String(), strings.NewReader(body))
+        if err != nil {
+            t.Fatal(err)
+        }
+        r.Header = req.Header.Clone()
+        return r
+    }
+    return req, copyWith
+}
+
+func newCellSigners(t *testing.T) (receiver, sender *CellSigner) {
+    t.Setenv("CELL_SIGNING_KEYS", "cell-a=shared-key,cell-b=shared-key")
+    return NewCellSigner("cell-a"), NewCellSigner("cell-b")
+}
+
+func TestCellSignerVerify(t *testing.T) {
+    tests := []struct {
+        name     string
+        tamper   func(r *http.Request)
+        maxBytes int64
+        wantErr  bool
+    }{
+        {"signed", func(*http.Request) {}, 1 << 20, false},
+        {"body changed", func(r *http.Request) { r.Body = io.NopCloser(strings.NewReader(`{"quantity":9}`)) }, 1 << 20, true},
+        {"path changed", func(r *http.Request) { r.URL.Path = "/products/p2/stock" }, 1 << 20, true},
+        {"client changed", func(r *http.Request) { r.Header.Set(CellClientHeader, "203.0.113.2") }, 1 << 20, true},
+        {"nonce removed", func(r *http.Request) { r.Header.Del(CellNonceHeader) }, 1 << 20, true},
+        {"unknown cell", func(r *http.Request) { r.Header.Set(SourceCellHeader, "cell-c") }, 1 << 20, true},
+        {"body over limit", func(*http.Request) {}, 4, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            receiver, sender := newCellSigners(t)
+            req, _ := signedStockRequest(t, sender)
+            tt.tamper(req)
+
+            source, err := receiver.Verify(req, tt.maxBytes)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("Verify() error = %v, want error %v", err, tt.wantErr)
+            }
+            if err != nil {
+                return
+            }
+            if source != "cell-b" {
+                t.Errorf("Verify() = %q, want cell-b", source)
+            }
+            // The handler must still be able to read the body
+            if body, _ := io.ReadAll(req.Body); string(body) != stockBody {
+                t.Errorf("body after Verify() = %q, want %q", body, stockBody)
+            }
+        })
+    }
+}
+
+func TestCellSignerVerifySpendsNonceOnce(t *testing.T) {
+    receiver, sender := newCellSigners(t)
+    _, copyWith := signedStockRequest(t, sender)
+
+    steps := []struct {
+        name    string
+        body    string
+        wantErr bool
+    }{
+        // A tampered copy arriving first must not use up the nonce
+        {"tampered copy", `{"quantity":9}`, true},
+        {"genuine", stockBody, false},
+        {"replay", stockBody, true},
+    }
+    for _, step := range steps {
+        if _, err := receiver.Verify(copyWith(step.body), 1<<20); (err != nil) != step.wantErr {
+            t.Fatalf("%s: Verify() error = %v, want error %v", step.name, err, step.wantErr)
+        }
+    }
+}
@@ -0,0 +1,248 @@
+package gateway
+
+import (
+    "context"
+    "errors"
+    "math"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+
+    "cell-shared"
+    "cell-shared/auth"
+    "cell-shared/config"
+    "cell-shared/middleware"
+)
+
+// Priority decides the order in which requests are shed under load
+type Priority int
+
+const (
+    PriorityNormal Priority = iota
+    PriorityCrossCell
+)
+
+func (p Priority) String() string {
+    if p == PriorityCrossCell {
+        return "cross-cell"
+    }
+    return "normal"
+}
+
+// headroom scales the limit per priority so cross-cell calls keep flowing
+// after external traffic is shed
+var headroom = map[Priority]float64{
+    PriorityNormal:    1.0,
+    PriorityCrossCell: 1.5,
+}
+
+// priorities lists every priority, for reporting
+var priorities = []Priority{PriorityNormal, PriorityCrossCell}
+
+// classifyRequest assigns a priority from who verifiably made the request: a
+// workload in another cell, by its caller signature or client certificate,
+// or the other cell's gateway, by its cell signature. Unsigned cell headers
+// never get this far, so neither can be claimed by an external client.
+func classifyRequest(r *http.Request, cellID string) Priority {
+    if caller := auth.CallerFromContext(r.Context()); caller != "" && !strings.HasPrefix(caller, cellID+"/") {
+        return PriorityCrossCell
+    }
+    if r.Header.Get(SourceCellHeader) != "" {
+        return PriorityCrossCell
+    }
+    return PriorityNormal
+}
+
+// AdaptiveLimiter is an AIMD concurrency limit for one upstream: the limit
+// grows by one per window of fast responses and is cut multiplicatively when
+// latency exceeds the target or the upstream fails
+type AdaptiveLimiter struct {
+    mutex         sync.Mutex
+    limit         float64
+    minLimit      float64
+    maxLimit      float64
+    latencyTarget time.Duration
+    backoff       float64
+    lastDecrease  time.Time
+    inFlight      int
+    inFlightBy    map[Priority]int
+    admitted      int64
+    rejected      map[Priority]int64
+}
+
+// LimiterStats is a point-in-time view of a limiter. The per-priority maps
+// are keyed by Priority.String(); health checks have no limit.
+type LimiterStats struct {
+    Limit            int              `json:"limit"`
+    InFlight         int              `json:"in_flight"`
+    Admitted         int64            `json:"admitted"`
+    Rejected         map[string]int64 `json:"rejected"`
+    PriorityLimits   map[string]int   `json:"priority_limits"`
+    PriorityInFlight map[string]int   `json:"priority_in_flight"`
+}
+
+func (l *AdaptiveLimiter) Acquire(priority Priority) bool {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    if float64(l.inFlight) >= l.limit*headroom[priority] {
+        l.rejected[priority]++
+        return false
+    }
+    l.inFlight++
+    l.inFlightBy[priority]++
+    l.admitted++
+    return true
+}
+
+// Release frees the slot a request held and adapts the limit to how the
+// upstream handled it. A request the client cancelled says nothing about the
+// upstream, so it only frees its slot.
+func (l *AdaptiveLimiter) Release(priority Priority, latency time.Duration, failed, cancelled bool) {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    l.inFlight--
+    l.inFlightBy[priority]--
+    if cancelled {
+        return
+    }
+
+    now := time.Now()
+    if failed || latency > l.latencyTarget {
+        // Cut at most once per latency window so one burst of slow
+        // responses does not collapse the limit to the floor
+        if now.Sub(l.lastDecrease) >= l.latencyTarget {
+            l.limit = math.Max(l.minLimit, l.limit*l.backoff)
+            l.lastDecrease = now
+        }
+        return
+    }
+
+    // Only grow while the limit is actually being exercised
+    if float64(l.inFlight+1) >= l.limit/2 {
+        l.limit = math.Min(l.maxLimit, l.limit+1/l.limit)
+    }
+}
+
+func (l *AdaptiveLimiter) Stats() LimiterStats {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+
+    rejected := make(map[string]int64, len(priorities))
+    limits := make(map[string]int, len(priorities))
+    inFlight := make(map[string]int, len(priorities))
+    for _, priority := range priorities {
+        rejected[priority.String()] = l.rejected[priority]
+        limits[priority.String()] = int(l.limit * headroom[priority])
+        inFlight[priority.String()] = l.inFlightBy[priority]
+    }
+    return LimiterStats{
+        Limit:            int(l.limit),
+        InFlight:         l.inFlight,
+        Admitted:         l.admitted,
+        Rejected:         rejected,
+        PriorityLimits:   limits,
+        PriorityInFlight: inFlight,
+    }
+}
+
+// ConcurrencyLimiter keeps one adaptive limiter per upstream
+type ConcurrencyLimiter struct {
+    cellID        string
+    enabled       bool
+    initialLimit  float64
+    minLimit      float64
+    maxLimit      float64
+    latencyTarget time.Duration
+    backoff       float64
+    limiters      map[string]*AdaptiveLimiter
+    mutex         sync.Mutex
+}
+
+func NewConcurrencyLimiter(cellID string) *ConcurrencyLimiter {
+    return &ConcurrencyLimiter{
+        cellID:        cellID,
+        enabled:       config.Bool("CONCURRENCY_LIMIT_ENABLED", true),
+        initialLimit:  float64(config.Int64("CONCURRENCY_INITIAL_LIMIT", 50)),
+        minLimit:      float64(config.Int64("CONCURRENCY_MIN_LIMIT", 5)),
+        maxLimit:      float64(config.Int64("CONCURRENCY_MAX_LIMIT", 500)),
+        latencyTarget: config.Duration("CONCURRENCY_LATENCY_TARGET", time.Second),
+        backoff:       config.Float("CONCURRENCY_BACKOFF", 0.9),
+        limiters:      make(map[string]*AdaptiveLimiter),
+    }
+}
+
+func (c *ConcurrencyLimiter) limiterFor(upstream string) *AdaptiveLimiter {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    limiter, exists := c.limiters[upstream]
+    if !exists {
+        limiter = &AdaptiveLimiter{
+            limit:         c.initialLimit,
+            minLimit:      c.minLimit,
+            maxLimit:      c.maxLimit,
+            latencyTarget: c.latencyTarget,
+            backoff:       c.backoff,
+            inFlightBy:    make(map[Priority]int),
+            rejected:      make(map[Priority]int64),
+        }
+        c.limiters[upstream] = limiter
+    }
+    return limiter
+}
+
+// Middleware sheds requests to the upstream once its adaptive limit is reached
+func (c *ConcurrencyLimiter) Middleware(upstream string, next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if !c.enabled {
+            next(w, r)
+            return
+        }
+
+        limiter := c.limiterFor(upstream)
+        priority := classifyRequest(r, c.cellID)
+        if !limiter.Acquire(priority) {
+            w.Header().Set("Retry-After", "1")
+            e := shared.NewError(shared.ErrorOverloaded, "Upstream overloaded, request shed")
+            e.Upstream = upstream
+            e.UpstreamCell = upstreamCell(c.cellID, upstream)
+            e.Reason = "concurrency limit reached"
+            shared.WriteFailure(w, c.cellID, e)
+            return
+        }
+
+        recorder := middleware.NewStatusRecorder(w)
+        start := time.Now()
+        defer func() {
+            cancelled := errors.Is(r.Context().Err(), context.Canceled)
+            limiter.Release(priority, time.Since(start), recorder.Status >= http.StatusInternalServerError, cancelled)
+        }()
+        next(recorder, r)
+    }
+}
+
+func (c *ConcurrencyLimiter) Stats() map[string]LimiterStats {
+    c.mutex.Lock()
+    limiters := make(map[string]*AdaptiveLimiter, len(c.limiters))
+    for upstream, limiter := range c.limiters {
+        limiters[upstream] = limiter
+    }
+    c.mutex.Unlock()
+
+    stats := make(map[string]LimiterStats, len(limiters))
+    for upstream, limiter := range limiters {
+        stats[upstream] = limiter.Stats()
+    }
+    return stats
+}
+
+func (c *ConcurrencyLimiter) handleStats(w http.ResponseWriter, r *http.Request) {
+    shared.WriteJSON(w, http.StatusOK, map[string]interface{}{
+        "enabled":   c.enabled,
+        "upstreams": c.Stats(),
+        "timestamp": time.Now(),
+    })
+}
@@ -0,0 +1,83 @@
+package gateway
+
+import (
+    "math"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "cell-shared/auth"
+)
+
+func TestAdaptiveLimiterRelease(t *testing.T) {
+    const target = 100 * time.Millisecond
+    tests := []struct {
+        name         string
+        limit        float64
+        inFlight     int
+        lastDecrease time.Time
+        latency      time.Duration
+        failed       bool
+        cancelled    bool
+        want         float64
+    }{
+        {"fast while busy grows", 10, 6, time.Time{}, 10 * time.Millisecond, false, false, 10.1},
+        {"fast while idle holds", 10, 1, time.Time{}, 10 * time.Millisecond, false, false, 10},
+        {"growth stops at max", 20, 20, time.Time{}, 10 * time.Millisecond, false, false, 20},
+        {"slow cuts", 10, 6, time.Time{}, 2 * target, false, false, 5},
+        {"failure cuts", 10, 6, time.Time{}, 10 * time.Millisecond, true, false, 5},
+        {"cut stops at min", 8, 6, time.Time{}, 2 * target, false, false, 5},
+        {"one cut per window", 10, 6, time.Now(), 2 * target, false, false, 10},
+        {"cancelled holds", 10, 6, time.Time{}, 2 * target, true, true, 10},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            l := &AdaptiveLimiter{
+                limit:         tt.limit,
+                minLimit:      5,
+                maxLimit:      20,
+                latencyTarget: target,
+                backoff:       0.5,
+                lastDecrease:  tt.lastDecrease,
+                inFlight:      tt.inFlight,
+                inFlightBy:    map[Priority]int{PriorityNormal: tt.inFlight},
+                rejected:      make(map[Priority]int64),
+            }
+            l.Release(PriorityNormal, tt.latency, tt.failed, tt.cancelled)
+            if math.Abs(l.limit-tt.want) > 1e-9 {
+                t.Errorf("limit = %v, want %v", l.limit, tt.want)
+            }
+            if l.inFlight != tt.inFlight-1 {
+                t.Errorf("in flight = %d, want %d", l.inFlight, tt.inFlight-1)
+            }
+        })
+    }
+}
+
+func TestClassifyRequest(t *testing.T) {
+    tests := []struct {
+        name       string
+        caller     string
+        sourceCell string
+        want       Priority
+    }{
+        {"anonymous", "", "", PriorityNormal},
+        {"own cell's workload", "cell-a/gateway", "", PriorityNormal},
+        {"other cell's workload", "cell-b/order-service", "", PriorityCrossCell},
+        {"cell sharing a prefix", "cell-ab/order-service", "", PriorityCrossCell},
+        {"other cell's gateway", "", "cell-b", PriorityCrossCell},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(http.MethodGet, "/products/p1", nil)
+            r = r.WithContext(auth.WithCaller(r.Context(), tt.caller))
+            if tt.sourceCell != "" {
+                r.Header.Set(SourceCellHeader, tt.sourceCell)
+            }
+            if got := classifyRequest(r, "cell-a"); got != tt.want {
+                t.Errorf("classifyRequest() = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,464 @@
+// Package gateway is the API gateway every cell runs in front of its
+// services. It routes this cell's paths to its services and the other cell's
+// to that cell's gateway; what differs between cells is their Config.
+package gateway
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+
+    "cell-shared"
+    "cell-shared/config"
+    "cell-shared/logging"
+    "cell-shared/middleware"
+    "cell-shared/server"
+)
+
+// Upstream is a service behind the gateway, or the other cell's gateway,
+// which is named <cell>-gateway. Host, when set, is sent as the Host of every
+// request to it, for upstreams behind a proxy that routes by host name.
+type Upstream struct {
+    Name string
+    URL  string
+    Host string
+}
+
+// Route sends the requests under Prefix, or for exactly Path when it is set,
+// to the upstream named Upstream. Name picks its limits and rate limit.
+type Route struct {
+    Name     string
+    Prefix   string
+    Path     string
+    Upstream string
+}
+
+// Config is what sets one cell's gateway apart from the other's
+type Config struct {
+    CellID string
+    Port   string
+    // Services are this cell's services
+    Services []Upstream
+    // Peer is the other cell's gateway
+    Peer   Upstream
+    Routes []Route
+    // KeysFrom is the upstream that serves /.well-known/jwks.json
+    KeysFrom string
+    // PreWarm holds readiness until every service has been activated
+    PreWarm bool
+}
+
+type Gateway struct {
+    CellID      string
+    Port        string
+    services    []Upstream
+    peer        Upstream
+    routes      []Route
+    upstreams   map[string]Upstream
+    preWarm     bool
+    health      *HealthChecker
+    activator   *Activator
+    server      *server.Server
+    routeLimits map[string]RouteLimits
+    rateLimiter *RateLimiter
+    concurrency *ConcurrencyLimiter
+    metrics     *UpstreamMetrics
+    specs       *SpecAggregator
+    authz       *Authorizer
+    cells       *CellSigner
+    maxHops     int
+    client      *http.Client
+}
+
+// New builds the gateway cfg describes and registers its routes. It exits
+// when the routes would send requests round in a loop.
+func New(cfg Config) *Gateway {
+    upstreams := append(append([]Upstream{}, cfg.Services...), cfg.Peer)
+    byName := make(map[string]Upstream, len(upstreams))
+    for _, upstream := range upstreams {
+        byName[upstream.Name] = upstream
+    }
+    var names, peerPrefixes []string
+    seen := make(map[string]bool)
+    for _, route := range cfg.Routes {
+        if !seen[route.Name] {
+            seen[route.Name] = true
+            names = append(names, route.Name)
+        }
+        if route.Upstream == cfg.Peer.Name {
+            peerPrefixes = append(peerPrefixes, route.match())
+        }
+    }
+
+    g := &Gateway{
+        CellID:      cfg.CellID,
+        Port:        cfg.Port,
+        services:    cfg.Services,
+        peer:        cfg.Peer,
+        routes:      cfg.Routes,
+        upstreams:   byName,
+        preWarm:     cfg.PreWarm,
+        health:      NewHealthChecker(),
+        routeLimits: loadRouteLimits(names...),
+        rateLimiter: NewRateLimiter(cfg.CellID, names...),
+        concurrency: NewConcurrencyLimiter(cfg.CellID),
+        cells:       NewCellSigner(cfg.CellID),
+        maxHops:     int(config.Int64("MAX_HOPS", 5)),
+        client:      server.NewClient(config.Duration("UPSTREAM_TIMEOUT", 30*time.Second)),
+    }
+
+    g.server = server.New(g.CellID+"-gateway", g.CellID)
+    // Users reach the gateway without a client certificate; the other
+    // cell's gateway and services present theirs
+    g.server.OptionalClientCerts = true
+    for _, upstream := range upstreams {
+        g.health.Register(upstream.Name, upstream.URL, upstream.Host)
+    }
+    g.activator = NewActivator(g.health)
+    keys := byName[cfg.KeysFrom]
+    g.authz = NewAuthorizer(g.CellID, cfg.KeysFrom, keys.URL+"/.well-known/jwks.json", keys.Host)
+
+    g.server.Readiness.Register("upstreams", true, g.health.AnyUsableCheck)
+    for _, upstream := range upstreams {
+        g.server.Readiness.Register(upstream.Name, false, g.health.UpstreamCheck(upstream.Name))
+    }
+
+    g.metrics = NewUpstreamMetrics(g.server.Metrics)
+    g.registerStateMetrics()
+
+    local := make([]specSource, 0, len(cfg.Services))
+    for _, service := range cfg.Services {
+        local = append(local, specSource{service.Name, service.URL, service.Host})
+    }
+    g.specs = NewSpecAggregator(g.CellID+"-gateway", g.client, local, specSource{cfg.Peer.Name, cfg.Peer.URL, cfg.Peer.Host}, peerPrefixes...)
+    g.server.OpenAPI = http.HandlerFunc(g.specs.handleSpec)
+
+    g.registerRoutes()
+    return g
+}
+
+// match is the path a route serves, or the prefix of the paths it serves
+func (rt Route) match() string {
+    if rt.Path != "" {
+        return rt.Path
+    }
+    return rt.Prefix
+}
+
+// registerRoutes serves health, stats and the OpenAPI documents and proxies
+// each route to its upstream, after checking the routes do not loop
+func (g *Gateway) registerRoutes() {
+    r := g.server.Router
+    g.server.HandleHealth(g.healthDetails)
+    r.HandleFunc("/stats/concurrency", g.concurrency.handleStats).Methods("GET")
+    r.HandleFunc("/openapi/cell.json", g.specs.handleCellSpec).Methods("GET")
+
+    routes := make(map[string]string, len(g.routes))
+    for _, rt := range g.routes {
+        rt := rt
+        url := g.upstreams[rt.Upstream].URL
+        handler := g.route(rt.Name, rt.Upstream, func(w http.ResponseWriter, r *http.Request) {
+            g.forward(rt.Name, rt.Upstream, url, w, r)
+        })
+        if rt.Path != "" {
+            r.Path(rt.Path).HandlerFunc(handler)
+        } else {
+            r.PathPrefix(rt.Prefix).HandlerFunc(handler)
+        }
+        routes[rt.match()] = rt.Upstream
+    }
+
+    // A misconfigured upstream URL would send requests round in circles
+    if err := checkRoutes(g.CellID+"-gateway", g.Port, routes, g.upstreams); err != nil {
+        log.Fatalf("Invalid routes: %v", err)
+    }
+}
+
+// Run checks upstream health in the background and serves until shutdown
+func (g *Gateway) Run() {
+    healthCtx, stopHealthChecks := context.WithCancel(context.Background())
+    g.health.Start(healthCtx)
+    if g.preWarm {
+        go func() {
+            g.preWarmDependencies()
+            g.server.Readiness.MarkWarm()
+        }()
+    } else {
+        g.server.Readiness.MarkWarm()
+    }
+
+    g.server.OnShutdown(func(ctx context.Context) {
+        stopHealthChecks()
+    })
+    g.server.Run(g.Port)
+}
+
+// ensureServiceHealthy holds the request until the service is ready, replying
+// 503 when activation fails; it reports whether the request may proceed
+func (g *Gateway) ensureServiceHealthy(w http.ResponseWriter, r *http.Request, serviceName string) bool {
+    if err := g.activator.Wait(r.Context(), serviceName); err != nil {
+        logging.FromContext(r.Context()).Warn("Service unavailable", "upstream", serviceName, "error", err)
+        w.Header().Set("Retry-After", "5")
+        shared.WriteFailure(w, g.CellID, g.activationError(serviceName, err))
+        return false
+    }
+    return true
+}
+
+// activationError describes why serviceName could not be activated
+func (g *Gateway) activationError(serviceName string, err error) *shared.Error {
+    e := shared.UpstreamError("Service unavailable", serviceName, upstreamCell(g.CellID, serviceName), err)
+    switch {
+    case errors.Is(err, ErrActivationQueueFull):
+        e.Code = shared.ErrorOverloaded
+        e.Reason = "activation queue full"
+    case errors.Is(err, ErrActivationTimeout):
+        e.Reason = "not ready after activation wait"
+    }
+    return e
+}
+
+// upstreamCell is the cell an upstream runs in: the peer for its gateway,
+// cellID for everything else
+func upstreamCell(cellID, upstream string) string {
+    if strings.HasSuffix(upstream, "-gateway") {
+        return strings.TrimSuffix(upstream, "-gateway")
+    }
+    return cellID
+}
+
+// preWarmDependencies concurrently warms up all dependent services
+func (g *Gateway) preWarmDependencies() {
+    var wg sync.WaitGroup
+    for _, service := range g.services {
+        wg.Add(1)
+        go func(name string) {
+            defer wg.Done()
+            ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+            defer cancel()
+            if err := g.activator.Wait(ctx, name); err != nil {
+                log.Printf("Failed to pre-warm %s: %v", name, err)
+            }
+        }(service.Name)
+    }
+
+    // Wait for all services to be warmed up (with timeout)
+    done := make(chan struct{})
+    go func() {
+        wg.Wait()
+        close(done)
+    }()
+
+    select {
+    case <-done:
+        log.Printf("All dependent services pre-warmed successfully")
+    case <-time.After(30 * time.Second):
+        log.Printf("Pre-warming timeout reached, proceeding anyway")
+    }
+}
+
+// proxyRequest streams the request to upstream at targetURL and returns an
+// error when the upstream itself failed, so callers can drop its cached health.
+// Each gateway adds itself to Via, and a request that already passed this
+// gateway or MAX_HOPS proxies gets a 508 instead of going round again.
+func (g *Gateway) proxyRequest(route, upstream, targetURL string, w http.ResponseWriter, r *http.Request) error {
+    limits := g.limitsFor(route)
+    if r.ContentLength > limits.MaxRequestBytes {
+        shared.WriteError(w, g.CellID, shared.ErrorPayloadTooLarge, "Request body too large")
+        return nil
+    }
+
+    self := g.CellID + "-gateway"
+    if hops, looped := viaHops(r.Header, self); looped || hops >= g.maxHops {
+        logging.FromContext(r.Context()).Error("Routing loop detected", "upstream", upstream, "via", strings.Join(r.Header.Values("Via"), ", "), "max_hops", g.maxHops)
+        e := shared.NewError(shared.ErrorLoopDetected, "Request is looping between gateways")
+        e.Upstream = upstream
+        e.UpstreamCell = upstreamCell(g.CellID, upstream)
+        e.Reason = fmt.Sprintf("passed %d proxies", hops)
+        if looped {
+            e.Reason = "already passed " + self
+        }
+        shared.WriteFailure(w, g.CellID, e)
+        return nil
+    }
+
+    // The body is read into memory to sign it, so cap it at the route's limit
+    body := http.MaxBytesReader(w, r.Body, limits.MaxRequestBytes)
+    defer body.Close()
+
+    target := targetURL + r.URL.Path
+    if r.URL.RawQuery != "" {
+        target += "?" + r.URL.RawQuery
+    }
+    req, err := http.NewRequestWithContext(r.Context(), r.Method, target, body)
+    if err != nil {
+        shared.WriteError(w, g.CellID, shared.ErrorInternal, "Failed to create request")
+        return nil
+    }
+    req.ContentLength = r.ContentLength
+    if host := g.upstreams[upstream].Host; host != "" {
+        req.Host = host
+    }
+
+    for key, values := range r.Header {
+        for _, value := range values {
+            req.Header.Add(key, value)
+        }
+    }
+
+    req.Header.Add("Via", viaProtocol+" "+self)
+    if remote, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+        req.Header.Set("X-Forwarded-For", strings.Join(append(r.Header.Values("X-Forwarded-For"), remote), ", "))
+    }
+    req.Header.Set(GatewayIDHeader, g.CellID)
+    req.Header.Set("X-Request-Time", time.Now().Format(time.RFC3339))
+    req.Header.Set(SourceCellHeader, g.CellID)
+    if peer := upstreamCell(g.CellID, upstream); peer != g.CellID {
+        if err := g.cells.Sign(req, peer, g.rateLimiter.clientIP(r)); err != nil {
+            var maxBytesErr *http.MaxBytesError
+            if errors.As(err, &maxBytesErr) {
+                shared.WriteError(w, g.CellID, shared.ErrorPayloadTooLarge, "Request body too large")
+                return nil
+            }
+            logging.FromContext(r.Context()).Error("Cannot sign cross-cell request", "target", targetURL, "error", err)
+            shared.WriteError(w, g.CellID, shared.ErrorInternal, "Failed to sign cross-cell request")
+            return nil
+        }
+    }
+
+    resp, err := g.client.Do(req)
+    if err != nil {
+        var maxBytesErr *http.MaxBytesError
+        if errors.As(err, &maxBytesErr) {
+            shared.WriteError(w, g.CellID, shared.ErrorPayloadTooLarge, "Request body too large")
+            return nil
+        }
+        if errors.Is(err, context.Canceled) {
+            logging.FromContext(r.Context()).Info("Client closed request", "target", targetURL)
+        } else {
+            logging.FromContext(r.Context()).Error("Error proxying request", "target", targetURL, "error", err)
+        }
+        shared.WriteFailure(w, g.CellID, shared.UpstreamError("Service unavailable", upstream, upstreamCell(g.CellID, upstream), err))
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.ContentLength > limits.MaxResponseBytes {
+        logging.FromContext(r.Context()).Warn("Upstream response too large", "target", targetURL, "limit", limits.MaxResponseBytes, "content_length", resp.ContentLength)
+        e := shared.NewError(shared.ErrorUpstreamResponse, "Upstream response too large")
+        e.Upstream = upstream
+        e.UpstreamCell = upstreamCell(g.CellID, upstream)
+        e.Reason = fmt.Sprintf("response exceeds %d bytes", limits.MaxResponseBytes)
+        shared.WriteFailure(w, g.CellID, e)
+        return nil
+    }
+
+    for key, values := range resp.Header {
+        if key == http.CanonicalHeaderKey(logging.RequestIDHeader) {
+            // Already set on the way in
+            continue
+        }
+        for _, value := range values {
+            w.Header().Add(key, value)
+        }
+    }
+
+    // Keep a 503 to tell load shed by the upstream from a failure
+    var reply io.Reader = io.LimitReader(resp.Body, limits.MaxResponseBytes+1)
+    var answer bytes.Buffer
+    if resp.StatusCode == http.StatusServiceUnavailable {
+        reply = io.TeeReader(reply, &answer)
+    }
+    w.WriteHeader(resp.StatusCode)
+    copied, err := io.Copy(w, reply)
+    if copied > limits.MaxResponseBytes {
+        // Headers are already sent, so abort the connection rather than
+        // hand the client a silently truncated body
+        logging.FromContext(r.Context()).Warn("Upstream response exceeded limit, aborting", "target", targetURL, "limit", limits.MaxResponseBytes)
+        panic(http.ErrAbortHandler)
+    }
+    if err != nil {
+        logging.FromContext(r.Context()).Error("Error streaming response", "target", targetURL, "error", err)
+    }
+
+    switch resp.StatusCode {
+    case http.StatusServiceUnavailable:
+        if shedding(answer.Bytes()) {
+            return nil
+        }
+        return fmt.Errorf("upstream %s returned %d", targetURL, resp.StatusCode)
+    case http.StatusBadGateway, http.StatusGatewayTimeout:
+        return fmt.Errorf("upstream %s returned %d", targetURL, resp.StatusCode)
+    }
+    return nil
+}
+
+// shedding reports whether body is the error an upstream, such as the other
+// cell's gateway, refuses requests with to shed load, which is an answer from
+// a working upstream rather than a failure
+func shedding(body []byte) bool {
+    var response shared.ServiceResponse
+    if json.Unmarshal(body, &response) != nil || response.Error == nil {
+        return false
+    }
+    return response.Error.Code == shared.ErrorOverloaded || response.Error.Code == shared.ErrorRateLimited
+}
+
+// forward proxies to a service and feeds the outcome to passive outlier
+// detection and upstream metrics
+func (g *Gateway) forward(route, serviceName, serviceURL string, w http.ResponseWriter, r *http.Request) {
+    recorder := middleware.NewStatusRecorder(w)
+    start := time.Now()
+    err := g.proxyRequest(route, serviceName, serviceURL, recorder, r)
+    g.metrics.Observe(serviceName, recorder.Status, time.Since(start), err)
+    g.health.ReportProxyResult(serviceName, err)
+}
+
+// route wraps a proxy handler with the service policy, cross-cell signature
+// checks, token verification, rate limiting, the access policy, activation
+// and load shedding for its upstream. Tokens are verified ahead of the rate
+// limiter so it can key on the caller, but rejected only after it, so bad
+// tokens still spend the client's tokens.
+func (g *Gateway) route(name, upstream string, handler http.HandlerFunc) http.HandlerFunc {
+    shed := g.concurrency.Middleware(upstream, handler)
+    limited := g.rateLimiter.Middleware(name, g.authz.Middleware(g.activate(upstream, shed)))
+    verified := g.cells.Middleware(g.limitsFor(name).MaxRequestBytes, g.authz.Authenticate(limited))
+    return g.server.Callers.Middleware(verified)
+}
+
+// activate holds requests until the activator reports upstream ready. It runs
+// ahead of the concurrency limiter, so requests waiting for a cold start hold
+// no slot and the wait does not count as upstream latency.
+func (g *Gateway) activate(upstream string, next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if g.ensureServiceHealthy(w, r, upstream) {
+            next(w, r)
+        }
+    }
+}
+
+func (g *Gateway) healthDetails() map[string]interface{} {
+    services := make([]string, 0, len(g.services))
+    endpoints := make(map[string]string, len(g.upstreams))
+    for _, service := range g.services {
+        services = append(services, service.Name)
+    }
+    for name, upstream := range g.upstreams {
+        endpoints[strings.ReplaceAll(name, "-", "_")] = upstream.URL
+    }
+    return map[string]interface{}{
+        "upstream_status": g.health.Aggregate(),
+        "upstreams":       g.health.Snapshot(),
+        "services":        services,
+        "endpoints":       endpoints,
+    }
+}
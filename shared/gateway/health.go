@@ -0,0 +1,295 @@
+package gateway
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+
+    "cell-shared"
+    "cell-shared/config"
+    "cell-shared/mtls"
+)
+
+const (
+    healthUnknown   = "unknown"
+    healthHealthy   = "healthy"
+    healthUnhealthy = "unhealthy"
+)
+
+// UpstreamHealth is the gateway's view of one upstream
+type UpstreamHealth struct {
+    Name                 string    `json:"name"`
+    URL                  string    `json:"url"`
+    Host                 string    `json:"host,omitempty"`
+    Status               string    `json:"status"`
+    ConsecutiveSuccesses int       `json:"consecutive_successes"`
+    ConsecutiveFailures  int       `json:"consecutive_failures"`
+    ProxyFailures        int       `json:"proxy_failures"`
+    LastSuccess          time.Time `json:"last_success,omitempty"`
+    LastCheck            time.Time `json:"last_check,omitempty"`
+    LastError            string    `json:"last_error,omitempty"`
+    SchemaVersion        string    `json:"schema_version,omitempty"`
+}
+
+// HealthChecker tracks upstream health from two sources: active probes of
+// each upstream's /health endpoint on an interval, and passive outlier
+// detection from proxied request failures
+type HealthChecker struct {
+    client             *http.Client
+    interval           time.Duration
+    healthyThreshold   int
+    unhealthyThreshold int
+    outlierThreshold   int
+    cacheTTL           time.Duration
+    upstreams          map[string]*UpstreamHealth
+    order              []string
+    mutex              sync.RWMutex
+}
+
+func NewHealthChecker() *HealthChecker {
+    return &HealthChecker{
+        client:             &http.Client{Timeout: config.Duration("HEALTH_CHECK_TIMEOUT", 5*time.Second), Transport: mtls.NewTransport()},
+        interval:           config.DurationOrZero("HEALTH_CHECK_INTERVAL", 10*time.Second),
+        healthyThreshold:   int(config.Int64("HEALTH_CHECK_HEALTHY_THRESHOLD", 2)),
+        unhealthyThreshold: int(config.Int64("HEALTH_CHECK_UNHEALTHY_THRESHOLD", 3)),
+        outlierThreshold:   int(config.Int64("OUTLIER_CONSECUTIVE_ERRORS", 5)),
+        cacheTTL:           config.Duration("HEALTH_CACHE_TTL", 30*time.Second),
+        upstreams:          make(map[string]*UpstreamHealth),
+    }
+}
+
+// Register adds an upstream, probed with host as the Host when it is set;
+// registering the same name twice is a no-op
+func (h *HealthChecker) Register(name, url, host string) {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    if _, exists := h.upstreams[name]; exists {
+        return
+    }
+    h.upstreams[name] = &UpstreamHealth{Name: name, URL: url, Host: host, Status: healthUnknown}
+    h.order = append(h.order, name)
+}
+
+// Start runs active health checks for every registered upstream until ctx is done
+func (h *HealthChecker) Start(ctx context.Context) {
+    if h.interval <= 0 {
+        log.Printf("Active health checks disabled")
+        return
+    }
+
+    h.mutex.RLock()
+    names := append([]string(nil), h.order...)
+    h.mutex.RUnlock()
+
+    for _, name := range names {
+        go func(name string) {
+            ticker := time.NewTicker(h.interval)
+            defer ticker.Stop()
+
+            for {
+                h.Check(name)
+                select {
+                case <-ctx.Done():
+                    return
+                case <-ticker.C:
+                }
+            }
+        }(name)
+    }
+}
+
+// Check probes the upstream once and applies the healthy/unhealthy thresholds
+func (h *HealthChecker) Check(name string) bool {
+    h.mutex.RLock()
+    upstream, exists := h.upstreams[name]
+    h.mutex.RUnlock()
+    if !exists {
+        return false
+    }
+
+    health, err := h.probe(upstream.URL, upstream.Host)
+
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    upstream.LastCheck = time.Now()
+    if health.SchemaVersion != "" && health.SchemaVersion != upstream.SchemaVersion {
+        upstream.SchemaVersion = health.SchemaVersion
+        if !shared.CompatibleSchema(health.SchemaVersion) {
+            log.Printf("Upstream %s speaks schema %s, incompatible with this gateway's %s", name, health.SchemaVersion, shared.SchemaVersion)
+        }
+    }
+    if err != nil {
+        upstream.LastError = err.Error()
+        upstream.ConsecutiveSuccesses = 0
+        upstream.ConsecutiveFailures++
+        if upstream.Status != healthUnhealthy && upstream.ConsecutiveFailures >= h.unhealthyThreshold {
+            h.transition(upstream, healthUnhealthy)
+        }
+        return false
+    }
+
+    upstream.LastSuccess = upstream.LastCheck
+    upstream.ConsecutiveFailures = 0
+    upstream.ConsecutiveSuccesses++
+    if upstream.Status != healthHealthy && upstream.ConsecutiveSuccesses >= h.healthyThreshold {
+        h.transition(upstream, healthHealthy)
+    }
+    return true
+}
+
+// probe calls the upstream's /health. The body is only informational, so
+// one that does not decode still counts as healthy.
+func (h *HealthChecker) probe(url, host string) (shared.Health, error) {
+    var health shared.Health
+    req, err := http.NewRequest(http.MethodGet, url+"/health", nil)
+    if err != nil {
+        return health, err
+    }
+    if host != "" {
+        req.Host = host
+    }
+    resp, err := h.client.Do(req)
+    if err != nil {
+        return health, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return health, &statusError{code: resp.StatusCode}
+    }
+    json.NewDecoder(resp.Body).Decode(&health)
+    return health, nil
+}
+
+// MarkHealthy marks an upstream healthy straight away, bypassing the
+// threshold; the activator uses it once a cold upstream answers
+func (h *HealthChecker) MarkHealthy(name string) {
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    if upstream, exists := h.upstreams[name]; exists {
+        upstream.LastSuccess = time.Now()
+        upstream.ProxyFailures = 0
+        h.transition(upstream, healthHealthy)
+    }
+}
+
+// ReportProxyResult feeds passive outlier detection: consecutive proxy
+// failures eject the upstream until a probe finds it healthy again. A call
+// the client gave up on says nothing about the upstream and is not counted.
+func (h *HealthChecker) ReportProxyResult(name string, err error) {
+    if errors.Is(err, context.Canceled) {
+        return
+    }
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+
+    upstream, exists := h.upstreams[name]
+    if !exists {
+        return
+    }
+
+    if err == nil {
+        upstream.ProxyFailures = 0
+        upstream.LastSuccess = time.Now()
+        return
+    }
+
+    upstream.ProxyFailures++
+    upstream.LastError = err.Error()
+    if upstream.Status != healthUnhealthy && upstream.ProxyFailures >= h.outlierThreshold {
+        log.Printf("Ejecting %s after %d consecutive proxy failures", name, upstream.ProxyFailures)
+        upstream.ConsecutiveSuccesses = 0
+        h.transition(upstream, healthUnhealthy)
+    }
+}
+
+func (h *HealthChecker) transition(upstream *UpstreamHealth, status string) {
+    if upstream.Status != status {
+        log.Printf("Upstream %s is now %s", upstream.Name, status)
+        upstream.Status = status
+    }
+}
+
+// IsHealthy reports whether the upstream is healthy and was seen working within the cache TTL
+func (h *HealthChecker) IsHealthy(name string) bool {
+    h.mutex.RLock()
+    defer h.mutex.RUnlock()
+
+    upstream, exists := h.upstreams[name]
+    return exists && upstream.Status == healthHealthy && time.Since(upstream.LastSuccess) < h.cacheTTL
+}
+
+// Snapshot returns the state of every upstream in registration order
+func (h *HealthChecker) Snapshot() []UpstreamHealth {
+    h.mutex.RLock()
+    defer h.mutex.RUnlock()
+
+    snapshot := make([]UpstreamHealth, 0, len(h.order))
+    for _, name := range h.order {
+        snapshot = append(snapshot, *h.upstreams[name])
+    }
+    return snapshot
+}
+
+// Aggregate summarises upstream health: "healthy" when nothing is known to
+// be unhealthy, "degraded" when some upstreams are, "unhealthy" when all are
+func (h *HealthChecker) Aggregate() string {
+    snapshot := h.Snapshot()
+    unhealthy := 0
+    for _, upstream := range snapshot {
+        if upstream.Status == healthUnhealthy {
+            unhealthy++
+        }
+    }
+
+    switch {
+    case unhealthy == 0:
+        return healthHealthy
+    case unhealthy == len(snapshot):
+        return healthUnhealthy
+    default:
+        return "degraded"
+    }
+}
+
+// UpstreamCheck reports an upstream's tracked state as a readiness check
+func (h *HealthChecker) UpstreamCheck(name string) func(ctx context.Context) error {
+    return func(ctx context.Context) error {
+        h.mutex.RLock()
+        defer h.mutex.RUnlock()
+
+        upstream, exists := h.upstreams[name]
+        if !exists {
+            return fmt.Errorf("upstream %s not registered", name)
+        }
+        if upstream.Status == healthUnhealthy {
+            return fmt.Errorf("%s is unhealthy: %s", name, upstream.LastError)
+        }
+        return nil
+    }
+}
+
+// AnyUsableCheck fails only when every upstream is unhealthy, so one
+// scaled-down dependency does not take the whole gateway out of rotation
+func (h *HealthChecker) AnyUsableCheck(ctx context.Context) error {
+    if h.Aggregate() == healthUnhealthy {
+        return fmt.Errorf("all upstreams are unhealthy")
+    }
+    return nil
+}
+
+type statusError struct {
+    code int
+}
+
+func (e *statusError) Error() string {
+    return "health check returned " + http.StatusText(e.code)
+}
@@ -0,0 +1,48 @@
+package gateway
+
+import (
+    "strings"
+
+    "cell-shared/config"
+)
+
+const (
+    defaultMaxRequestBodyBytes  int64 = 1 << 20  // 1 MiB
+    defaultMaxResponseBodyBytes int64 = 10 << 20 // 10 MiB
+)
+
+// RouteLimits bounds how much data a single proxied request may move
+type RouteLimits struct {
+    MaxRequestBytes  int64
+    MaxResponseBytes int64
+}
+
+// loadRouteLimits reads the global body limits and applies per-route
+// overrides such as USERS_MAX_REQUEST_BODY_BYTES or ORDERS_MAX_RESPONSE_BODY_BYTES
+func loadRouteLimits(routes ...string) map[string]RouteLimits {
+    defaults := RouteLimits{
+        MaxRequestBytes:  config.Int64("MAX_REQUEST_BODY_BYTES", defaultMaxRequestBodyBytes),
+        MaxResponseBytes: config.Int64("MAX_RESPONSE_BODY_BYTES", defaultMaxResponseBodyBytes),
+    }
+
+    limits := make(map[string]RouteLimits, len(routes))
+    for _, route := range routes {
+        prefix := strings.ToUpper(route) + "_"
+        limits[route] = RouteLimits{
+            MaxRequestBytes:  config.Int64(prefix+"MAX_REQUEST_BODY_BYTES", defaults.MaxRequestBytes),
+            MaxResponseBytes: config.Int64(prefix+"MAX_RESPONSE_BODY_BYTES", defaults.MaxResponseBytes),
+        }
+    }
+    return limits
+}
+
+// limitsFor returns the limits for a route, falling back to the defaults
+func (g *Gateway) limitsFor(route string) RouteLimits {
+    if limits, ok := g.routeLimits[route]; ok {
+        return limits
+    }
+    return RouteLimits{
+        MaxRequestBytes:  defaultMaxRequestBodyBytes,
+        MaxResponseBytes: defaultMaxResponseBodyBytes,
+    }
+}
@@ -0,0 +1,90 @@
+package gateway
+
+import (
+    "context"
+    "errors"
+    "strconv"
+    "time"
+
+    "cell-shared/metrics"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// UpstreamMetrics records per-upstream proxy metrics alongside the shared
+// RED metrics
+type UpstreamMetrics struct {
+    requests *prometheus.CounterVec
+    failures *prometheus.CounterVec
+    duration *prometheus.HistogramVec
+}
+
+func NewUpstreamMetrics(m *metrics.Metrics) *UpstreamMetrics {
+    u := &UpstreamMetrics{
+        requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Name:        "gateway_upstream_requests_total",
+            Help:        "Requests proxied to each upstream, by status code returned to the client.",
+            ConstLabels: m.Labels,
+        }, []string{"upstream", "code"}),
+        failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Name:        "gateway_upstream_failures_total",
+            Help:        "Proxied requests where the upstream was unreachable or returned 502, 503 or 504.",
+            ConstLabels: m.Labels,
+        }, []string{"upstream"}),
+        duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+            Name:        "gateway_upstream_request_duration_seconds",
+            Help:        "Time spent proxying to each upstream, including streaming the response.",
+            ConstLabels: m.Labels,
+            Buckets:     prometheus.DefBuckets,
+        }, []string{"upstream"}),
+    }
+    m.Register(u.requests, u.failures, u.duration)
+    return u
+}
+
+// Observe records the outcome of one proxied request. A request the client
+// cancelled is counted with its 499 but is not the upstream's failure.
+func (u *UpstreamMetrics) Observe(upstream string, status int, duration time.Duration, err error) {
+    u.requests.WithLabelValues(upstream, strconv.Itoa(status)).Inc()
+    u.duration.WithLabelValues(upstream).Observe(duration.Seconds())
+    if err != nil && !errors.Is(err, context.Canceled) {
+        u.failures.WithLabelValues(upstream).Inc()
+    }
+}
+
+// registerStateMetrics exposes upstream health and the adaptive concurrency
+// limits as gauges read at scrape time
+func (g *Gateway) registerStateMetrics() {
+    m := g.server.Metrics
+    m.Register(m.NewStoreCollector("gateway_upstream_health", "1 for the upstream's current health state (unknown, healthy or unhealthy).", []string{"upstream", "state"}, func(report func(float64, ...string)) {
+        for _, upstream := range g.health.Snapshot() {
+            for _, state := range []string{healthUnknown, healthHealthy, healthUnhealthy} {
+                value := 0.0
+                if upstream.Status == state {
+                    value = 1
+                }
+                report(value, upstream.Name, state)
+            }
+        }
+    }))
+    m.Register(m.NewStoreCollector("gateway_concurrency_limit", "Current adaptive concurrency limit with each priority's headroom, by upstream and priority.", []string{"upstream", "priority"}, func(report func(float64, ...string)) {
+        for upstream, stats := range g.concurrency.Stats() {
+            for priority, limit := range stats.PriorityLimits {
+                report(float64(limit), upstream, priority)
+            }
+        }
+    }))
+    m.Register(m.NewStoreCollector("gateway_concurrency_in_flight", "Requests currently in flight, by upstream and priority.", []string{"upstream", "priority"}, func(report func(float64, ...string)) {
+        for upstream, stats := range g.concurrency.Stats() {
+            for priority, inFlight := range stats.PriorityInFlight {
+                report(float64(inFlight), upstream, priority)
+            }
+        }
+    }))
+    m.Register(m.NewStoreCounter("gateway_concurrency_shed_total", "Requests shed because the upstream's concurrency limit was reached, by upstream and priority.", []string{"upstream", "priority"}, func(report func(float64, ...string)) {
+        for upstream, stats := range g.concurrency.Stats() {
+            for priority, rejected := range stats.Rejected {
+                report(float64(rejected), upstream, priority)
+            }
+        }
+    }))
+}
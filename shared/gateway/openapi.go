@@ -0,0 +1,153 @@
+package gateway
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+
+    "cell-shared"
+    "cell-shared/config"
+    "cell-shared/logging"
+    "cell-shared/openapi"
+    "cell-shared/server"
+)
+
+// specSource is an upstream whose OpenAPI document the gateway aggregates
+type specSource struct {
+    name string
+    url  string
+    host string
+}
+
+type cachedSpec struct {
+    doc     *openapi.Document
+    fetched time.Time
+}
+
+// SpecAggregator merges the OpenAPI documents of the services behind the
+// gateway. /openapi/cell.json covers this cell's services; /openapi.json adds
+// the peer gateway's cell document for the routes forwarded there. Asking the
+// peer for its cell document only keeps the two gateways from fetching each
+// other in a loop.
+type SpecAggregator struct {
+    title        string
+    client       *http.Client
+    local        []specSource
+    peer         specSource
+    peerPrefixes []string
+    cacheTTL     time.Duration
+    fetchTimeout time.Duration
+    mutex        sync.Mutex
+    cache        map[bool]cachedSpec
+}
+
+func NewSpecAggregator(title string, client *http.Client, local []specSource, peer specSource, peerPrefixes ...string) *SpecAggregator {
+    return &SpecAggregator{
+        title:        title,
+        client:       client,
+        local:        local,
+        peer:         peer,
+        peerPrefixes: peerPrefixes,
+        cacheTTL:     config.Duration("OPENAPI_CACHE_TTL", time.Minute),
+        fetchTimeout: config.Duration("OPENAPI_FETCH_TIMEOUT", 5*time.Second),
+        cache:        make(map[bool]cachedSpec),
+    }
+}
+
+func (a *SpecAggregator) handleSpec(w http.ResponseWriter, r *http.Request) {
+    a.document(r.Context(), true).ServeHTTP(w, r)
+}
+
+func (a *SpecAggregator) handleCellSpec(w http.ResponseWriter, r *http.Request) {
+    a.document(r.Context(), false).ServeHTTP(w, r)
+}
+
+// document returns the cached aggregate, rebuilding it once it is older than
+// OPENAPI_CACHE_TTL. Upstreams that cannot be fetched are listed under
+// x-unavailable instead of failing the whole document.
+func (a *SpecAggregator) document(ctx context.Context, includePeer bool) *openapi.Document {
+    a.mutex.Lock()
+    defer a.mutex.Unlock()
+
+    if cached, ok := a.cache[includePeer]; ok && time.Since(cached.fetched) < a.cacheTTL {
+        return cached.doc
+    }
+
+    doc := openapi.New(a.title, server.Version)
+    for _, source := range a.local {
+        a.mergeFrom(ctx, doc, source, source.url+"/openapi.json", nil)
+    }
+    if includePeer {
+        a.mergeFrom(ctx, doc, a.peer, a.peer.url+"/openapi/cell.json", a.peerPrefixes)
+    }
+
+    a.cache[includePeer] = cachedSpec{doc: doc, fetched: time.Now()}
+    return doc
+}
+
+// mergeFrom adds the document at url to doc, keeping only paths under
+// prefixes when any are given
+func (a *SpecAggregator) mergeFrom(ctx context.Context, doc *openapi.Document, source specSource, url string, prefixes []string) {
+    fetched, err := a.fetch(ctx, url, source.host)
+    if err != nil {
+        logging.FromContext(ctx).Warn("Could not fetch OpenAPI document", "upstream", source.name, "error", err)
+        doc.Unavailable = append(doc.Unavailable, source.name)
+        return
+    }
+
+    if len(prefixes) > 0 {
+        for path := range fetched.Paths {
+            if !hasAnyPrefix(path, prefixes) {
+                delete(fetched.Paths, path)
+            }
+        }
+    }
+    doc.Merge(fetched)
+}
+
+func (a *SpecAggregator) fetch(ctx context.Context, url, host string) (*openapi.Document, error) {
+    ctx, cancel := context.WithTimeout(ctx, a.fetchTimeout)
+    defer cancel()
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    if err != nil {
+        return nil, err
+    }
+    if host != "" {
+        req.Host = host
+    }
+    resp, err := a.client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("%s returned %d", url, resp.StatusCode)
+    }
+    if version := resp.Header.Get(shared.SchemaVersionHeader); version != "" && !shared.CompatibleSchema(version) {
+        return nil, fmt.Errorf("%s uses schema %s, incompatible with %s", url, version, shared.SchemaVersion)
+    }
+
+    var doc openapi.Document
+    if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+        return nil, fmt.Errorf("decoding %s: %w", url, err)
+    }
+    if doc.Paths == nil {
+        doc.Paths = make(map[string]map[string]*openapi.PathOperation)
+    }
+    return &doc, nil
+}
+
+func hasAnyPrefix(path string, prefixes []string) bool {
+    for _, prefix := range prefixes {
+        if strings.HasPrefix(path, prefix) {
+            return true
+        }
+    }
+    return false
+}
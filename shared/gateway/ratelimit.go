@@ -0,0 +1,283 @@
+package gateway
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "math"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "cell-shared"
+    "cell-shared/auth"
+    "cell-shared/config"
+    "github.com/redis/go-redis/v9"
+)
+
+// RateLimitRule configures a token bucket for one route
+type RateLimitRule struct {
+    Rate  float64 // tokens refilled per second, 0 disables limiting
+    Burst int     // bucket capacity
+    KeyBy string  // ip, api-key or tenant
+}
+
+// RateLimitResult is the outcome of taking a token from a bucket
+type RateLimitResult struct {
+    Allowed    bool
+    Limit      int
+    Remaining  int
+    RetryAfter time.Duration
+    Reset      time.Duration
+}
+
+// RateLimitStore holds token buckets; implementations backed by a shared
+// store let every gateway replica enforce the same limit
+type RateLimitStore interface {
+    Take(ctx context.Context, key string, rule RateLimitRule) (RateLimitResult, error)
+}
+
+type RateLimiter struct {
+    cellID       string
+    store        RateLimitStore
+    rules        map[string]RateLimitRule
+    apiKeyHeader string
+    apiKeys      map[string]bool
+    trustProxy   bool
+}
+
+func NewRateLimiter(cellID string, routes ...string) *RateLimiter {
+    defaults := RateLimitRule{
+        Rate:  config.Float("RATE_LIMIT_RPS", 0),
+        Burst: int(config.Int64("RATE_LIMIT_BURST", 20)),
+        KeyBy: config.Get("RATE_LIMIT_KEY", "ip"),
+    }
+
+    rules := make(map[string]RateLimitRule, len(routes))
+    for _, route := range routes {
+        prefix := strings.ToUpper(route) + "_"
+        rules[route] = RateLimitRule{
+            Rate:  config.Float(prefix+"RATE_LIMIT_RPS", defaults.Rate),
+            Burst: int(config.Int64(prefix+"RATE_LIMIT_BURST", int64(defaults.Burst))),
+            KeyBy: config.Get(prefix+"RATE_LIMIT_KEY", defaults.KeyBy),
+        }
+    }
+
+    var store RateLimitStore
+    switch config.Get("RATE_LIMIT_STORE", "memory") {
+    case "redis":
+        store = NewRedisRateLimitStore(config.Get("RATE_LIMIT_REDIS_ADDR", "localhost:6379"))
+    default:
+        store = NewMemoryRateLimitStore()
+    }
+
+    // Only keys issued to clients get their own bucket, so a client cannot
+    // dodge its limit by sending a fresh key with every request
+    apiKeys := make(map[string]bool)
+    for _, key := range strings.Split(config.Get("RATE_LIMIT_API_KEYS", ""), ",") {
+        if key = strings.TrimSpace(key); key != "" {
+            apiKeys[key] = true
+        }
+    }
+
+    return &RateLimiter{
+        cellID:       cellID,
+        store:        store,
+        rules:        rules,
+        apiKeyHeader: config.Get("RATE_LIMIT_API_KEY_HEADER", "X-API-Key"),
+        apiKeys:      apiKeys,
+        trustProxy:   config.Bool("RATE_LIMIT_TRUST_FORWARDED", false),
+    }
+}
+
+// Middleware enforces the route's rule before calling next
+func (rl *RateLimiter) Middleware(route string, next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        rule, ok := rl.rules[route]
+        if !ok || rule.Rate <= 0 {
+            next(w, r)
+            return
+        }
+
+        key := fmt.Sprintf("ratelimit:%s:%s", route, rl.clientKey(rule, r))
+        result, err := rl.store.Take(r.Context(), key, rule)
+        if err != nil {
+            // Fail open: a broken limiter store should not take the cell down
+            log.Printf("Rate limit store error for %s: %v", key, err)
+            next(w, r)
+            return
+        }
+
+        w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+        w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+        w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+
+        if !result.Allowed {
+            w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+            shared.WriteError(w, rl.cellID, shared.ErrorRateLimited, "Rate limit exceeded")
+            return
+        }
+        next(w, r)
+    }
+}
+
+// clientKey identifies the caller according to the rule: by an API key in
+// RATE_LIMIT_API_KEYS, or by the user of the access token the gateway
+// verified. Anything a client could make up falls back to the client IP.
+func (rl *RateLimiter) clientKey(rule RateLimitRule, r *http.Request) string {
+    switch rule.KeyBy {
+    case "api-key":
+        if key := r.Header.Get(rl.apiKeyHeader); rl.apiKeys[key] {
+            return "api-key:" + key
+        }
+    case "tenant":
+        if id := auth.IdentityFromContext(r.Context()); id != nil && id.UserID != "" {
+            return "tenant:" + id.UserID
+        }
+    }
+    return "ip:" + rl.clientIP(r)
+}
+
+// clientIP is the address of the client r came from. For a request the
+// other cell's gateway forwarded, that is the client it signed for, so each
+// client keeps its own bucket rather than sharing the gateway's.
+func (rl *RateLimiter) clientIP(r *http.Request) string {
+    // Cell headers only survive on requests whose signature verified
+    if client := r.Header.Get(CellClientHeader); client != "" && r.Header.Get(SourceCellHeader) != "" {
+        return client
+    }
+    if rl.trustProxy {
+        if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+            return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+        }
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+type tokenBucket struct {
+    tokens float64
+    last   time.Time
+    rule   RateLimitRule
+}
+
+// MemoryRateLimitStore keeps buckets in process memory, so each replica limits independently
+type MemoryRateLimitStore struct {
+    buckets map[string]*tokenBucket
+    mutex   sync.Mutex
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+    store := &MemoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+    go store.evictIdle(time.Minute)
+    return store
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, rule RateLimitRule) (RateLimitResult, error) {
+    now := time.Now()
+
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    bucket, exists := s.buckets[key]
+    if !exists {
+        bucket = &tokenBucket{tokens: float64(rule.Burst), last: now, rule: rule}
+        s.buckets[key] = bucket
+    }
+
+    elapsed := now.Sub(bucket.last).Seconds()
+    bucket.tokens = math.Min(float64(rule.Burst), bucket.tokens+elapsed*rule.Rate)
+    bucket.last = now
+
+    allowed := bucket.tokens >= 1
+    if allowed {
+        bucket.tokens--
+    }
+    return bucketResult(allowed, bucket.tokens, rule), nil
+}
+
+// evictIdle drops buckets that have refilled completely and so carry no state
+func (s *MemoryRateLimitStore) evictIdle(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for now := range ticker.C {
+        s.mutex.Lock()
+        for key, bucket := range s.buckets {
+            // A bucket still refilling remembers a client's recent burst
+            if bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rule.Rate >= float64(bucket.rule.Burst) {
+                delete(s.buckets, key)
+            }
+        }
+        s.mutex.Unlock()
+    }
+}
+
+// tokenBucketScript refills and takes from a bucket atomically inside Redis
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local allowed = 0
+if tokens >= 1 then
+    tokens = tokens - 1
+    allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+// RedisRateLimitStore shares buckets between gateway replicas through Redis
+type RedisRateLimitStore struct {
+    client *redis.Client
+}
+
+func NewRedisRateLimitStore(addr string) *RedisRateLimitStore {
+    return &RedisRateLimitStore{client: redis.NewClient(&redis.Options{Addr: addr})}
+}
+
+func (s *RedisRateLimitStore) Take(ctx context.Context, key string, rule RateLimitRule) (RateLimitResult, error) {
+    values, err := tokenBucketScript.Run(ctx, s.client, []string{key}, rule.Rate, rule.Burst, time.Now().UnixMilli()).Slice()
+    if err != nil {
+        return RateLimitResult{}, err
+    }
+    if len(values) != 2 {
+        return RateLimitResult{}, fmt.Errorf("unexpected token bucket reply: %v", values)
+    }
+
+    allowed, _ := values[0].(int64)
+    tokensValue, _ := values[1].(string)
+    tokens, err := strconv.ParseFloat(tokensValue, 64)
+    if err != nil {
+        return RateLimitResult{}, fmt.Errorf("invalid token count %q: %w", tokensValue, err)
+    }
+    return bucketResult(allowed == 1, tokens, rule), nil
+}
+
+func bucketResult(allowed bool, tokens float64, rule RateLimitRule) RateLimitResult {
+    result := RateLimitResult{
+        Allowed:   allowed,
+        Limit:     rule.Burst,
+        Remaining: int(math.Floor(tokens)),
+        Reset:     time.Duration((float64(rule.Burst) - tokens) / rule.Rate * float64(time.Second)),
+    }
+    if !allowed {
+        result.RetryAfter = time.Duration((1 - tokens) / rule.Rate * float64(time.Second))
+    }
+    return result
+}
+
+func ceilSeconds(d time.Duration) int {
+    return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,78 @@
+package gateway
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "cell-shared/auth"
+)
+
+func TestMemoryRateLimitStoreTake(t *testing.T) {
+    rule := RateLimitRule{Rate: 10, Burst: 5}
+    tests := []struct {
+        name          string
+        existing      bool
+        tokens        float64
+        elapsed       time.Duration
+        wantAllowed   bool
+        wantRemaining int
+    }{
+        {"new bucket starts full", false, 0, 0, true, 4},
+        {"empty bucket refuses", true, 0, 0, false, 0},
+        {"refills at the rate", true, 0, 250 * time.Millisecond, true, 1},
+        {"partial token tops up", true, 0.5, 50 * time.Millisecond, true, 0},
+        {"refill stops at burst", true, 0, time.Hour, true, 4},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            store := &MemoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+            if tt.existing {
+                store.buckets["client"] = &tokenBucket{tokens: tt.tokens, last: time.Now().Add(-tt.elapsed), rule: rule}
+            }
+
+            result, err := store.Take(context.Background(), "client", rule)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if result.Allowed != tt.wantAllowed || result.Remaining != tt.wantRemaining {
+                t.Errorf("Take() = allowed %v, remaining %d, want %v, %d", result.Allowed, result.Remaining, tt.wantAllowed, tt.wantRemaining)
+            }
+            if !result.Allowed && result.RetryAfter <= 0 {
+                t.Errorf("Take() refused with RetryAfter %v", result.RetryAfter)
+            }
+        })
+    }
+}
+
+func TestRateLimiterClientKey(t *testing.T) {
+    tests := []struct {
+        name   string
+        keyBy  string
+        apiKey string
+        user   string
+        want   string
+    }{
+        {"by ip", "ip", "issued-key", "u1", "ip:192.0.2.1"},
+        {"issued api key", "api-key", "issued-key", "", "api-key:issued-key"},
+        {"made-up api key", "api-key", "made-up-key", "", "ip:192.0.2.1"},
+        {"verified tenant", "tenant", "", "u1", "tenant:u1"},
+        {"anonymous tenant", "tenant", "", "", "ip:192.0.2.1"},
+    }
+    rl := &RateLimiter{apiKeyHeader: "X-API-Key", apiKeys: map[string]bool{"issued-key": true}}
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(http.MethodGet, "/products", nil)
+            r.RemoteAddr = "192.0.2.1:41000"
+            r.Header.Set("X-API-Key", tt.apiKey)
+            if tt.user != "" {
+                r = r.WithContext(auth.WithIdentity(r.Context(), &auth.Identity{UserID: tt.user}))
+            }
+            if got := rl.clientKey(RateLimitRule{KeyBy: tt.keyBy}, r); got != tt.want {
+                t.Errorf("clientKey() = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,118 @@
+package gateway
+
+import (
+    "fmt"
+    "net/http"
+    "net/url"
+    "sort"
+    "strings"
+)
+
+// viaProtocol is the protocol this gateway records itself with in Via
+const viaProtocol = "1.1"
+
+// viaHops counts the proxies the Via headers in h name and reports whether
+// self is one of them, which means the request has come round in a loop
+func viaHops(h http.Header, self string) (hops int, seen bool) {
+    for _, value := range h.Values("Via") {
+        for _, entry := range strings.Split(value, ",") {
+            fields := strings.Fields(entry)
+            if len(fields) == 0 {
+                continue
+            }
+            hops++
+            if len(fields) > 1 && fields[1] == self {
+                seen = true
+            }
+        }
+    }
+    return hops, seen
+}
+
+// checkRoutes follows each route this gateway proxies, given as a path
+// prefix and the upstream it goes to, through every gateway it would reach,
+// and fails when one comes back to a gateway it already passed. upstreams
+// holds each upstream by name. The other cell's gateway is taken to send this
+// cell's routes here and serve its own, as both gateways do, so a service URL
+// that points at it is a loop, and so is an upstream URL that points back
+// here.
+func checkRoutes(self, port string, routes map[string]string, upstreams map[string]Upstream) error {
+    prefixes := make([]string, 0, len(routes))
+    for prefix := range routes {
+        prefixes = append(prefixes, prefix)
+    }
+    sort.Strings(prefixes)
+
+    for _, prefix := range prefixes {
+        path := []string{self}
+        for node := self; ; {
+            var next string
+            if node == self {
+                next = gatewayAt(upstreams[routes[prefix]], self, port, upstreams)
+            } else if !strings.HasSuffix(routes[prefix], "-gateway") {
+                next = self
+            }
+            if next == "" {
+                break
+            }
+            for _, passed := range path {
+                if passed == next {
+                    return fmt.Errorf("%s loops: %s", prefix, strings.Join(append(path, next), " → "))
+                }
+            }
+            path = append(path, next)
+            node = next
+        }
+    }
+    return nil
+}
+
+// gatewayAt is the gateway target reaches: self when it is this gateway's
+// address or host name, the gateway upstream it shares an address and Host
+// with or that has the same host name, or "" for anything else. Upstreams
+// behind one shared proxy, such as the KEDA HTTP add-on's interceptor, share
+// an address and are told apart by their Host.
+func gatewayAt(target Upstream, self, port string, upstreams map[string]Upstream) string {
+    address, host, name := hostAddress(target)
+    if address == "localhost:"+port || name == self {
+        return self
+    }
+    for _, upstream := range upstreams {
+        if !strings.HasSuffix(upstream.Name, "-gateway") {
+            continue
+        }
+        gatewayAddress, gatewayHost, _ := hostAddress(upstream)
+        if (address == gatewayAddress && host == gatewayHost) || name == upstream.Name {
+            return upstream.Name
+        }
+    }
+    return ""
+}
+
+// hostAddress is the host and port u's URL connects to, with loopback hosts
+// as localhost, the Host requests to it carry, and the first label of that
+// host name, which is the service name in Docker and Kubernetes
+func hostAddress(u Upstream) (address, host, name string) {
+    parsed, err := url.Parse(u.URL)
+    if err != nil {
+        return "", "", ""
+    }
+    hostname, port := strings.ToLower(parsed.Hostname()), parsed.Port()
+    if port == "" {
+        port = "80"
+        if parsed.Scheme == "https" {
+            port = "443"
+        }
+    }
+    switch hostname {
+    case "localhost", "127.0.0.1", "::1":
+        hostname = "localhost"
+    }
+    address, host = hostname+":"+port, hostname+":"+port
+    if u.Host != "" {
+        host = strings.ToLower(u.Host)
+    }
+    name, _, _ = strings.Cut(host, ".")
+    name, _, _ = strings.Cut(name, ":")
+    return address, host, name
+}
@@ -0,0 +1,75 @@
+package gateway
+
+import (
+    "net/http"
+    "testing"
+)
+
+func TestViaHops(t *testing.T) {
+    tests := []struct {
+        name     string
+        via      []string
+        wantHops int
+        wantSeen bool
+    }{
+        {"no Via", nil, 0, false},
+        {"another proxy", []string{"1.1 cell-b-gateway"}, 1, false},
+        {"this gateway", []string{"1.1 cell-b-gateway, 1.1 cell-a-gateway"}, 2, true},
+        {"several headers", []string{"1.1 proxy", "1.0 cell-b-gateway (nginx)"}, 2, false},
+        {"protocol only", []string{"1.1"}, 1, false},
+        {"empty entries", []string{" , 1.1 proxy,"}, 1, false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            h := http.Header{}
+            for _, value := range tt.via {
+                h.Add("Via", value)
+            }
+            hops, seen := viaHops(h, "cell-a-gateway")
+            if hops != tt.wantHops || seen != tt.wantSeen {
+                t.Errorf("viaHops() = %d, %v, want %d, %v", hops, seen, tt.wantHops, tt.wantSeen)
+            }
+        })
+    }
+}
+
+func TestCheckRoutes(t *testing.T) {
+    routes := map[string]string{
+        "/users":  "user-service",
+        "/orders": "cell-b-gateway",
+    }
+    tests := []struct {
+        name    string
+        user    Upstream
+        peer    Upstream
+        wantErr bool
+    }{
+        {"distinct upstreams",
+            Upstream{"user-service", "http://user-service:8011", ""},
+            Upstream{"cell-b-gateway", "http://cell-b-gateway:8080", ""}, false},
+        {"service at this gateway",
+            Upstream{"user-service", "http://127.0.0.1:8080", ""},
+            Upstream{"cell-b-gateway", "http://cell-b-gateway:8080", ""}, true},
+        {"service at the other gateway",
+            Upstream{"user-service", "http://cell-b-gateway:8080", ""},
+            Upstream{"cell-b-gateway", "http://cell-b-gateway:8080", ""}, true},
+        {"other gateway pointing back here",
+            Upstream{"user-service", "http://user-service:8011", ""},
+            Upstream{"cell-b-gateway", "http://cell-a-gateway.cell-a.svc:8080", ""}, true},
+        {"shared proxy told apart by Host",
+            Upstream{"user-service", "http://proxy:8080", "user-service.local"},
+            Upstream{"cell-b-gateway", "http://proxy:8080", "cell-b-gateway.local"}, false},
+        {"shared proxy with the other gateway's Host",
+            Upstream{"user-service", "http://proxy:8080", "cell-b-gateway.local"},
+            Upstream{"cell-b-gateway", "http://proxy:8080", "cell-b-gateway.local"}, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            upstreams := map[string]Upstream{tt.user.Name: tt.user, tt.peer.Name: tt.peer}
+            err := checkRoutes("cell-a-gateway", "8080", routes, upstreams)
+            if (err != nil) != tt.wantErr {
+                t.Errorf("checkRoutes() error = %v, want error %v", err, tt.wantErr)
+            }
+        })
+    }
+}
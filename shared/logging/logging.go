@@ -0,0 +1,149 @@
+// Package logging writes structured JSON logs and carries the request ID
+// that ties one request's log lines together across gateways, services and
+// cells
+package logging
+
+import (
+    "context"
+    "log/slog"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+
+    "github.com/google/uuid"
+    "github.com/gorilla/mux"
+)
+
+// RequestIDHeader carries the correlation ID between hops. The first gateway
+// a request reaches generates it; everything downstream reuses it.
+const RequestIDHeader = "X-Request-ID"
+
+type contextKey struct{}
+
+// Setup builds a JSON logger tagged with the service and cell and makes it
+// the default, so existing log.Printf calls come out as JSON too. LOG_LEVEL
+// sets the minimum level: debug, info (default), warn or error.
+func Setup(service, cellID string) *slog.Logger {
+    var level slog.Level
+    if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+        level = slog.LevelInfo
+    }
+
+    logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})).With(
+        slog.String("service", service),
+        slog.String("cell_id", cellID),
+    )
+    slog.SetDefault(logger)
+    return logger
+}
+
+// RequestID reuses the caller's X-Request-ID or generates one, puts it on
+// the request so proxies forward it, echoes it on the response and stores
+// it in the request context
+func RequestID(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get(RequestIDHeader)
+        if id == "" {
+            id = uuid.New().String()
+            r.Header.Set(RequestIDHeader, id)
+        }
+        w.Header().Set(RequestIDHeader, id)
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, id)))
+    })
+}
+
+// RequestIDFromContext returns the request ID stored by RequestID, if any
+func RequestIDFromContext(ctx context.Context) string {
+    id, _ := ctx.Value(contextKey{}).(string)
+    return id
+}
+
+// FromContext returns the default logger tagged with the request ID
+func FromContext(ctx context.Context) *slog.Logger {
+    if id := RequestIDFromContext(ctx); id != "" {
+        return slog.Default().With(slog.String("request_id", id))
+    }
+    return slog.Default()
+}
+
+// AccessLog logs one line per request with its route, status and latency.
+// Probe and scrape endpoints are logged at debug level so they do not drown
+// out real traffic.
+func AccessLog(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+        start := time.Now()
+        next.ServeHTTP(recorder, r)
+
+        route := r.URL.Path
+        if current := mux.CurrentRoute(r); current != nil {
+            if template, err := current.GetPathTemplate(); err == nil {
+                route = template
+            }
+        }
+
+        level := slog.LevelInfo
+        switch {
+        case recorder.status >= http.StatusInternalServerError:
+            level = slog.LevelError
+        case isProbe(r.URL.Path):
+            level = slog.LevelDebug
+        }
+
+        FromContext(r.Context()).LogAttrs(r.Context(), level, "request",
+            slog.String("method", r.Method),
+            slog.String("route", route),
+            slog.String("path", r.URL.Path),
+            slog.Int("status", recorder.status),
+            slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+            slog.Int64("bytes", recorder.bytes),
+            slog.String("source_cell", r.Header.Get("X-Source-Cell")),
+            slog.String("remote_addr", r.RemoteAddr),
+        )
+    })
+}
+
+func isProbe(path string) bool {
+    return strings.HasSuffix(path, "/health") || strings.HasSuffix(path, "/readiness") || path == "/metrics"
+}
+
+// Transport sets X-Request-ID on outbound calls from the request context, so
+// service-to-service calls stay on the same request ID
+type Transport struct {
+    Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+    if id := RequestIDFromContext(req.Context()); id != "" && req.Header.Get(RequestIDHeader) == "" {
+        req = req.Clone(req.Context())
+        req.Header.Set(RequestIDHeader, id)
+    }
+    return t.Base.RoundTrip(req)
+}
+
+// statusRecorder captures the status code and size of a response
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+    bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+    s.status = status
+    s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+    n, err := s.ResponseWriter.Write(b)
+    s.bytes += int64(n)
+    return n, err
+}
+
+func (s *statusRecorder) Flush() {
+    http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+    return s.ResponseWriter
+}
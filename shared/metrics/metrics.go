@@ -0,0 +1,120 @@
+// Package metrics exposes Prometheus RED metrics per route, Go runtime
+// metrics and service-specific gauges
+package metrics
+
+import (
+    "net/http"
+    "strconv"
+    "time"
+
+    "cell-shared/middleware"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/collectors"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the RED metrics for every route plus Go runtime metrics on a
+// private registry served at /metrics. Domain gauges are added with Register.
+type Metrics struct {
+    Labels   prometheus.Labels
+    registry *prometheus.Registry
+    requests *prometheus.CounterVec
+    errors   *prometheus.CounterVec
+    duration *prometheus.HistogramVec
+}
+
+func New(service, cellID string) *Metrics {
+    m := &Metrics{
+        Labels:   prometheus.Labels{"service": service, "cell_id": cellID},
+        registry: prometheus.NewRegistry(),
+    }
+
+    m.requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name:        "http_requests_total",
+        Help:        "HTTP requests handled, by route, method and status code.",
+        ConstLabels: m.Labels,
+    }, []string{"route", "method", "code"})
+    m.errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name:        "http_request_errors_total",
+        Help:        "HTTP requests that ended in a 5xx response, by route and method.",
+        ConstLabels: m.Labels,
+    }, []string{"route", "method"})
+    m.duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+        Name:        "http_request_duration_seconds",
+        Help:        "HTTP request latency, by route and method.",
+        ConstLabels: m.Labels,
+        Buckets:     prometheus.DefBuckets,
+    }, []string{"route", "method"})
+
+    m.registry.MustRegister(
+        m.requests,
+        m.errors,
+        m.duration,
+        collectors.NewGoCollector(),
+        collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+    )
+    return m
+}
+
+// Register adds service-specific collectors to the registry
+func (m *Metrics) Register(cs ...prometheus.Collector) {
+    m.registry.MustRegister(cs...)
+}
+
+// Handler serves the registry in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+    return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Middleware records RED metrics labelled by the matched route template, so
+// /users/{id} is one series rather than one per user
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        route := middleware.RouteTemplate(r)
+        recorder := middleware.NewStatusRecorder(w)
+        start := time.Now()
+        defer func() {
+            m.duration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+            m.requests.WithLabelValues(route, r.Method, strconv.Itoa(recorder.Status)).Inc()
+            if recorder.Status >= http.StatusInternalServerError {
+                m.errors.WithLabelValues(route, r.Method).Inc()
+            }
+        }()
+        next.ServeHTTP(recorder, r)
+    })
+}
+
+// StoreCollector reports gauges computed from in-memory state at scrape
+// time, so they never drift from what the service actually holds
+type StoreCollector struct {
+    desc      *prometheus.Desc
+    valueType prometheus.ValueType
+    collect   func(report func(value float64, labelValues ...string))
+}
+
+// NewStoreCollector reports gauges carrying the service and cell_id labels
+// every other metric of m does
+func (m *Metrics) NewStoreCollector(name, help string, labels []string, collect func(report func(value float64, labelValues ...string))) *StoreCollector {
+    return &StoreCollector{
+        desc:      prometheus.NewDesc(name, help, labels, m.Labels),
+        valueType: prometheus.GaugeValue,
+        collect:   collect,
+    }
+}
+
+// NewStoreCounter is NewStoreCollector for totals that only ever grow
+func (m *Metrics) NewStoreCounter(name, help string, labels []string, collect func(report func(value float64, labelValues ...string))) *StoreCollector {
+    c := m.NewStoreCollector(name, help, labels, collect)
+    c.valueType = prometheus.CounterValue
+    return c
+}
+
+func (c *StoreCollector) Describe(ch chan<- *prometheus.Desc) {
+    ch <- c.desc
+}
+
+func (c *StoreCollector) Collect(ch chan<- prometheus.Metric) {
+    c.collect(func(value float64, labelValues ...string) {
+        ch <- prometheus.MustNewConstMetric(c.desc, c.valueType, value, labelValues...)
+    })
+}
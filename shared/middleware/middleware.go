@@ -0,0 +1,113 @@
+// Package middleware holds the HTTP middleware every service router runs
+package middleware
+
+import (
+    "net/http"
+    "runtime/debug"
+    "strings"
+
+    "cell-shared"
+    "cell-shared/config"
+    "cell-shared/logging"
+    "github.com/gorilla/mux"
+)
+
+// RouteTemplate returns the path template of the mux route that matched r,
+// so per-route telemetry has one series per route rather than per ID
+func RouteTemplate(r *http.Request) string {
+    if current := mux.CurrentRoute(r); current != nil {
+        if template, err := current.GetPathTemplate(); err == nil {
+            return template
+        }
+    }
+    return "unmatched"
+}
+
+// StatusRecorder captures the status code written by a handler
+type StatusRecorder struct {
+    http.ResponseWriter
+    Status int
+}
+
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+    return &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (s *StatusRecorder) WriteHeader(status int) {
+    s.Status = status
+    s.ResponseWriter.WriteHeader(status)
+}
+
+// Flush sends buffered data on to the client, so streamed responses are not
+// held back by the recorder hiding the writer's http.Flusher
+func (s *StatusRecorder) Flush() {
+    http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the writer being recorded
+func (s *StatusRecorder) Unwrap() http.ResponseWriter {
+    return s.ResponseWriter
+}
+
+// Recovery turns a handler panic into a logged 500 instead of a dropped
+// connection. http.ErrAbortHandler is re-raised because handlers use it on
+// purpose to abort a response that has already started.
+func Recovery(cellID string) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            defer func() {
+                recovered := recover()
+                if recovered == nil {
+                    return
+                }
+                if recovered == http.ErrAbortHandler {
+                    panic(recovered)
+                }
+                logging.FromContext(r.Context()).Error("Recovered from panic",
+                    "panic", recovered,
+                    "stack", string(debug.Stack()),
+                )
+                shared.WriteError(w, cellID, shared.ErrorInternal, "Internal server error")
+            }()
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+// CORS allows browser clients from CORS_ALLOWED_ORIGINS (comma separated, or
+// "*") and answers preflight requests. It wraps the whole router so preflights
+// are answered even though routes only match their own methods. With no
+// origins configured it passes requests through untouched.
+func CORS(next http.Handler) http.Handler {
+    origins := map[string]bool{}
+    for _, origin := range strings.Split(config.Get("CORS_ALLOWED_ORIGINS", ""), ",") {
+        if origin = strings.TrimSpace(origin); origin != "" {
+            origins[origin] = true
+        }
+    }
+    if len(origins) == 0 {
+        return next
+    }
+    allowedHeaders := config.Get("CORS_ALLOWED_HEADERS", "Content-Type, Authorization, X-Request-ID, X-API-Key")
+
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        origin := r.Header.Get("Origin")
+        if origin == "" || !(origins["*"] || origins[origin]) {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        w.Header().Set("Access-Control-Allow-Origin", origin)
+        w.Header().Add("Vary", "Origin")
+        w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset")
+
+        if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+            w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+            w.Header().Set("Access-Control-Allow-Headers", allowedHeaders)
+            w.Header().Set("Access-Control-Max-Age", "600")
+            w.WriteHeader(http.StatusNoContent)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
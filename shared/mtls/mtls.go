@@ -0,0 +1,297 @@
+// Package mtls secures the traffic between gateways and services with
+// mutual TLS. Every workload holds a certificate whose URI SAN is its
+// SPIFFE ID, spiffe://<trust domain>/<cell>/<service>. A peer is trusted
+// when the shared CA signed its certificate and its ID is on the
+// allow-list. Certificates are read from files and reloaded when the files
+// change, so they can be rotated without a restart.
+package mtls
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "cell-shared/config"
+)
+
+// DefaultTrustDomain is the trust domain of the IDs dev-certs issues
+const DefaultTrustDomain = "cells"
+
+// ID is the SPIFFE ID of service in cell
+func ID(trustDomain, cell, service string) string {
+    return "spiffe://" + trustDomain + "/" + cell + "/" + service
+}
+
+// Config is this workload's certificate, the CA it trusts peers by and the
+// peers it accepts
+type Config struct {
+    certFile, keyFile, caFile string
+    trustDomain               string
+    allowed                   []string
+    reloadInterval            time.Duration
+
+    mutex    sync.Mutex
+    cert     *tls.Certificate
+    roots    *x509.CertPool
+    modTimes [3]time.Time
+    checked  time.Time
+
+    transport http.RoundTripper
+}
+
+var (
+    loadOnce sync.Once
+    loaded   *Config
+)
+
+// FromEnv returns the configuration in the TLS_* variables, or nil when
+// TLS_ENABLED is false. It is read once per process and exits when the
+// certificate files cannot be loaded.
+func FromEnv() *Config {
+    loadOnce.Do(func() {
+        if !config.Bool("TLS_ENABLED", false) {
+            return
+        }
+        c := &Config{
+            certFile:       config.Get("TLS_CERT_FILE", "/etc/cells/tls/tls.crt"),
+            keyFile:        config.Get("TLS_KEY_FILE", "/etc/cells/tls/tls.key"),
+            caFile:         config.Get("TLS_CA_FILE", "/etc/cells/tls/ca.crt"),
+            trustDomain:    config.Get("TLS_TRUST_DOMAIN", DefaultTrustDomain),
+            reloadInterval: config.Duration("TLS_RELOAD_INTERVAL", 10*time.Second),
+        }
+        for _, peer := range strings.Split(config.Get("TLS_ALLOWED_PEERS", ""), ",") {
+            if peer = strings.TrimSpace(peer); peer != "" {
+                c.allowed = append(c.allowed, peer)
+            }
+        }
+        if err := c.load(); err != nil {
+            log.Fatalf("Loading TLS certificates: %v", err)
+        }
+        log.Printf("Mutual TLS enabled as %s", strings.Join(c.ownIDs(), ", "))
+        loaded = c
+    })
+    return loaded
+}
+
+// load reads the certificate, key and CA files when any of them changed
+// since the last load
+func (c *Config) load() error {
+    var modTimes [3]time.Time
+    for i, path := range []string{c.certFile, c.keyFile, c.caFile} {
+        info, err := os.Stat(path)
+        if err != nil {
+            return err
+        }
+        modTimes[i] = info.ModTime()
+    }
+    if c.cert != nil && modTimes == c.modTimes {
+        return nil
+    }
+
+    cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+    if err != nil {
+        return err
+    }
+    if cert.Leaf == nil {
+        if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+            return err
+        }
+    }
+    if len(spiffeIDs(cert.Leaf, c.trustDomain)) == 0 {
+        return fmt.Errorf("%s has no SPIFFE ID in trust domain %q", c.certFile, c.trustDomain)
+    }
+    caPEM, err := os.ReadFile(c.caFile)
+    if err != nil {
+        return err
+    }
+    roots := x509.NewCertPool()
+    if !roots.AppendCertsFromPEM(caPEM) {
+        return fmt.Errorf("%s: no CA certificates", c.caFile)
+    }
+
+    if c.cert != nil {
+        log.Printf("Reloaded TLS certificates, now valid until %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+    }
+    c.cert, c.roots, c.modTimes = &cert, roots, modTimes
+    return nil
+}
+
+// current returns the certificate and CA pool, reloading them first when
+// TLS_RELOAD_INTERVAL has passed. A failed reload is logged and the
+// previous files stay in use, so a half-written rotation does no harm.
+func (c *Config) current() (*tls.Certificate, *x509.CertPool) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if time.Since(c.checked) >= c.reloadInterval {
+        c.checked = time.Now()
+        if err := c.load(); err != nil {
+            log.Printf("Keeping the previous TLS certificates: %v", err)
+        }
+    }
+    return c.cert, c.roots
+}
+
+func (c *Config) ownIDs() []string {
+    cert, _ := c.current()
+    return spiffeIDs(cert.Leaf, c.trustDomain)
+}
+
+// ServerTLS is the TLS configuration servers listen with. Clients must
+// present a certificate unless optionalClientCerts is set, as on gateways
+// that users reach directly; any certificate presented must verify and
+// carry an allowed ID.
+func (c *Config) ServerTLS(optionalClientCerts bool) *tls.Config {
+    clientAuth := tls.RequireAndVerifyClientCert
+    if optionalClientCerts {
+        clientAuth = tls.VerifyClientCertIfGiven
+    }
+    getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+        cert, _ := c.current()
+        return cert, nil
+    }
+    return &tls.Config{
+        MinVersion:     tls.VersionTLS12,
+        GetCertificate: getCertificate,
+        // A fresh configuration per connection picks up a rotated CA
+        GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+            _, roots := c.current()
+            return &tls.Config{
+                MinVersion:     tls.VersionTLS12,
+                GetCertificate: getCertificate,
+                ClientAuth:     clientAuth,
+                ClientCAs:      roots,
+                NextProtos:     []string{"h2", "http/1.1"},
+                VerifyConnection: func(state tls.ConnectionState) error {
+                    if len(state.PeerCertificates) == 0 {
+                        return nil
+                    }
+                    return c.checkAllowed(state.PeerCertificates[0])
+                },
+            }, nil
+        },
+    }
+}
+
+// ClientTLS is the TLS configuration clients dial with. Servers are
+// identified by the SPIFFE ID in their certificate rather than a host name,
+// so any workload the CA signed in the trust domain is accepted.
+func (c *Config) ClientTLS() *tls.Config {
+    return &tls.Config{
+        MinVersion: tls.VersionTLS12,
+        GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+            cert, _ := c.current()
+            return cert, nil
+        },
+        // Verified in VerifyConnection instead, against the current CA
+        InsecureSkipVerify: true,
+        VerifyConnection: func(state tls.ConnectionState) error {
+            if len(state.PeerCertificates) == 0 {
+                return errors.New("server presented no certificate")
+            }
+            if err := c.verify(state.PeerCertificates, x509.ExtKeyUsageServerAuth); err != nil {
+                return err
+            }
+            if len(spiffeIDs(state.PeerCertificates[0], c.trustDomain)) == 0 {
+                return fmt.Errorf("server certificate has no SPIFFE ID in trust domain %q", c.trustDomain)
+            }
+            return nil
+        },
+    }
+}
+
+// verify checks chain against the current CA
+func (c *Config) verify(chain []*x509.Certificate, usage x509.ExtKeyUsage) error {
+    _, roots := c.current()
+    intermediates := x509.NewCertPool()
+    for _, cert := range chain[1:] {
+        intermediates.AddCert(cert)
+    }
+    _, err := chain[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{usage}})
+    return err
+}
+
+// checkAllowed fails unless cert carries an ID on TLS_ALLOWED_PEERS. An
+// entry ending in "*" allows every ID it is a prefix of; without entries
+// every ID in the trust domain is allowed.
+func (c *Config) checkAllowed(cert *x509.Certificate) error {
+    ids := spiffeIDs(cert, c.trustDomain)
+    if len(ids) == 0 {
+        return fmt.Errorf("client certificate has no SPIFFE ID in trust domain %q", c.trustDomain)
+    }
+    if len(c.allowed) == 0 {
+        return nil
+    }
+    for _, id := range ids {
+        for _, allowed := range c.allowed {
+            if id == allowed || (strings.HasSuffix(allowed, "*") && strings.HasPrefix(id, strings.TrimSuffix(allowed, "*"))) {
+                return nil
+            }
+        }
+    }
+    log.Printf("Rejected TLS client %s: not in TLS_ALLOWED_PEERS", strings.Join(ids, ", "))
+    return fmt.Errorf("client %s is not allowed", strings.Join(ids, ", "))
+}
+
+// spiffeIDs are the SPIFFE IDs in cert's URI SANs within trustDomain
+func spiffeIDs(cert *x509.Certificate, trustDomain string) []string {
+    var ids []string
+    for _, uri := range cert.URIs {
+        if uri.Scheme == "spiffe" && uri.Host == trustDomain {
+            ids = append(ids, uri.String())
+        }
+    }
+    return ids
+}
+
+// PeerID is the SPIFFE ID of the client certificate r was made with, or ""
+// when the client presented none
+func PeerID(r *http.Request) string {
+    if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+        return ""
+    }
+    for _, uri := range r.TLS.PeerCertificates[0].URIs {
+        if uri.Scheme == "spiffe" {
+            return uri.String()
+        }
+    }
+    return ""
+}
+
+// NewTransport returns http.DefaultTransport, or when TLS is enabled one
+// shared transport that presents this workload's certificate and dials
+// http:// URLs over TLS, so upstream URLs need not change when it is turned
+// on
+func NewTransport() http.RoundTripper {
+    c := FromEnv()
+    if c == nil {
+        return http.DefaultTransport
+    }
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if c.transport == nil {
+        base := http.DefaultTransport.(*http.Transport).Clone()
+        base.TLSClientConfig = c.ClientTLS()
+        c.transport = &upgradeTransport{base: base}
+    }
+    return c.transport
+}
+
+// upgradeTransport sends requests for http:// URLs as https://
+type upgradeTransport struct {
+    base http.RoundTripper
+}
+
+func (t *upgradeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    if req.URL.Scheme == "http" {
+        req = req.Clone(req.Context())
+        req.URL.Scheme = "https"
+    }
+    return t.base.RoundTrip(req)
+}
@@ -0,0 +1,167 @@
+// Package openapi describes the service APIs as OpenAPI 3.0 documents and
+// validates request bodies against the same schemas, so the published spec
+// and what a service accepts cannot drift apart
+package openapi
+
+import (
+    "net/http"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+
+    "cell-shared"
+)
+
+const Version = "3.0.3"
+
+// Operation is one route as the service registers it: a mux path template,
+// which uses the same {param} syntax as OpenAPI, plus its schemas
+type Operation struct {
+    ID       string
+    Method   string
+    Path     string
+    Summary  string
+    Request  *Schema        // request body, which the handler decodes with DecodeBody
+    Response *Schema        // body of the Status response
+    Status   int
+    Query    []Parameter    // optional query parameters
+    Errors   map[int]string // failures beyond the generated 400 and 404
+}
+
+type Document struct {
+    OpenAPI     string                               `json:"openapi"`
+    Info        Info                                 `json:"info"`
+    Paths       map[string]map[string]*PathOperation `json:"paths"`
+    Components  Components                           `json:"components"`
+    Unavailable []string                             `json:"x-unavailable,omitempty"`
+}
+
+type Info struct {
+    Title       string `json:"title"`
+    Version     string `json:"version"`
+    Description string `json:"description,omitempty"`
+}
+
+type Components struct {
+    Schemas map[string]*Schema `json:"schemas"`
+}
+
+type PathOperation struct {
+    OperationID string               `json:"operationId"`
+    Summary     string               `json:"summary,omitempty"`
+    Tags        []string             `json:"tags,omitempty"`
+    Parameters  []Parameter          `json:"parameters,omitempty"`
+    RequestBody *RequestBody         `json:"requestBody,omitempty"`
+    Responses   map[string]*Response `json:"responses"`
+}
+
+type Parameter struct {
+    Name        string  `json:"name"`
+    In          string  `json:"in"`
+    Description string  `json:"description,omitempty"`
+    Required    bool    `json:"required"`
+    Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+    Required bool                 `json:"required"`
+    Content  map[string]MediaType `json:"content"`
+}
+
+type MediaType struct {
+    Schema *Schema `json:"schema"`
+}
+
+type Response struct {
+    Description string               `json:"description"`
+    Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+// New starts a document for one service, with the shared types as its
+// component schemas
+func New(title, version string) *Document {
+    return &Document{
+        OpenAPI:    Version,
+        Info:       Info{Title: title, Version: version, Description: "Wire types follow schema version " + shared.SchemaVersion + "."},
+        Paths:      make(map[string]map[string]*PathOperation),
+        Components: Components{Schemas: ComponentSchemas()},
+    }
+}
+
+var pathParam = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// Add documents op under the document's title as its tag
+func (d *Document) Add(op Operation) {
+    path := pathParam.ReplaceAllString(op.Path, "{$1}")
+    operation := &PathOperation{
+        OperationID: op.ID,
+        Summary:     op.Summary,
+        Tags:        []string{d.Info.Title},
+        Responses:   make(map[string]*Response),
+    }
+
+    for _, match := range pathParam.FindAllStringSubmatch(op.Path, -1) {
+        operation.Parameters = append(operation.Parameters, Parameter{
+            Name:     match[1],
+            In:       "path",
+            Required: true,
+            Schema:   &Schema{Type: "string"},
+        })
+    }
+
+    if op.Request != nil {
+        operation.RequestBody = &RequestBody{Required: true, Content: jsonContent(op.Request)}
+        operation.Responses["400"] = &Response{Description: "The request body does not match the schema; error.details lists every problem", Content: jsonContent(Ref("ServiceResponse"))}
+    }
+    if len(operation.Parameters) > 0 {
+        operation.Responses["404"] = &Response{Description: "Not found", Content: jsonContent(Ref("ServiceResponse"))}
+    }
+    for _, param := range op.Query {
+        param.In = "query"
+        operation.Parameters = append(operation.Parameters, param)
+    }
+    for status, description := range op.Errors {
+        operation.Responses[strconv.Itoa(status)] = &Response{Description: description, Content: jsonContent(Ref("ServiceResponse"))}
+    }
+    status := op.Status
+    if status == 0 {
+        status = http.StatusOK
+    }
+    operation.Responses[strconv.Itoa(status)] = &Response{Description: http.StatusText(status), Content: jsonContent(op.Response)}
+
+    if d.Paths[path] == nil {
+        d.Paths[path] = make(map[string]*PathOperation)
+    }
+    d.Paths[path][strings.ToLower(op.Method)] = operation
+}
+
+// Merge adds the paths and schemas of other; it is how gateways aggregate
+// the documents of the services behind them
+func (d *Document) Merge(other *Document) {
+    for path, operations := range other.Paths {
+        if d.Paths[path] == nil {
+            d.Paths[path] = make(map[string]*PathOperation)
+        }
+        for method, operation := range operations {
+            d.Paths[path][method] = operation
+        }
+    }
+    for name, schema := range other.Components.Schemas {
+        d.Components.Schemas[name] = schema
+    }
+    d.Unavailable = append(d.Unavailable, other.Unavailable...)
+    sort.Strings(d.Unavailable)
+}
+
+// ServeHTTP serves the document as JSON
+func (d *Document) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    shared.WriteJSON(w, http.StatusOK, d)
+}
+
+func jsonContent(schema *Schema) map[string]MediaType {
+    if schema == nil {
+        return nil
+    }
+    return map[string]MediaType{"application/json": {Schema: schema}}
+}
@@ -0,0 +1,270 @@
+package openapi
+
+import (
+    "fmt"
+    "math"
+    "net/mail"
+    "reflect"
+    "regexp"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "cell-shared"
+)
+
+// Schema is the subset of the OpenAPI 3.0 schema object the services use.
+// The same value documents a request body and validates it.
+type Schema struct {
+    Ref              string             `json:"$ref,omitempty"`
+    Type             string             `json:"type,omitempty"`
+    Format           string             `json:"format,omitempty"`
+    Description      string             `json:"description,omitempty"`
+    Properties       map[string]*Schema `json:"properties,omitempty"`
+    Required         []string           `json:"required,omitempty"`
+    Items            *Schema            `json:"items,omitempty"`
+    AllOf            []*Schema          `json:"allOf,omitempty"`
+    Enum             []string           `json:"enum,omitempty"`
+    Minimum          *float64           `json:"minimum,omitempty"`
+    ExclusiveMinimum bool               `json:"exclusiveMinimum,omitempty"`
+    Maximum          *float64           `json:"maximum,omitempty"`
+    MinLength        *int               `json:"minLength,omitempty"`
+    MaxLength        *int               `json:"maxLength,omitempty"`
+    Pattern          string             `json:"pattern,omitempty"`
+    PatternMessage   string             `json:"-"` // what a mismatch is reported as
+
+    ReadOnly         bool               `json:"readOnly,omitempty"`
+    Nullable         bool               `json:"nullable,omitempty"`
+}
+
+// Ref points at a schema under components/schemas
+func Ref(name string) *Schema {
+    return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+func atLeast(v float64) *float64 {
+    return &v
+}
+
+func atMost(v float64) *float64 {
+    return &v
+}
+
+func chars(n int) *int {
+    return &n
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// SchemaOf describes how encoding/json encodes values of type t. Fields
+// without omitempty are required and embedded structs are flattened.
+func SchemaOf(t reflect.Type) *Schema {
+    if t == timeType {
+        return &Schema{Type: "string", Format: "date-time"}
+    }
+
+    switch t.Kind() {
+    case reflect.Ptr:
+        return SchemaOf(t.Elem())
+    case reflect.String:
+        return &Schema{Type: "string"}
+    case reflect.Bool:
+        return &Schema{Type: "boolean"}
+    case reflect.Int, reflect.Int32, reflect.Int64:
+        return &Schema{Type: "integer"}
+    case reflect.Float32, reflect.Float64:
+        return &Schema{Type: "number"}
+    case reflect.Slice, reflect.Array:
+        return &Schema{Type: "array", Items: SchemaOf(t.Elem())}
+    case reflect.Struct:
+        schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+        addFields(schema, t)
+        sort.Strings(schema.Required)
+        return schema
+    }
+    // interface{} accepts any value
+    return &Schema{}
+}
+
+func addFields(schema *Schema, t reflect.Type) {
+    for i := 0; i < t.NumField(); i++ {
+        f := t.Field(i)
+        if f.Anonymous && f.Type.Kind() == reflect.Struct {
+            addFields(schema, f.Type)
+            continue
+        }
+        if !f.IsExported() {
+            continue
+        }
+        tag := strings.Split(f.Tag.Get("json"), ",")
+        if tag[0] == "-" {
+            continue
+        }
+        name := tag[0]
+        if name == "" {
+            name = f.Name
+        }
+        schema.Properties[name] = SchemaOf(f.Type)
+
+        optional := false
+        for _, option := range tag[1:] {
+            if option == "omitempty" {
+                optional = true
+            }
+        }
+        if !optional {
+            schema.Required = append(schema.Required, name)
+        }
+    }
+}
+
+// Validate checks v, decoded from JSON, against the schema and returns one
+// FieldError per problem. $ref and allOf are not followed: request schemas
+// are written out in full.
+func (s *Schema) Validate(v interface{}) []shared.FieldError {
+    return s.validate("", v)
+}
+
+func (s *Schema) validate(field string, v interface{}) []shared.FieldError {
+    if v == nil {
+        if s.Nullable || s.Type == "" {
+            return nil
+        }
+        return fieldError(field, "must not be null")
+    }
+
+    switch s.Type {
+    case "object":
+        object, ok := v.(map[string]interface{})
+        if !ok {
+            return fieldError(field, "must be an object")
+        }
+        var errs []shared.FieldError
+        for _, name := range s.Required {
+            if _, present := object[name]; !present {
+                errs = append(errs, shared.FieldError{Field: join(field, name), Message: "is required"})
+            }
+        }
+        names := make([]string, 0, len(s.Properties))
+        for name := range s.Properties {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            if value, present := object[name]; present {
+                errs = append(errs, s.Properties[name].validate(join(field, name), value)...)
+            }
+        }
+        return errs
+
+    case "array":
+        items, ok := v.([]interface{})
+        if !ok {
+            return fieldError(field, "must be an array")
+        }
+        var errs []shared.FieldError
+        for i, item := range items {
+            if s.Items != nil {
+                errs = append(errs, s.Items.validate(fmt.Sprintf("%s[%d]", field, i), item)...)
+            }
+        }
+        return errs
+
+    case "string":
+        text, ok := v.(string)
+        if !ok {
+            return fieldError(field, "must be a string")
+        }
+        return s.validateString(field, text)
+
+    case "integer", "number":
+        n, ok := v.(float64)
+        if !ok {
+            return fieldError(field, "must be a "+s.Type)
+        }
+        if s.Type == "integer" && n != math.Trunc(n) {
+            return fieldError(field, "must be an integer")
+        }
+        if s.Minimum != nil {
+            if s.ExclusiveMinimum && n <= *s.Minimum {
+                return fieldError(field, fmt.Sprintf("must be greater than %g", *s.Minimum))
+            }
+            if n < *s.Minimum {
+                return fieldError(field, fmt.Sprintf("must be at least %g", *s.Minimum))
+            }
+        }
+        if s.Maximum != nil && n > *s.Maximum {
+            return fieldError(field, fmt.Sprintf("must be at most %g", *s.Maximum))
+        }
+
+    case "boolean":
+        if _, ok := v.(bool); !ok {
+            return fieldError(field, "must be a boolean")
+        }
+    }
+    return nil
+}
+
+func (s *Schema) validateString(field, text string) []shared.FieldError {
+    if s.MinLength != nil && len([]rune(text)) < *s.MinLength {
+        if *s.MinLength == 1 {
+            return fieldError(field, "must not be empty")
+        }
+        return fieldError(field, fmt.Sprintf("must be at least %d characters", *s.MinLength))
+    }
+    if s.MaxLength != nil && len([]rune(text)) > *s.MaxLength {
+        return fieldError(field, fmt.Sprintf("must be at most %d characters", *s.MaxLength))
+    }
+    if s.Pattern != "" && !compiled(s.Pattern).MatchString(text) {
+        if s.PatternMessage != "" {
+            return fieldError(field, s.PatternMessage)
+        }
+        return fieldError(field, "must match "+s.Pattern)
+    }
+    if len(s.Enum) > 0 {
+        for _, allowed := range s.Enum {
+            if text == allowed {
+                return nil
+            }
+        }
+        return fieldError(field, "must be one of "+strings.Join(s.Enum, ", "))
+    }
+    if s.Format == "email" {
+        // Bare addresses only: "Ada <ada@example.com>" parses but is not one
+        address, err := mail.ParseAddress(text)
+        if err != nil || address.Address != text {
+            return fieldError(field, "must be a valid email address")
+        }
+    }
+    return nil
+}
+
+var (
+    patterns      = make(map[string]*regexp.Regexp)
+    patternsMutex sync.Mutex
+)
+
+// compiled caches the regexp for a pattern; patterns are constants of the
+// request schemas, so the cache stays small
+func compiled(pattern string) *regexp.Regexp {
+    patternsMutex.Lock()
+    defer patternsMutex.Unlock()
+    re, ok := patterns[pattern]
+    if !ok {
+        re = regexp.MustCompile(pattern)
+        patterns[pattern] = re
+    }
+    return re
+}
+
+func fieldError(field, message string) []shared.FieldError {
+    return []shared.FieldError{{Field: field, Message: message}}
+}
+
+func join(parent, name string) string {
+    if parent == "" {
+        return name
+    }
+    return parent + "." + name
+}
@@ -0,0 +1,217 @@
+package openapi
+
+import (
+    "reflect"
+
+    "cell-shared"
+)
+
+// ComponentSchemas derives a schema for every shared wire type, so the
+// documents describe exactly what services encode
+func ComponentSchemas() map[string]*Schema {
+    schemas := map[string]*Schema{
+        "User":            SchemaOf(reflect.TypeOf(shared.User{})),
+        "Product":         SchemaOf(reflect.TypeOf(shared.Product{})),
+        "Order":           SchemaOf(reflect.TypeOf(shared.Order{})),
+        "Payment":         SchemaOf(reflect.TypeOf(shared.Payment{})),
+        "ServiceResponse": SchemaOf(reflect.TypeOf(shared.ServiceResponse{})),
+        "Error":           SchemaOf(reflect.TypeOf(shared.Error{})),
+        "FieldError":      SchemaOf(reflect.TypeOf(shared.FieldError{})),
+        "Health":          SchemaOf(reflect.TypeOf(shared.Health{})),
+        "Tokens":          SchemaOf(reflect.TypeOf(shared.Tokens{})),
+        "JWKS":            SchemaOf(reflect.TypeOf(shared.JWKS{})),
+        "JWK":             SchemaOf(reflect.TypeOf(shared.JWK{})),
+    }
+
+    // Fields the service assigns, which clients cannot set
+    for name, fields := range map[string][]string{
+        "User":    {"id", "cell_id", "created_at"},
+        "Product": {"id", "cell_id", "created_at"},
+        "Order":   {"id", "cell_id", "created_at", "status"},
+        "Payment": {"id", "cell_id", "created_at", "status"},
+    } {
+        for _, field := range fields {
+            schemas[name].Properties[field].ReadOnly = true
+        }
+    }
+
+    schemas["Order"].Properties["status"].Enum = shared.OrderStatuses
+    schemas["Payment"].Properties["status"].Enum = []string{shared.PaymentStatusProcessing, shared.PaymentStatusCompleted, shared.PaymentStatusRefunded}
+    schemas["Payment"].Properties["method"].Enum = shared.PaymentMethods
+    schemas["ServiceResponse"].Properties["error"] = Ref("Error")
+    schemas["Error"].Properties["details"].Items = Ref("FieldError")
+    schemas["JWKS"].Properties["keys"].Items = Ref("JWK")
+
+    byOrder := SchemaOf(reflect.TypeOf(shared.PaymentsByOrderResponse{}))
+    byOrder.Properties["data"] = &Schema{Type: "array", Items: Ref("Payment")}
+    byOrder.Properties["error"] = Ref("Error")
+    schemas["PaymentsByOrderResponse"] = byOrder
+    return schemas
+}
+
+// Data is a successful envelope carrying one component
+func Data(component string) *Schema {
+    return &Schema{AllOf: []*Schema{
+        Ref("ServiceResponse"),
+        {Type: "object", Properties: map[string]*Schema{"data": Ref(component)}},
+    }}
+}
+
+// List is a successful envelope carrying an array of a component and its size
+func List(component string) *Schema {
+    return &Schema{AllOf: []*Schema{
+        Ref("ServiceResponse"),
+        {Type: "object", Properties: map[string]*Schema{
+            "data":  {Type: "array", Items: Ref(component), Nullable: true},
+            "count": {Type: "integer"},
+        }},
+    }}
+}
+
+// Message is a successful envelope with no data
+func Message() *Schema {
+    return Ref("ServiceResponse")
+}
+
+// Rules shared by the request bodies below
+const (
+    // visibleText has at least one visible character and no control characters
+    visibleText        = `^[^\p{Cc}]*[^\p{Cc}\p{Z}][^\p{Cc}]*$`
+    visibleTextMessage = "must not be blank or contain control characters"
+
+    maxPrice    = 1e6
+    maxStock    = 1e6
+    maxQuantity = 1000
+    maxAmount   = 1e9
+)
+
+// name is a required or updated display name
+func name() *Schema {
+    return &Schema{Type: "string", MaxLength: chars(200), Pattern: visibleText, PatternMessage: visibleTextMessage}
+}
+
+// email is a user's email address
+func email() *Schema {
+    return &Schema{Type: "string", Format: "email", MaxLength: chars(254)}
+}
+
+// password is checked for length in characters here; handlers also reject
+// passwords longer than bcrypt hashes in full
+func password() *Schema {
+    return &Schema{Type: "string", MinLength: chars(8), MaxLength: chars(72)}
+}
+
+// id references another resource by ID
+func id() *Schema {
+    return &Schema{Type: "string", MinLength: chars(1), MaxLength: chars(64), Pattern: visibleText, PatternMessage: visibleTextMessage}
+}
+
+// Request bodies. Fields the service assigns are ignored when sent, and
+// unknown fields are allowed so older clients keep working. Optional fields
+// of updates follow the same rules as on create when they are sent.
+var (
+    UserCreate = &Schema{
+        Type:     "object",
+        Required: []string{"email", "name"},
+        Properties: map[string]*Schema{
+            "name":  name(),
+            "email": email(),
+        },
+    }
+
+    UserUpdate = &Schema{
+        Type: "object",
+        Properties: map[string]*Schema{
+            "name":  name(),
+            "email": email(),
+        },
+    }
+
+    Registration = &Schema{
+        Type:     "object",
+        Required: []string{"email", "name", "password"},
+        Properties: map[string]*Schema{
+            "name":     name(),
+            "email":    email(),
+            "password": password(),
+        },
+    }
+
+    // Login only checks the credentials are there; whether they are right
+    // is answered with 401, not a list of rules
+    Credentials = &Schema{
+        Type:     "object",
+        Required: []string{"email", "password"},
+        Properties: map[string]*Schema{
+            "email":    {Type: "string", MinLength: chars(1), MaxLength: chars(254)},
+            "password": {Type: "string", MinLength: chars(1), MaxLength: chars(1024)},
+        },
+    }
+
+    RefreshRequest = &Schema{
+        Type:     "object",
+        Required: []string{"refresh_token"},
+        Properties: map[string]*Schema{
+            "refresh_token": {Type: "string", MinLength: chars(1), MaxLength: chars(256)},
+        },
+    }
+
+    ProductCreate = &Schema{
+        Type:     "object",
+        Required: []string{"name", "price"},
+        Properties: map[string]*Schema{
+            "name":        name(),
+            "description": {Type: "string", MaxLength: chars(2000)},
+            "price":       {Type: "number", Minimum: atLeast(0), Maximum: atMost(maxPrice)},
+            "stock":       {Type: "integer", Minimum: atLeast(0), Maximum: atMost(maxStock)},
+        },
+    }
+
+    ProductUpdate = &Schema{
+        Type: "object",
+        Properties: map[string]*Schema{
+            "name":        name(),
+            "description": {Type: "string", MaxLength: chars(2000)},
+            "price":       {Type: "number", Minimum: atLeast(0), Maximum: atMost(maxPrice)},
+            "stock":       {Type: "integer", Minimum: atLeast(0), Maximum: atMost(maxStock)},
+        },
+    }
+
+    StockUpdate = &Schema{
+        Type:     "object",
+        Required: []string{"quantity"},
+        Properties: map[string]*Schema{
+            "quantity": {Type: "integer", Minimum: atLeast(1), Maximum: atMost(maxQuantity)},
+        },
+    }
+
+    OrderCreate = &Schema{
+        Type:     "object",
+        // user_id defaults to the caller; only admins may name another user
+        Required: []string{"product_id", "quantity"},
+        Properties: map[string]*Schema{
+            "user_id":    id(),
+            "product_id": id(),
+            "quantity":   {Type: "integer", Minimum: atLeast(1), Maximum: atMost(maxQuantity)},
+            "total":      {Type: "number", Minimum: atLeast(0), Maximum: atMost(maxAmount)},
+        },
+    }
+
+    OrderStatusUpdate = &Schema{
+        Type:     "object",
+        Required: []string{"status"},
+        Properties: map[string]*Schema{
+            "status": {Type: "string", Enum: shared.OrderStatuses},
+        },
+    }
+
+    PaymentCreate = &Schema{
+        Type:     "object",
+        Required: []string{"amount", "method", "order_id"},
+        Properties: map[string]*Schema{
+            "order_id": id(),
+            "amount":   {Type: "number", Minimum: atLeast(0), ExclusiveMinimum: true, Maximum: atMost(maxAmount)},
+            "method":   {Type: "string", Enum: shared.PaymentMethods},
+        },
+    }
+)
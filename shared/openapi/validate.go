@@ -0,0 +1,91 @@
+package openapi
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "io"
+    "net/http"
+    "reflect"
+
+    "cell-shared"
+)
+
+// maxValidatedBodyBytes bounds how much of a body is read for validation;
+// gateways already cap bodies well below this
+const maxValidatedBodyBytes = 1 << 20
+
+// DecodeBody reads the JSON request body, checks it against schema and
+// decodes it into v. When the body is unreadable or breaks any rule it
+// writes a 400 listing every problem and returns false, so handlers only
+// ever see bodies that satisfy their schema:
+//
+//     var user shared.User
+//     if !openapi.DecodeBody(w, r, s.CellID, openapi.UserCreate, &user) {
+//         return
+//     }
+func DecodeBody(w http.ResponseWriter, r *http.Request, cellID string, schema *Schema, v interface{}) bool {
+    raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValidatedBodyBytes))
+    if err != nil {
+        var maxBytesErr *http.MaxBytesError
+        if errors.As(err, &maxBytesErr) {
+            shared.WriteError(w, cellID, shared.ErrorPayloadTooLarge, "Request body too large")
+            return false
+        }
+        shared.WriteInvalid(w, cellID, []shared.FieldError{{Message: "could not be read"}})
+        return false
+    }
+    if len(bytes.TrimSpace(raw)) == 0 {
+        shared.WriteInvalid(w, cellID, []shared.FieldError{{Message: "is required"}})
+        return false
+    }
+
+    var body interface{}
+    if err := json.Unmarshal(raw, &body); err != nil {
+        shared.WriteInvalid(w, cellID, []shared.FieldError{{Message: "must be valid JSON"}})
+        return false
+    }
+    if details := schema.Validate(body); len(details) > 0 {
+        shared.WriteInvalid(w, cellID, details)
+        return false
+    }
+
+    // Decode what was validated, re-encoded, so a number the schema accepts
+    // as an integer, such as 10.0, also decodes into an int. The schema only
+    // covers fields clients may set; the rest of the wire type can still be
+    // sent, e.g. echoing a fetched object back.
+    normalized, err := json.Marshal(body)
+    if err != nil {
+        shared.WriteInvalid(w, cellID, []shared.FieldError{{Message: "must be valid JSON"}})
+        return false
+    }
+    if err := json.Unmarshal(normalized, v); err != nil {
+        detail := shared.FieldError{Message: "does not match the expected type"}
+        var typeErr *json.UnmarshalTypeError
+        if errors.As(err, &typeErr) {
+            detail = shared.FieldError{Field: typeErr.Field, Message: "must be " + jsonType(typeErr.Type)}
+        }
+        shared.WriteInvalid(w, cellID, []shared.FieldError{detail})
+        return false
+    }
+    return true
+}
+
+// jsonType names the JSON type a Go type decodes from, the way the schema
+// error messages do
+func jsonType(t reflect.Type) string {
+    switch t.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return "an integer"
+    case reflect.Float32, reflect.Float64:
+        return "a number"
+    case reflect.Bool:
+        return "a boolean"
+    case reflect.Slice, reflect.Array:
+        return "an array"
+    case reflect.Struct, reflect.Map:
+        return "an object"
+    }
+    return "a string"
+}
@@ -0,0 +1,58 @@
+package shared
+
+import (
+    "encoding/json"
+    "net/http"
+
+    "cell-shared/logging"
+)
+
+// WriteJSON writes v as the JSON body with the given status code, tagged
+// with the schema version of the types in this package
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set(SchemaVersionHeader, SchemaVersion)
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+// WriteData writes a successful ServiceResponse carrying data
+func WriteData(w http.ResponseWriter, status int, cellID string, data interface{}) {
+    WriteJSON(w, status, ServiceResponse{Success: true, Data: data, CellID: cellID})
+}
+
+// WriteList writes a successful ServiceResponse for a collection and its size
+func WriteList(w http.ResponseWriter, cellID string, data interface{}, count int) {
+    WriteJSON(w, http.StatusOK, ServiceResponse{Success: true, Data: data, Count: &count, CellID: cellID})
+}
+
+// WriteMessage writes a successful ServiceResponse with no data
+func WriteMessage(w http.ResponseWriter, status int, cellID, message string) {
+    WriteJSON(w, status, ServiceResponse{Success: true, Message: message, CellID: cellID})
+}
+
+// WriteInvalid writes a 400 listing why the request body was rejected
+func WriteInvalid(w http.ResponseWriter, cellID string, details []FieldError) {
+    e := NewError(ErrorInvalidRequest, "Invalid request body")
+    e.Details = details
+    WriteFailure(w, cellID, e)
+}
+
+// WriteError writes a failed ServiceResponse for code, with the status the
+// code maps to
+func WriteError(w http.ResponseWriter, cellID, code, message string) {
+    WriteFailure(w, cellID, NewError(code, message))
+}
+
+// WriteFailure writes e as a failed ServiceResponse, filling in the cell and
+// the request ID the logging middleware put on the response when e does not
+// carry them already
+func WriteFailure(w http.ResponseWriter, cellID string, e *Error) {
+    if e.CellID == "" {
+        e.CellID = cellID
+    }
+    if e.RequestID == "" {
+        e.RequestID = w.Header().Get(logging.RequestIDHeader)
+    }
+    WriteJSON(w, StatusFor(e.Code), ServiceResponse{Success: false, Error: e, CellID: cellID})
+}
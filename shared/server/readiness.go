@@ -0,0 +1,184 @@
+package server
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "cell-shared/config"
+    "cell-shared/mtls"
+)
+
+// ReadinessCheck is one condition the service needs before it can take
+// traffic; only critical checks can fail readiness
+type ReadinessCheck struct {
+    Name     string
+    Critical bool
+    Check    func(ctx context.Context) error
+}
+
+// CheckResult is the outcome of a single readiness check
+type CheckResult struct {
+    Status     string `json:"status"`
+    Critical   bool   `json:"critical"`
+    Error      string `json:"error,omitempty"`
+    DurationMs int64  `json:"duration_ms"`
+}
+
+// Readiness aggregates the checks registered by each component. It is
+// separate from /health, which stays a cheap liveness probe.
+type Readiness struct {
+    checks   []ReadinessCheck
+    mutex    sync.RWMutex
+    timeout  time.Duration
+    warm     atomic.Bool
+    draining atomic.Bool
+}
+
+func NewReadiness() *Readiness {
+    r := &Readiness{timeout: config.Duration("READINESS_CHECK_TIMEOUT", 2*time.Second)}
+    r.Register("warmup", true, func(ctx context.Context) error {
+        if !r.warm.Load() {
+            return fmt.Errorf("warm-up not complete")
+        }
+        return nil
+    })
+    r.Register("shutdown", true, func(ctx context.Context) error {
+        if r.draining.Load() {
+            return fmt.Errorf("shutting down")
+        }
+        return nil
+    })
+    return r
+}
+
+func (r *Readiness) Register(name string, critical bool, check func(ctx context.Context) error) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.checks = append(r.checks, ReadinessCheck{Name: name, Critical: critical, Check: check})
+}
+
+// MarkWarm records that start-up work has finished
+func (r *Readiness) MarkWarm() {
+    r.warm.Store(true)
+}
+
+// SetDraining fails readiness so no new traffic is routed here during shutdown
+func (r *Readiness) SetDraining() {
+    r.draining.Store(true)
+}
+
+// Run executes every check concurrently and reports whether all critical checks passed
+func (r *Readiness) Run(ctx context.Context) (bool, map[string]CheckResult) {
+    r.mutex.RLock()
+    checks := append([]ReadinessCheck(nil), r.checks...)
+    r.mutex.RUnlock()
+
+    ctx, cancel := context.WithTimeout(ctx, r.timeout)
+    defer cancel()
+
+    results := make(map[string]CheckResult, len(checks))
+    var resultsMutex sync.Mutex
+    var wg sync.WaitGroup
+    for _, check := range checks {
+        wg.Add(1)
+        go func(check ReadinessCheck) {
+            defer wg.Done()
+
+            start := time.Now()
+            result := CheckResult{Status: "pass", Critical: check.Critical}
+            if err := check.Check(ctx); err != nil {
+                result.Status = "fail"
+                result.Error = err.Error()
+            }
+            result.DurationMs = time.Since(start).Milliseconds()
+
+            resultsMutex.Lock()
+            results[check.Name] = result
+            resultsMutex.Unlock()
+        }(check)
+    }
+    wg.Wait()
+
+    ready := true
+    for _, result := range results {
+        if result.Critical && result.Status != "pass" {
+            ready = false
+        }
+    }
+    return ready, results
+}
+
+// Handler serves /readiness: 200 when every critical check passes, 503 with
+// per-check detail otherwise
+func (r *Readiness) Handler(service, cellID string) http.HandlerFunc {
+    return func(w http.ResponseWriter, req *http.Request) {
+        ready, results := r.Run(req.Context())
+
+        status, code := "ready", http.StatusOK
+        if !ready {
+            status, code = "not_ready", http.StatusServiceUnavailable
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(code)
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "status":    status,
+            "service":   service,
+            "cell_id":   cellID,
+            "checks":    results,
+            "timestamp": time.Now(),
+        })
+    }
+}
+
+// LockCheck verifies an in-memory store's lock can be taken, catching a
+// wedged store before it stalls every request. It polls with TryRLock rather
+// than blocking, so a probe that times out leaves nothing queued on the lock.
+func LockCheck(mutex *sync.RWMutex) func(ctx context.Context) error {
+    return func(ctx context.Context) error {
+        ticker := time.NewTicker(5 * time.Millisecond)
+        defer ticker.Stop()
+        for {
+            if mutex.TryRLock() {
+                mutex.RUnlock()
+                return nil
+            }
+            select {
+            case <-ticker.C:
+            case <-ctx.Done():
+                return fmt.Errorf("storage lock not acquired: %w", ctx.Err())
+            }
+        }
+    }
+}
+
+// UpstreamCheck verifies a dependency answers its /health endpoint. A
+// non-empty host is sent as the Host, for a dependency behind a proxy that
+// routes by it.
+func UpstreamCheck(url, host string) func(ctx context.Context) error {
+    client := &http.Client{Transport: mtls.NewTransport()}
+    return func(ctx context.Context) error {
+        req, err := http.NewRequestWithContext(ctx, "GET", url+"/health", nil)
+        if err != nil {
+            return err
+        }
+        if host != "" {
+            req.Host = host
+        }
+        resp, err := client.Do(req)
+        if err != nil {
+            return err
+        }
+        defer resp.Body.Close()
+
+        if resp.StatusCode != http.StatusOK {
+            return fmt.Errorf("%s/health returned %d", url, resp.StatusCode)
+        }
+        return nil
+    }
+}
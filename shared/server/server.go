@@ -0,0 +1,213 @@
+// Package server bootstraps a service: logging, tracing, metrics, readiness,
+// the standard middleware chain and a server that shuts down gracefully
+package server
+
+import (
+    "context"
+    "errors"
+    "log"
+    "net/http"
+    "os"
+    "os/signal"
+    "strings"
+    "syscall"
+    "time"
+
+    "cell-shared"
+    "cell-shared/auth"
+    "cell-shared/config"
+    "cell-shared/logging"
+    "cell-shared/metrics"
+    "cell-shared/middleware"
+    "cell-shared/mtls"
+    "cell-shared/openapi"
+    "cell-shared/tracing"
+    "github.com/gorilla/mux"
+)
+
+// Version is reported by every /health endpoint
+const Version = "1.0.0"
+
+// Server is the common scaffolding of every gateway and service. API routes
+// are added with Route; /readiness, /metrics and /openapi.json are
+// registered already.
+type Server struct {
+    Service   string
+    CellID    string
+    Router    *mux.Router
+    Readiness *Readiness
+    Metrics   *metrics.Metrics
+    API       *openapi.Document
+    // Identity verifies the identity headers gateways sign; gateways also
+    // sign with it
+    Identity *auth.IdentitySigner
+    // Callers enforces which workloads may call the API routes; gateways
+    // wrap their proxied routes in its Middleware
+    Callers *auth.CallerGuard
+    // OpenAPI serves /openapi.json, API unless replaced; gateways serve an
+    // aggregate of the services behind them instead
+    OpenAPI http.Handler
+    // OptionalClientCerts lets clients without a certificate connect when
+    // mutual TLS is on, for gateways that users reach directly
+    OptionalClientCerts bool
+
+    shutdownTracing func(ctx context.Context)
+    onShutdown      []func(ctx context.Context)
+}
+
+// New sets up logging and tracing for the service and builds a router that
+// runs request ID, access log, recovery, identity, tracing and metrics
+// middleware on every matched route. Calls made through NewClient name the
+// service as their caller.
+func New(service, cellID string) *Server {
+    logging.Setup(service, cellID)
+    self := cellID + "/" + strings.TrimPrefix(service, cellID+"-")
+
+    s := &Server{
+        Service:         service,
+        CellID:          cellID,
+        Router:          mux.NewRouter(),
+        Readiness:       NewReadiness(),
+        Metrics:         metrics.New(service, cellID),
+        API:             openapi.New(service, Version),
+        Identity:        auth.NewIdentitySigner(),
+        shutdownTracing: tracing.Setup(service, cellID),
+    }
+
+    s.Callers = auth.NewCallerGuard(self, cellID, s.Identity)
+    auth.SignOutbound(s.Identity, self)
+
+    s.Router.Use(logging.RequestID)
+    s.Router.Use(logging.AccessLog)
+    s.Router.Use(middleware.Recovery(cellID))
+    s.Router.Use(s.Identity.Middleware)
+    s.Router.Use(tracing.Middleware)
+    s.Router.Use(s.Metrics.Middleware)
+
+    // Unmatched requests skip the router middleware, so they get a request
+    // ID here to keep their errors traceable
+    s.Router.NotFoundHandler = logging.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        shared.WriteError(w, cellID, shared.ErrorRouteNotFound, "No route for "+r.URL.Path)
+    }))
+    s.Router.MethodNotAllowedHandler = logging.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        shared.WriteError(w, cellID, shared.ErrorMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path)
+    }))
+
+    s.Router.HandleFunc("/readiness", s.Readiness.Handler(service, cellID)).Methods("GET")
+    s.Router.Handle("/metrics", s.Metrics.Handler()).Methods("GET")
+    s.OpenAPI = s.API
+    s.Router.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+        s.OpenAPI.ServeHTTP(w, r)
+    }).Methods("GET")
+    return s
+}
+
+// Route registers handler for op, open to the callers the service policy
+// allows, and documents it in /openapi.json. A handler for an op with a
+// Request schema decodes its body with openapi.DecodeBody and the same
+// schema, so the document states exactly the rules the handler enforces.
+func (s *Server) Route(op openapi.Operation, handler http.HandlerFunc) {
+    s.Router.HandleFunc(op.Path, s.Callers.Middleware(handler)).Methods(op.Method)
+    s.API.Add(op)
+}
+
+// HandleHealth registers the /health liveness endpoint, whose standard
+// fields match shared.Health. details adds service-specific fields.
+func (s *Server) HandleHealth(details func() map[string]interface{}) {
+    s.Router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+        body := map[string]interface{}{
+            "status":         "healthy",
+            "service":        s.Service,
+            "cell_id":        s.CellID,
+            "timestamp":      time.Now(),
+            "version":        Version,
+            "schema_version": shared.SchemaVersion,
+        }
+        if details != nil {
+            for key, value := range details() {
+                body[key] = value
+            }
+        }
+
+        shared.WriteJSON(w, http.StatusOK, body)
+    }).Methods("GET")
+}
+
+// NewClient returns an HTTP client for calls to other services that carries
+// the trace, request ID and bearer token of the request that caused them,
+// signs this workload's caller headers and uses mutual TLS when it is on
+func NewClient(timeout time.Duration) *http.Client {
+    return &http.Client{
+        Timeout:   timeout,
+        Transport: &tracing.Transport{Base: &logging.Transport{Base: &auth.Transport{Base: mtls.NewTransport()}}},
+    }
+}
+
+// OnShutdown registers work to run once in-flight requests have drained,
+// such as finishing or persisting background jobs
+func (s *Server) OnShutdown(fn func(ctx context.Context)) {
+    s.onShutdown = append(s.onShutdown, fn)
+}
+
+// Run serves on port, over mutual TLS when TLS_ENABLED is set, until SIGTERM
+// or SIGINT, then fails readiness, waits SHUTDOWN_DRAIN_DELAY for load
+// balancers to notice, drains in-flight requests within SHUTDOWN_TIMEOUT,
+// runs the OnShutdown hooks and flushes traces before returning
+func (s *Server) Run(port string) {
+    server := &http.Server{
+        Addr:              ":" + port,
+        Handler:           middleware.CORS(s.Router),
+        ReadHeaderTimeout: config.Duration("SERVER_READ_HEADER_TIMEOUT", 5*time.Second),
+        ReadTimeout:       config.Duration("SERVER_READ_TIMEOUT", 30*time.Second),
+        WriteTimeout:      config.Duration("SERVER_WRITE_TIMEOUT", 90*time.Second),
+        IdleTimeout:       config.Duration("SERVER_IDLE_TIMEOUT", 120*time.Second),
+    }
+    drainDelay := config.Duration("SHUTDOWN_DRAIN_DELAY", 5*time.Second)
+    timeout := config.Duration("SHUTDOWN_TIMEOUT", 20*time.Second)
+
+    tlsConfig := mtls.FromEnv()
+    if tlsConfig != nil {
+        server.TLSConfig = tlsConfig.ServerTLS(s.OptionalClientCerts)
+    }
+
+    serveErr := make(chan error, 1)
+    go func() {
+        if tlsConfig != nil {
+            serveErr <- server.ListenAndServeTLS("", "")
+            return
+        }
+        serveErr <- server.ListenAndServe()
+    }()
+
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+    defer signal.Stop(signals)
+
+    select {
+    case err := <-serveErr:
+        if !errors.Is(err, http.ErrServerClosed) {
+            log.Fatal(err)
+        }
+        return
+    case sig := <-signals:
+        log.Printf("Received %s, draining for %s before shutdown", sig, drainDelay)
+    }
+
+    s.Readiness.SetDraining()
+    time.Sleep(drainDelay)
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+
+    if err := server.Shutdown(ctx); err != nil {
+        log.Printf("Graceful shutdown did not complete: %v", err)
+    } else {
+        log.Printf("All in-flight requests drained")
+    }
+
+    for _, fn := range s.onShutdown {
+        fn(ctx)
+    }
+    s.shutdownTracing(ctx)
+    log.Printf("Shutdown complete")
+}
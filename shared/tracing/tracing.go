@@ -0,0 +1,251 @@
+// Package tracing sets up OpenTelemetry tracing with W3C traceparent
+// propagation for incoming and outgoing requests
+package tracing
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "sync"
+
+    "cell-shared/config"
+    "cell-shared/middleware"
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/codes"
+    "go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+    "go.opentelemetry.io/otel/propagation"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+    "go.opentelemetry.io/otel/sdk/resource"
+    semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+    "go.opentelemetry.io/otel/trace"
+)
+
+// Tracer starts spans for work that is not an HTTP request, such as
+// background processing
+var Tracer = otel.Tracer("cell-test-suite")
+
+// Setup installs the global tracer provider and the W3C traceparent
+// propagator. TRACING_EXPORTER picks where finished spans go: "none" (the
+// default), "stdout", or "otlp-file" for OTLP/JSON lines in TRACING_FILE.
+// The returned function flushes any buffered spans.
+func Setup(service, cellID string) func(ctx context.Context) {
+    otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+    var exporter sdktrace.SpanExporter
+    var err error
+    switch config.Get("TRACING_EXPORTER", "none") {
+    case "stdout":
+        exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+    case "otlp-file":
+        exporter, err = newOTLPFileExporter(config.Get("TRACING_FILE", "traces.jsonl"))
+    default:
+        return func(ctx context.Context) {}
+    }
+    if err != nil {
+        log.Printf("Tracing disabled: %v", err)
+        return func(ctx context.Context) {}
+    }
+
+    ratio, err := strconv.ParseFloat(config.Get("TRACING_SAMPLE_RATIO", "1"), 64)
+    if err != nil {
+        ratio = 1
+    }
+
+    provider := sdktrace.NewTracerProvider(
+        sdktrace.WithBatcher(exporter),
+        sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+        sdktrace.WithResource(resource.NewSchemaless(
+            semconv.ServiceName(service),
+            semconv.ServiceNamespace(cellID),
+        )),
+    )
+    otel.SetTracerProvider(provider)
+    log.Printf("Tracing enabled, exporting to %s", config.Get("TRACING_EXPORTER", "none"))
+
+    return func(ctx context.Context) {
+        if err := provider.Shutdown(ctx); err != nil {
+            log.Printf("Error flushing traces: %v", err)
+        }
+    }
+}
+
+// Middleware continues the caller's trace from traceparent, or starts
+// a new one, with a server span named after the matched route
+func Middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+        route := middleware.RouteTemplate(r)
+        ctx, span := Tracer.Start(ctx, r.Method+" "+route,
+            trace.WithSpanKind(trace.SpanKindServer),
+            trace.WithAttributes(
+                semconv.HTTPRequestMethodKey.String(r.Method),
+                semconv.HTTPRoute(route),
+                attribute.String("cell.source", r.Header.Get("X-Source-Cell")),
+            ),
+        )
+        defer span.End()
+
+        recorder := middleware.NewStatusRecorder(w)
+        next.ServeHTTP(recorder, r.WithContext(ctx))
+
+        span.SetAttributes(semconv.HTTPResponseStatusCode(recorder.Status))
+        if recorder.Status >= http.StatusInternalServerError {
+            span.SetStatus(codes.Error, http.StatusText(recorder.Status))
+        }
+    })
+}
+
+// Transport wraps outbound calls in a client span and injects traceparent
+// so the next service joins the same trace
+type Transport struct {
+    Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+    ctx, span := Tracer.Start(req.Context(), req.Method+" "+req.URL.Host,
+        trace.WithSpanKind(trace.SpanKindClient),
+        trace.WithAttributes(
+            semconv.HTTPRequestMethodKey.String(req.Method),
+            semconv.URLFull(req.URL.String()),
+            semconv.ServerAddress(req.URL.Hostname()),
+        ),
+    )
+    defer span.End()
+
+    req = req.Clone(ctx)
+    otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+    resp, err := t.Base.RoundTrip(req)
+    if err != nil {
+        span.RecordError(err)
+        span.SetStatus(codes.Error, err.Error())
+        return nil, err
+    }
+    span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+    if resp.StatusCode >= http.StatusInternalServerError {
+        span.SetStatus(codes.Error, resp.Status)
+    }
+    return resp, nil
+}
+
+// otlpFileExporter writes each batch of spans as one line of OTLP/JSON, the
+// format read by the OpenTelemetry Collector's otlpjsonfile receiver
+type otlpFileExporter struct {
+    file  io.WriteCloser
+    mutex sync.Mutex
+}
+
+func newOTLPFileExporter(path string) (*otlpFileExporter, error) {
+    file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        return nil, fmt.Errorf("opening trace file: %w", err)
+    }
+    return &otlpFileExporter{file: file}, nil
+}
+
+func (e *otlpFileExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+    if len(spans) == 0 {
+        return nil
+    }
+
+    scopes := make(map[string][]map[string]interface{})
+    var order []string
+    for _, span := range spans {
+        scope := span.InstrumentationScope().Name
+        if _, exists := scopes[scope]; !exists {
+            order = append(order, scope)
+        }
+        scopes[scope] = append(scopes[scope], otlpSpan(span))
+    }
+
+    scopeSpans := make([]map[string]interface{}, 0, len(order))
+    for _, scope := range order {
+        scopeSpans = append(scopeSpans, map[string]interface{}{
+            "scope": map[string]string{"name": scope},
+            "spans": scopes[scope],
+        })
+    }
+
+    line, err := json.Marshal(map[string]interface{}{
+        "resourceSpans": []map[string]interface{}{{
+            "resource":   map[string]interface{}{"attributes": otlpAttributes(spans[0].Resource().Attributes())},
+            "scopeSpans": scopeSpans,
+        }},
+    })
+    if err != nil {
+        return err
+    }
+
+    e.mutex.Lock()
+    defer e.mutex.Unlock()
+    _, err = e.file.Write(append(line, '\n'))
+    return err
+}
+
+func (e *otlpFileExporter) Shutdown(ctx context.Context) error {
+    e.mutex.Lock()
+    defer e.mutex.Unlock()
+    return e.file.Close()
+}
+
+func otlpSpan(span sdktrace.ReadOnlySpan) map[string]interface{} {
+    // OTLP numbers status codes Unset, Ok, Error; the Go API uses Unset, Error, Ok
+    status := map[string]interface{}{"code": 0}
+    switch span.Status().Code {
+    case codes.Ok:
+        status["code"] = 1
+    case codes.Error:
+        status["code"] = 2
+        status["message"] = span.Status().Description
+    }
+
+    events := make([]map[string]interface{}, 0, len(span.Events()))
+    for _, event := range span.Events() {
+        events = append(events, map[string]interface{}{
+            "name":         event.Name,
+            "timeUnixNano": strconv.FormatInt(event.Time.UnixNano(), 10),
+            "attributes":   otlpAttributes(event.Attributes),
+        })
+    }
+
+    result := map[string]interface{}{
+        "traceId":           span.SpanContext().TraceID().String(),
+        "spanId":            span.SpanContext().SpanID().String(),
+        "name":              span.Name(),
+        "kind":              int(span.SpanKind()),
+        "startTimeUnixNano": strconv.FormatInt(span.StartTime().UnixNano(), 10),
+        "endTimeUnixNano":   strconv.FormatInt(span.EndTime().UnixNano(), 10),
+        "attributes":        otlpAttributes(span.Attributes()),
+        "events":            events,
+        "status":            status,
+    }
+    if span.Parent().IsValid() {
+        result["parentSpanId"] = span.Parent().SpanID().String()
+    }
+    return result
+}
+
+func otlpAttributes(attributes []attribute.KeyValue) []map[string]interface{} {
+    result := make([]map[string]interface{}, 0, len(attributes))
+    for _, kv := range attributes {
+        var value map[string]interface{}
+        switch kv.Value.Type() {
+        case attribute.BOOL:
+            value = map[string]interface{}{"boolValue": kv.Value.AsBool()}
+        case attribute.INT64:
+            value = map[string]interface{}{"intValue": strconv.FormatInt(kv.Value.AsInt64(), 10)}
+        case attribute.FLOAT64:
+            value = map[string]interface{}{"doubleValue": kv.Value.AsFloat64()}
+        default:
+            value = map[string]interface{}{"stringValue": kv.Value.Emit()}
+        }
+        result = append(result, map[string]interface{}{"key": string(kv.Key), "value": value})
+    }
+    return result
+}
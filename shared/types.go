@@ -1,6 +1,54 @@
+// Package shared holds the wire types every gateway and service exchanges.
+// They are the single source of truth for the JSON on the wire; the contract
+// test in test/contract-test.sh fails when a service's responses drift from
+// them.
 package shared
 
-import "time"
+import (
+    "strings"
+    "time"
+)
+
+// SchemaVersion is the version of the types in this package. The major
+// version changes when a field is removed, renamed or changes meaning;
+// adding a field bumps the minor version.
+const SchemaVersion = "2.4.0"
+
+// SchemaVersionHeader carries SchemaVersion on every JSON response
+const SchemaVersionHeader = "X-Schema-Version"
+
+// CompatibleSchema reports whether a peer speaking version can exchange
+// these types, i.e. whether the major versions match
+func CompatibleSchema(version string) bool {
+    major := func(v string) string {
+        return strings.SplitN(strings.TrimPrefix(v, "v"), ".", 2)[0]
+    }
+    return version != "" && major(version) == major(SchemaVersion)
+}
+
+const (
+    OrderStatusPending   = "pending"
+    OrderStatusPaid      = "paid"
+    OrderStatusCompleted = "completed"
+    OrderStatusCancelled = "cancelled"
+
+    PaymentStatusProcessing = "processing"
+    PaymentStatusCompleted  = "completed"
+    PaymentStatusRefunded   = "refunded"
+
+    PaymentMethodCard         = "card"
+    PaymentMethodCreditCard   = "credit_card"
+    PaymentMethodDebitCard    = "debit_card"
+    PaymentMethodBankTransfer = "bank_transfer"
+    PaymentMethodPayPal       = "paypal"
+    PaymentMethodWallet       = "wallet"
+)
+
+// PaymentMethods lists every method a payment can be made with
+var PaymentMethods = []string{
+    PaymentMethodCard, PaymentMethodCreditCard, PaymentMethodDebitCard,
+    PaymentMethodBankTransfer, PaymentMethodPayPal, PaymentMethodWallet,
+}
 
 type User struct {
     ID        string    `json:"id"`
@@ -21,19 +69,30 @@ type Product struct {
 }
 
 type Order struct {
-    ID        string    `json:"id"`
-    UserID    string    `json:"user_id"`
-    ProductID string    `json:"product_id"`
-    Quantity  int       `json:"quantity"`
-    Total     float64   `json:"total"`
-    Status    string    `json:"status"`
-    CreatedAt time.Time `json:"created_at"`
-    CellID    string    `json:"cell_id"`
+    ID        string        `json:"id"`
+    UserID    string        `json:"user_id"`
+    User      *UserSnapshot `json:"user,omitempty"`
+    ProductID string        `json:"product_id"`
+    Quantity  int           `json:"quantity"`
+    Total     float64       `json:"total"`
+    Status    string        `json:"status"`
+    CreatedAt time.Time     `json:"created_at"`
+    CellID    string        `json:"cell_id"`
+}
+
+// UserSnapshot is the user an order was placed for, as Cell A knew them at
+// the time; later changes to the user do not update it
+type UserSnapshot struct {
+    ID    string `json:"id"`
+    Name  string `json:"name"`
+    Email string `json:"email"`
 }
 
 type Payment struct {
     ID        string    `json:"id"`
     OrderID   string    `json:"order_id"`
+    // UserID is the owner of the order, copied when the payment is made
+    UserID    string    `json:"user_id"`
     Amount    float64   `json:"amount"`
     Status    string    `json:"status"`
     Method    string    `json:"method"`
@@ -41,9 +100,129 @@ type Payment struct {
     CreatedAt time.Time `json:"created_at"`
 }
 
+// UserUpdate is the body of PUT /users/{id}; only the fields that are set
+// change
+type UserUpdate struct {
+    Name  *string `json:"name,omitempty"`
+    Email *string `json:"email,omitempty"`
+}
+
+// ProductUpdate is the body of PUT /products/{id}; only the fields that are
+// set change, so stock can be set to zero without touching the price
+type ProductUpdate struct {
+    Name        *string  `json:"name,omitempty"`
+    Description *string  `json:"description,omitempty"`
+    Price       *float64 `json:"price,omitempty"`
+    Stock       *int     `json:"stock,omitempty"`
+}
+
+// StockUpdate is the body of PUT /products/{id}/stock, which takes
+// Quantity units out of stock
+type StockUpdate struct {
+    Quantity int `json:"quantity"`
+}
+
+// OrderStatusUpdate is the body of PUT /orders/{id}/status
+type OrderStatusUpdate struct {
+    Status string `json:"status"`
+}
+
+// OrderStatuses lists every status an order can be set to
+var OrderStatuses = []string{OrderStatusPending, OrderStatusPaid, OrderStatusCompleted, OrderStatusCancelled}
+
 type ServiceResponse struct {
     Success bool        `json:"success"`
     Data    interface{} `json:"data,omitempty"`
-    Error   string      `json:"error,omitempty"`
+    Error   *Error      `json:"error,omitempty"`
+    Message string      `json:"message,omitempty"`
+    Count   *int        `json:"count,omitempty"`
     CellID  string      `json:"cell_id"`
-}
\ No newline at end of file
+}
+
+// Error is the error of every failed response, from services and gateways
+// alike. CellID is the cell that produced it, which differs from the
+// envelope's when a gateway reports a failure in the peer cell. Upstream,
+// UpstreamCell and Reason are set when the failure was a call to another
+// service that could not be completed.
+type Error struct {
+    Code         string       `json:"code"`
+    Message      string       `json:"message"`
+    Details      []FieldError `json:"details,omitempty"`
+    CellID       string       `json:"cell_id"`
+    RequestID    string       `json:"request_id,omitempty"`
+    Retryable    bool         `json:"retryable"`
+    Upstream     string       `json:"upstream,omitempty"`
+    UpstreamCell string       `json:"upstream_cell,omitempty"`
+    Reason       string       `json:"reason,omitempty"`
+}
+
+// FieldError is one reason a request was rejected. Field is the dotted path
+// of the offending field in the request body, empty for the body as a whole.
+type FieldError struct {
+    Field   string `json:"field"`
+    Message string `json:"message"`
+}
+
+// Registration is the body of POST /auth/register, which creates a user who
+// can log in
+type Registration struct {
+    Name     string `json:"name"`
+    Email    string `json:"email"`
+    Password string `json:"password"`
+}
+
+// Credentials is the body of POST /auth/login
+type Credentials struct {
+    Email    string `json:"email"`
+    Password string `json:"password"`
+}
+
+// RefreshRequest is the body of POST /auth/refresh and POST /auth/logout
+type RefreshRequest struct {
+    RefreshToken string `json:"refresh_token"`
+}
+
+// Tokens is what a login or refresh answers with. AccessToken is a JWT to
+// send as a Bearer token; RefreshToken is opaque, single-use, and traded
+// for new Tokens at POST /auth/refresh. Lifetimes are in seconds.
+type Tokens struct {
+    AccessToken      string `json:"access_token"`
+    TokenType        string `json:"token_type"`
+    ExpiresIn        int    `json:"expires_in"`
+    RefreshToken     string `json:"refresh_token"`
+    RefreshExpiresIn int    `json:"refresh_expires_in"`
+}
+
+// JWKS is the key set at /.well-known/jwks.json that access tokens are
+// verified with. It is served bare, not in a ServiceResponse, so standard
+// JWT libraries can read it.
+type JWKS struct {
+    Keys []JWK `json:"keys"`
+}
+
+// JWK is one RSA public key of a JWKS, as RFC 7517 encodes it
+type JWK struct {
+    KeyType   string `json:"kty"`
+    Use       string `json:"use"`
+    Algorithm string `json:"alg"`
+    KeyID     string `json:"kid"`
+    N         string `json:"n"`
+    E         string `json:"e"`
+}
+
+// PaymentsByOrderResponse is the envelope of GET /payments/order/{order_id}
+type PaymentsByOrderResponse struct {
+    ServiceResponse
+    OrderID string `json:"order_id"`
+}
+
+// Health is the part of every /health response common to all services;
+// each service adds its own fields alongside
+type Health struct {
+    Status        string    `json:"status"`
+    Service       string    `json:"service"`
+    CellID        string    `json:"cell_id"`
+    Timestamp     time.Time `json:"timestamp"`
+    Version       string    `json:"version"`
+    SchemaVersion string    `json:"schema_version"`
+}
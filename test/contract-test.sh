@@ -0,0 +1,703 @@
+#!/bin/bash
+
+# Contract Test
+# Runs both cells locally, drives every endpoint through the gateways and
+# checks each JSON response against the shared types in shared/types.go.
+# Fails when a service adds, drops or retypes a field without the shared
+# types changing with it, stops sending X-Schema-Version, accepts a body its
+# OpenAPI schema forbids, leaves a route out of /openapi.json, or lets a
+# caller through that the gateway access policy or a service policy keeps
+# out. Requests are sent as the admin unless TOKEN says otherwise.
+
+set -e
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+BLUE='\033[0;34m'
+NC='\033[0m' # No Color
+
+ROOT_DIR="$(cd "$(dirname "$0")/.." && pwd)"
+WORK_DIR="$(mktemp -d)"
+GATEWAY_A_PORT=19110
+USER_PORT=19111
+PRODUCT_PORT=19112
+GATEWAY_B_PORT=19120
+ORDER_PORT=19121
+PAYMENT_PORT=19122
+# A gateway, payment service and order service whose upstreams are down, and
+# the ports they point at, which nothing listens on
+ORPHAN_GATEWAY_PORT=19123
+ORPHAN_PAYMENT_PORT=19124
+ORPHAN_ORDER_PORT=19125
+DEAD_PORT=19129
+DEAD_GATEWAY_PORT=19128
+# A gateway whose order-service URL is itself, under an address it does not
+# recognise, and one whose routes loop in a way it sees at startup
+LOOP_GATEWAY_PORT=19126
+BAD_ROUTES_PORT=19127
+# A proxy that routes by Host, like the KEDA HTTP add-on's interceptor, and a
+# gateway, order-service and payment-service that reach every upstream
+# through it
+HOST_ROUTER_PORT=19130
+SHARED_PROXY_GATEWAY_PORT=19131
+SHARED_PROXY_ORDER_PORT=19134
+SHARED_PROXY_PAYMENT_PORT=19135
+# A gateway with a one-request rate limit
+RATE_LIMITED_GATEWAY_PORT=19132
+# Services with no signing key, which must not start
+NO_KEY_USER_PORT=19133
+FAILURES=0
+CHECKS=0
+
+PIDS=()
+cleanup() {
+    for pid in "${PIDS[@]}"; do
+        kill "$pid" 2>/dev/null || true
+    done
+    rm -rf "$WORK_DIR"
+}
+trap cleanup EXIT
+
+fail() {
+    echo -e "${RED}❌ $1${NC}"
+    FAILURES=$((FAILURES + 1))
+}
+
+pass() {
+    echo -e "${GREEN}✅ $1${NC}"
+}
+
+wait_for() {
+    local url=$1
+    for _ in $(seq 1 50); do
+        if curl -s -o /dev/null "$url"; then
+            return 0
+        fi
+        sleep 0.1
+    done
+    echo -e "${RED}Timed out waiting for $url${NC}"
+    exit 1
+}
+
+# expect METHOD URL BODY STATUS SHAPE
+# Sends the request with $TOKEN as the bearer token, $HEADER as an extra
+# header, caller headers naming $CALLER and a cross-cell signature from the
+# gateway of $CELL, if set, for the client $CELL_CLIENT, then checks the status
+# code, the schema version header and the body against SHAPE. $CELL_TIME,
+# $CELL_NONCE and $CELL_SIGNED_BODY replace the time, nonce and body that are
+# signed, and $CALLER_NONCE and $CALLER_SIGNED_BODY those in the caller
+# headers. The body is left in $WORK_DIR/body.json.
+expect() {
+    local method=$1 url=$2 body=$3 want_status=$4 shape=$5
+    local args=(-s -o "$WORK_DIR/body.json" -D "$WORK_DIR/headers.txt" -w '%{http_code}' -X "$method")
+    if [ -n "$body" ]; then
+        args+=(-H "Content-Type: application/json" -d "$body")
+    fi
+    if [ -n "$TOKEN" ]; then
+        args+=(-H "Authorization: Bearer $TOKEN")
+    fi
+    if [ -n "$HEADER" ]; then
+        args+=(-H "$HEADER")
+    fi
+    if [ -n "$CALLER" ]; then
+        local path="/${url#*://*/}" now nonce=${CALLER_NONCE:-$(openssl rand -hex 16)} hash
+        now=$(date +%s)
+        hash=$(printf '%s' "${CALLER_SIGNED_BODY-$body}" | sha256sum | cut -d' ' -f1)
+        args+=(-H "X-Caller-Service: $CALLER" -H "X-Caller-Time: $now" -H "X-Caller-Nonce: $nonce" -H "X-Caller-Content-SHA256: $hash"
+               -H "X-Caller-Signature: $(sign "$IDENTITY_SIGNING_KEY" caller "$method" "$path" "$CALLER" "$now" "$nonce" "$hash")")
+    fi
+    if [ -n "$CELL" ]; then
+        local path="/${url#*://*/}" now=${CELL_TIME:-$(date +%s)} nonce=${CELL_NONCE:-$(openssl rand -hex 16)} hash
+        hash=$(printf '%s' "${CELL_SIGNED_BODY-$body}" | sha256sum | cut -d' ' -f1)
+        args+=(-H "X-Source-Cell: $CELL" -H "X-Gateway-ID: $CELL" -H "X-Cell-Client: $CELL_CLIENT"
+               -H "X-Cell-Time: $now" -H "X-Cell-Nonce: $nonce" -H "X-Content-SHA256: $hash"
+               -H "X-Cell-Signature: $(sign "$CELL_SIGNING_KEY" "$method" "$path" "$now" "$nonce" "$hash" "$CELL" "$CELL" "$CELL_CLIENT")")
+    fi
+    local status
+    status=$(curl "${args[@]}" "$url")
+    CHECKS=$((CHECKS + 1))
+
+    local label="$method ${url#http://localhost:} ($shape)"
+    if [ "$status" != "$want_status" ]; then
+        fail "$label returned $status, want $want_status: $(cat "$WORK_DIR/body.json")"
+        return
+    fi
+
+    local version
+    version=$(grep -i '^X-Schema-Version:' "$WORK_DIR/headers.txt" | tr -d '\r' | awk '{print $2}')
+    if [ "$version" != "$SCHEMA_VERSION" ]; then
+        fail "$label sent schema version '$version', want $SCHEMA_VERSION"
+        return
+    fi
+
+    local problems
+    if problems=$("$WORK_DIR/contract-check" "$shape" < "$WORK_DIR/body.json"); then
+        pass "$label"
+    else
+        fail "$label diverges from the shared schema:"
+        echo "$problems" | sed 's/^/     /'
+    fi
+}
+
+# sign KEY FIELD... prints the signature of the fields the way gateways and
+# services sign headers: an HMAC-SHA256 of the fields, one per line
+sign() {
+    local key=$1 IFS=$'\n'
+    shift
+    printf '%s' "$*" | openssl dgst -sha256 -hmac "$key" -binary | base64 | tr '+/' '-_' | tr -d '=\n'
+}
+
+# expect_spec URL PATH... checks an OpenAPI document documents every PATH
+expect_spec() {
+    local url=$1
+    shift
+    local status
+    status=$(curl -s -o "$WORK_DIR/spec.json" -w '%{http_code}' "$url")
+    CHECKS=$((CHECKS + 1))
+
+    local label="GET ${url#http://localhost:}"
+    if [ "$status" != "200" ]; then
+        fail "$label returned $status"
+        return
+    fi
+    local problems
+    if problems=$(python3 - "$WORK_DIR/spec.json" "$@" <<'PY'
+import json, sys
+spec = json.load(open(sys.argv[1]))
+if not spec.get("openapi", "").startswith("3."):
+    print("not an OpenAPI 3 document")
+for path in sys.argv[2:]:
+    if path not in spec.get("paths", {}):
+        print("missing path " + path)
+for name in spec.get("x-unavailable", []):
+    print("upstream unavailable: " + name)
+PY
+    ) && [ -z "$problems" ]; then
+        pass "$label documents $# paths"
+    else
+        fail "$label is incomplete:"
+        echo "$problems" | sed 's/^/     /'
+    fi
+}
+
+# field NAME prints a field of the data object in the last response body;
+# NAME may be a dotted path into nested objects
+field() {
+    python3 -c "
+import json, sys
+value = json.load(sys.stdin)['data']
+for key in '$1'.split('.'):
+    value = value[key]
+print(value)" < "$WORK_DIR/body.json"
+}
+
+# expect_token USER_ID checks the access token in the last response body
+# names USER_ID and cell-a and verifies against the JWKS gateway B serves
+expect_token() {
+    curl -s "$B/.well-known/jwks.json" > "$WORK_DIR/jwks.json"
+    CHECKS=$((CHECKS + 1))
+    local problems
+    if problems=$(python3 - "$WORK_DIR/body.json" "$WORK_DIR/jwks.json" "$1" <<'PY'
+import base64, hashlib, json, sys, time
+def decode(part):
+    return base64.urlsafe_b64decode(part + "=" * (-len(part) % 4))
+def number(part):
+    return int.from_bytes(decode(part), "big")
+token = json.load(open(sys.argv[1]))["data"]["access_token"]
+keys = {key["kid"]: key for key in json.load(open(sys.argv[2]))["keys"]}
+header, claims, signature = token.split(".")
+head, body = json.loads(decode(header)), json.loads(decode(claims))
+key = keys.get(head.get("kid"))
+if head.get("alg") != "RS256" or key is None:
+    print("header %s does not name a key in the JWKS" % head)
+    sys.exit()
+# RSASSA-PKCS1-v1_5 with SHA-256
+n, e = number(key["n"]), number(key["e"])
+size = (n.bit_length() + 7) // 8
+digest = bytes.fromhex("3031300d060960864801650304020105000420") + hashlib.sha256((header + "." + claims).encode()).digest()
+padded = b"\x00\x01" + b"\xff" * (size - len(digest) - 3) + b"\x00" + digest
+if pow(number(signature), e, n).to_bytes(size, "big") != padded:
+    print("signature does not verify")
+if body.get("sub") != sys.argv[3] or body.get("cell") != "cell-a":
+    print("claims name %s in %s" % (body.get("sub"), body.get("cell")))
+if not body.get("exp", 0) > time.time():
+    print("token has expired")
+PY
+    ) && [ -z "$problems" ]; then
+        pass "  ... access token verifies against the JWKS"
+    else
+        fail "  ... access token is wrong: $problems"
+    fi
+}
+
+# expect_count N checks the count of the list in the last response body
+expect_count() {
+    local count
+    count=$(python3 -c "import json, sys; print(json.load(sys.stdin)['count'])" < "$WORK_DIR/body.json")
+    CHECKS=$((CHECKS + 1))
+    if [ "$count" = "$1" ]; then
+        pass "  ... listed $count"
+    else
+        fail "  ... listed $count, want $1"
+    fi
+}
+
+# expect_field NAME VALUE checks a field of the data in the last response body
+expect_field() {
+    local value
+    value=$(field "$1")
+    CHECKS=$((CHECKS + 1))
+    if [ "$value" = "$2" ]; then
+        pass "  ... $1 is $value"
+    else
+        fail "  ... $1 is $value, want $2"
+    fi
+}
+
+echo -e "${BLUE}=== Contract Test ===${NC}"
+
+echo -e "${YELLOW}Building binaries...${NC}"
+(cd "$ROOT_DIR/shared" && go build -o "$WORK_DIR/contract-check" ./cmd/contract-check)
+for service in cell-a/gateway cell-a/user-service cell-a/product-service \
+               cell-b/gateway cell-b/order-service cell-b/payment-service; do
+    (cd "$ROOT_DIR/$service" && go build -o "$WORK_DIR/${service//\//-}" .)
+done
+SCHEMA_VERSION=$(sed -n 's/^const SchemaVersion = "\(.*\)"/\1/p' "$ROOT_DIR/shared/types.go")
+
+export HEALTH_CHECK_INTERVAL=0 SHUTDOWN_DRAIN_DELAY=0s LOG_LEVEL=error
+export IDENTITY_SIGNING_KEY=contract-test-identity-key
+CELL_SIGNING_KEY=contract-test-cell-key
+export CELL_SIGNING_KEYS="cell-a=$CELL_SIGNING_KEY,cell-b=$CELL_SIGNING_KEY"
+openssl genpkey -algorithm RSA -pkeyopt rsa_keygen_bits:2048 -out "$WORK_DIR/signing-key.pem" 2>/dev/null
+PORT=$USER_PORT \
+JWT_SIGNING_KEY_FILE="$WORK_DIR/signing-key.pem" \
+ADMIN_EMAIL=admin@example.com \
+ADMIN_PASSWORD=admin-password \
+    "$WORK_DIR/cell-a-user-service" > "$WORK_DIR/user.log" 2>&1 &
+PIDS+=($!)
+PORT=$PRODUCT_PORT "$WORK_DIR/cell-a-product-service" > "$WORK_DIR/product.log" 2>&1 &
+PIDS+=($!)
+PORT=$ORDER_PORT \
+CELL_A_GATEWAY_URL="http://localhost:$GATEWAY_A_PORT" \
+PAYMENT_SERVICE_URL="http://localhost:$PAYMENT_PORT" \
+USER_CACHE_TTL=1s \
+    "$WORK_DIR/cell-b-order-service" > "$WORK_DIR/order.log" 2>&1 &
+PIDS+=($!)
+PORT=$PAYMENT_PORT \
+ORDER_SERVICE_URL="http://localhost:$ORDER_PORT" \
+    "$WORK_DIR/cell-b-payment-service" > "$WORK_DIR/payment.log" 2>&1 &
+PIDS+=($!)
+PORT=$GATEWAY_A_PORT \
+USER_SERVICE_URL="http://localhost:$USER_PORT" \
+PRODUCT_SERVICE_URL="http://localhost:$PRODUCT_PORT" \
+CELL_B_GATEWAY_URL="http://localhost:$GATEWAY_B_PORT" \
+    "$WORK_DIR/cell-a-gateway" > "$WORK_DIR/gateway-a.log" 2>&1 &
+PIDS+=($!)
+PORT=$GATEWAY_B_PORT \
+ORDER_SERVICE_URL="http://localhost:$ORDER_PORT" \
+PAYMENT_SERVICE_URL="http://localhost:$PAYMENT_PORT" \
+CELL_A_GATEWAY_URL="http://localhost:$GATEWAY_A_PORT" \
+    "$WORK_DIR/cell-b-gateway" > "$WORK_DIR/gateway-b.log" 2>&1 &
+PIDS+=($!)
+
+PORT=$ORPHAN_GATEWAY_PORT \
+ORDER_SERVICE_URL="http://localhost:$DEAD_PORT" \
+PAYMENT_SERVICE_URL="http://localhost:$DEAD_PORT" \
+CELL_A_GATEWAY_URL="http://localhost:$DEAD_GATEWAY_PORT" \
+ACTIVATOR_MAX_WAIT=500ms \
+    "$WORK_DIR/cell-b-gateway" > "$WORK_DIR/gateway-orphan.log" 2>&1 &
+PIDS+=($!)
+PORT=$LOOP_GATEWAY_PORT \
+ORDER_SERVICE_URL="http://127.0.0.2:$LOOP_GATEWAY_PORT" \
+PAYMENT_SERVICE_URL="http://localhost:$PAYMENT_PORT" \
+CELL_A_GATEWAY_URL="http://localhost:$GATEWAY_A_PORT" \
+    "$WORK_DIR/cell-b-gateway" > "$WORK_DIR/gateway-loop.log" 2>&1 &
+PIDS+=($!)
+# Called directly, so there is no gateway-verified user or gateway caller
+PORT=$ORPHAN_PAYMENT_PORT \
+ORDER_SERVICE_URL="http://localhost:$DEAD_PORT" \
+UPSTREAM_RETRY_ATTEMPTS=1 \
+AUTH_ENABLED=false \
+SERVICE_AUTH_ENABLED=false \
+    "$WORK_DIR/cell-b-payment-service" > "$WORK_DIR/payment-orphan.log" 2>&1 &
+PIDS+=($!)
+PORT=$ORPHAN_ORDER_PORT \
+CELL_A_GATEWAY_URL="http://localhost:$DEAD_PORT" \
+UPSTREAM_RETRY_ATTEMPTS=1 \
+AUTH_ENABLED=false \
+SERVICE_AUTH_ENABLED=false \
+    "$WORK_DIR/cell-b-order-service" > "$WORK_DIR/order-orphan.log" 2>&1 &
+PIDS+=($!)
+
+for port in $USER_PORT $PRODUCT_PORT $ORDER_PORT $PAYMENT_PORT $GATEWAY_A_PORT $GATEWAY_B_PORT \
+            $ORPHAN_GATEWAY_PORT $ORPHAN_PAYMENT_PORT $ORPHAN_ORDER_PORT $LOOP_GATEWAY_PORT; do
+    wait_for "http://localhost:$port/health"
+done
+
+A="http://localhost:$GATEWAY_A_PORT"
+B="http://localhost:$GATEWAY_B_PORT"
+
+# login EMAIL PASSWORD prints the access token of a login through gateway A
+login() {
+    curl -s -X POST -H "Content-Type: application/json" -d "{\"email\":\"$1\",\"password\":\"$2\"}" "$A/auth/login" |
+        python3 -c "import json, sys; print(json.load(sys.stdin)['data']['access_token'])"
+}
+TOKEN=$(login admin@example.com admin-password)
+
+echo -e "\n${YELLOW}Health...${NC}"
+for port in $USER_PORT $PRODUCT_PORT $ORDER_PORT $PAYMENT_PORT $GATEWAY_A_PORT $GATEWAY_B_PORT; do
+    expect GET "http://localhost:$port/health" "" 200 health
+done
+
+echo -e "\n${YELLOW}Users (Cell A)...${NC}"
+expect POST "$A/users" '{"name":"Ada","email":"ada@example.com"}' 201 user
+USER_ID=$(field id)
+expect GET "$A/users/$USER_ID" "" 200 user
+expect PUT "$A/users/$USER_ID" '{"name":"Ada Lovelace"}' 200 user
+expect GET "$A/users" "" 200 users
+expect GET "$A/users/missing" "" 404 error
+expect POST "$A/users" '{"name":"Ada Again","email":"ADA@Example.com"}' 409 error
+expect GET "$A/users?email=Ada%40Example.com" "" 200 users
+expect_count 1
+expect GET "$B/users?email=ada%40example.com" "" 200 users
+expect_count 1
+expect GET "$A/users?email=nobody%40example.com" "" 200 users
+expect_count 0
+expect POST "$A/users" '{"name":"Grace","email":"grace@example.com"}' 201 user
+GRACE_ID=$(field id)
+expect PUT "$A/users/$GRACE_ID" '{"email":"ada@example.com"}' 409 error
+expect PUT "$A/users/$GRACE_ID" '{"email":"grace.hopper@example.com"}' 200 user
+expect POST "$A/users" '{"name":"Grace","email":"grace@example.com"}' 201 user
+
+echo -e "\n${YELLOW}Auth (Cell A)...${NC}"
+expect POST "$A/auth/register" '{"name":"Alan","email":"alan@example.com","password":"correct horse"}' 201 user
+ALAN_ID=$(field id)
+expect POST "$A/auth/register" '{"name":"Alan","email":"ALAN@example.com","password":"correct horse"}' 409 error
+expect POST "$A/auth/login" '{"email":"alan@example.com","password":"wrong horse"}' 401 error
+expect POST "$A/auth/login" '{"email":"nobody@example.com","password":"correct horse"}' 401 error
+expect POST "$A/auth/login" '{"email":"ada@example.com","password":"correct horse"}' 401 error
+expect POST "$B/auth/login" '{"email":"Alan@Example.com","password":"correct horse"}' 200 tokens
+REFRESH_TOKEN=$(field refresh_token)
+ALAN_TOKEN=$(field access_token)
+expect_token "$ALAN_ID"
+expect GET "$A/.well-known/jwks.json" "" 200 jwks
+expect POST "$A/auth/refresh" "{\"refresh_token\":\"$REFRESH_TOKEN\"}" 200 tokens
+NEW_REFRESH_TOKEN=$(field refresh_token)
+expect_token "$ALAN_ID"
+expect POST "$A/auth/refresh" "{\"refresh_token\":\"$REFRESH_TOKEN\"}" 401 error
+expect POST "$A/auth/logout" "{\"refresh_token\":\"$NEW_REFRESH_TOKEN\"}" 200 message
+expect POST "$A/auth/refresh" "{\"refresh_token\":\"$NEW_REFRESH_TOKEN\"}" 401 error
+CHECKS=$((CHECKS + 1))
+if LOG_LEVEL=info PORT=$NO_KEY_USER_PORT timeout 10 "$WORK_DIR/cell-a-user-service" > "$WORK_DIR/user-no-key.log" 2>&1; then
+    fail "user-service started without JWT_SIGNING_KEY_FILE outside dev mode"
+elif grep -q 'JWT_SIGNING_KEY_FILE is not set' "$WORK_DIR/user-no-key.log"; then
+    pass "user-service refuses to start without JWT_SIGNING_KEY_FILE outside dev mode"
+else
+    fail "user-service without a signing key did not say why: $(tail -1 "$WORK_DIR/user-no-key.log")"
+fi
+CHECKS=$((CHECKS + 1))
+if IDENTITY_SIGNING_KEY= LOG_LEVEL=info PORT=$NO_KEY_USER_PORT timeout 10 "$WORK_DIR/cell-a-product-service" > "$WORK_DIR/product-no-key.log" 2>&1; then
+    fail "product-service started without IDENTITY_SIGNING_KEY outside dev mode"
+elif grep -q 'IDENTITY_SIGNING_KEY is not set' "$WORK_DIR/product-no-key.log"; then
+    pass "product-service refuses to start without IDENTITY_SIGNING_KEY outside dev mode"
+else
+    fail "product-service without an identity key did not say why: $(tail -1 "$WORK_DIR/product-no-key.log")"
+fi
+
+echo -e "\n${YELLOW}Products (Cell A)...${NC}"
+expect POST "$A/products" '{"name":"Widget","description":"A widget","price":9.5,"stock":10}' 201 product
+PRODUCT_ID=$(field id)
+expect GET "$A/products/$PRODUCT_ID" "" 200 product
+expect PUT "$A/products/$PRODUCT_ID" '{"price":12.25,"stock":20}' 200 product
+expect GET "$A/products" "" 200 products
+CALLER=cell-b/order-service expect PUT "$A/products/$PRODUCT_ID/stock" '{"quantity":1000}' 400 error
+
+echo -e "\n${YELLOW}Orders (Cell B, cross-cell stock update)...${NC}"
+expect POST "$B/orders" "{\"user_id\":\"$USER_ID\",\"product_id\":\"$PRODUCT_ID\",\"quantity\":2,\"total\":24.5}" 201 order
+ORDER_ID=$(field id)
+expect_field user.name "Ada Lovelace"
+expect_field user.email ada@example.com
+expect GET "$B/orders/$ORDER_ID" "" 200 order
+expect GET "$A/orders" "" 200 orders
+expect GET "$B/orders/missing" "" 404 error
+expect PUT "$B/orders/$ORDER_ID/status" '{"status":"completed"}' 200 order
+
+echo -e "\n${YELLOW}Payments (Cell B)...${NC}"
+expect POST "$B/payments" "{\"order_id\":\"$ORDER_ID\",\"amount\":24.5,\"method\":\"card\"}" 201 payment
+PAYMENT_ID=$(field id)
+expect GET "$B/payments/$PAYMENT_ID" "" 200 payment
+expect GET "$B/payments" "" 200 payments
+expect GET "$B/payments/order/$ORDER_ID" "" 200 payments-by-order
+expect POST "$B/payments/$PAYMENT_ID/refund" "" 400 error
+sleep 2.5
+expect POST "$B/payments/$PAYMENT_ID/refund" "" 200 payment
+expect GET "$A/payments/order/$ORDER_ID" "" 200 payments-by-order
+
+echo -e "\n${YELLOW}Access control...${NC}"
+TOKEN= expect GET "$A/products" "" 200 products
+TOKEN= expect GET "$B/products/$PRODUCT_ID" "" 200 product
+TOKEN= expect GET "$A/users/$ALAN_ID" "" 401 error
+TOKEN= expect POST "$B/orders" "{\"user_id\":\"$ALAN_ID\",\"product_id\":\"$PRODUCT_ID\",\"quantity\":1}" 401 error
+TOKEN=not.a.token expect GET "$A/products" "" 401 error
+TOKEN="$ALAN_TOKEN" expect GET "$B/users/$ALAN_ID" "" 200 user
+TOKEN="$ALAN_TOKEN" expect PUT "$A/users/$ALAN_ID" '{"name":"Alan Turing"}' 200 user
+TOKEN="$ALAN_TOKEN" expect GET "$A/users/$USER_ID" "" 404 error
+TOKEN="$ALAN_TOKEN" expect PUT "$A/users/$USER_ID" '{"name":"Mallory"}' 404 error
+TOKEN="$ALAN_TOKEN" expect DELETE "$A/users/$USER_ID" "" 404 error
+expect GET "$A/users/$USER_ID" "" 200 user
+expect_field name "Ada Lovelace"
+TOKEN="$ALAN_TOKEN" expect GET "$A/users" "" 403 error
+TOKEN="$ALAN_TOKEN" expect DELETE "$A/products/$PRODUCT_ID" "" 403 error
+TOKEN="$ALAN_TOKEN" expect POST "$B/payments/$PAYMENT_ID/refund" "" 403 error
+TOKEN="$ALAN_TOKEN" HEADER="X-Identity-Roles: admin" expect GET "$A/users" "" 403 error
+# Order-service reserves the stock through gateway A with Alan's token
+TOKEN="$ALAN_TOKEN" expect POST "$B/orders" "{\"product_id\":\"$PRODUCT_ID\",\"quantity\":1}" 201 order
+ALAN_ORDER_ID=$(field id)
+expect_field user_id "$ALAN_ID"
+TOKEN="$ALAN_TOKEN" expect POST "$B/orders" "{\"user_id\":\"$USER_ID\",\"product_id\":\"$PRODUCT_ID\",\"quantity\":1}" 403 error
+
+echo -e "\n${YELLOW}Ownership...${NC}"
+TOKEN="$ALAN_TOKEN" expect GET "$A/orders" "" 200 orders
+expect_count 1
+TOKEN="$ALAN_TOKEN" expect GET "$B/orders/$ALAN_ORDER_ID" "" 200 order
+TOKEN="$ALAN_TOKEN" expect GET "$B/orders/$ORDER_ID" "" 404 error
+TOKEN="$ALAN_TOKEN" expect POST "$B/payments" "{\"order_id\":\"$ORDER_ID\",\"amount\":1,\"method\":\"card\"}" 400 invalid
+TOKEN="$ALAN_TOKEN" expect POST "$B/payments" "{\"order_id\":\"$ALAN_ORDER_ID\",\"amount\":12.25,\"method\":\"card\"}" 201 payment
+expect_field user_id "$ALAN_ID"
+TOKEN="$ALAN_TOKEN" expect GET "$B/payments" "" 200 payments
+expect_count 1
+TOKEN="$ALAN_TOKEN" expect GET "$B/payments/$PAYMENT_ID" "" 404 error
+TOKEN="$ALAN_TOKEN" expect GET "$B/payments/order/$ORDER_ID" "" 200 payments-by-order
+expect_count 0
+expect GET "$B/orders" "" 200 orders
+expect_count 2
+# Services only believe identities a gateway signed
+CALLER=cell-b/gateway TOKEN= expect GET "http://localhost:$ORDER_PORT/orders" "" 401 error
+CALLER=cell-b/gateway TOKEN= HEADER="X-Identity-User: $USER_ID" expect GET "http://localhost:$PAYMENT_PORT/payments" "" 401 error
+
+echo -e "\n${YELLOW}Service policy...${NC}"
+# Only order-service may reserve stock, not users, admins or gateway B
+expect PUT "$A/products/$PRODUCT_ID/stock" '{"quantity":1}' 403 error
+expect PUT "$B/products/$PRODUCT_ID/stock" '{"quantity":1}' 403 error
+CALLER=cell-b/payment-service expect PUT "$A/products/$PRODUCT_ID/stock" '{"quantity":1}' 403 error
+IDENTITY_SIGNING_KEY=forged-key CALLER=cell-b/order-service expect PUT "$A/products/$PRODUCT_ID/stock" '{"quantity":1}' 403 error
+CALLER=cell-b/order-service expect PUT "$A/products/$PRODUCT_ID/stock" '{"quantity":1}' 200 product
+# Caller signatures cover the body and work once
+CALLER=cell-b/order-service CALLER_SIGNED_BODY='{"quantity":1}' expect PUT "$A/products/$PRODUCT_ID/stock" '{"quantity":2}' 403 error
+REPLAYED_NONCE=$(openssl rand -hex 16)
+CALLER=cell-b/order-service CALLER_NONCE=$REPLAYED_NONCE expect PUT "$A/products/$PRODUCT_ID/stock" '{"quantity":1}' 200 product
+CALLER=cell-b/order-service CALLER_NONCE=$REPLAYED_NONCE expect PUT "$A/products/$PRODUCT_ID/stock" '{"quantity":1}' 403 error
+# Services only take calls from their own cell's gateway, and order-service
+# from payment-service too
+expect GET "http://localhost:$PRODUCT_PORT/products" "" 403 error
+CALLER=cell-b/gateway expect GET "http://localhost:$USER_PORT/users/$USER_ID" "" 403 error
+CALLER=cell-a/gateway expect GET "http://localhost:$PRODUCT_PORT/products/$PRODUCT_ID" "" 200 product
+CALLER=cell-b/payment-service expect GET "http://localhost:$ORDER_PORT/orders" "" 403 error
+
+echo -e "\n${YELLOW}Cross-cell signatures...${NC}"
+CELL=cell-b expect GET "$A/users/$USER_ID" "" 200 user
+CELL=cell-b expect PUT "$A/users/$USER_ID" '{"name":"Ada Lovelace"}' 200 user
+CELL=cell-b CELL_SIGNED_BODY='{"name":"Ada"}' expect PUT "$A/users/$USER_ID" '{"name":"Ada Lovelace"}' 401 error
+CELL=cell-b CELL_TIME=$(($(date +%s) - 120)) expect GET "$A/users/$USER_ID" "" 401 error
+# A signature works once, so a captured request cannot be replayed
+REPLAYED_NONCE=$(openssl rand -hex 16)
+CELL=cell-b CELL_NONCE=$REPLAYED_NONCE expect GET "$A/users/$USER_ID" "" 200 user
+CELL=cell-b CELL_NONCE=$REPLAYED_NONCE expect GET "$A/users/$USER_ID" "" 401 error
+CHECKS=$((CHECKS + 1))
+if CELL_SIGNING_KEYS= LOG_LEVEL=info PORT=$BAD_ROUTES_PORT timeout 10 "$WORK_DIR/cell-b-gateway" > "$WORK_DIR/gateway-no-keys.log" 2>&1; then
+    fail "Gateway started without CELL_SIGNING_KEYS outside dev mode"
+elif grep -q 'CELL_SIGNING_KEYS is not set' "$WORK_DIR/gateway-no-keys.log"; then
+    pass "Gateway refuses to start without CELL_SIGNING_KEYS outside dev mode"
+else
+    fail "Gateway without signing keys did not say why: $(tail -1 "$WORK_DIR/gateway-no-keys.log")"
+fi
+CELL=cell-b CELL_SIGNING_KEY=forged-key expect GET "$A/users/$USER_ID" "" 401 error
+CELL=cell-a expect GET "$A/users/$USER_ID" "" 401 error
+# Unsigned cell headers are dropped rather than believed
+HEADER="X-Source-Cell: cell-b" expect GET "$A/users/$USER_ID" "" 200 user
+# Each client Cell B forwards for has its own rate limit bucket
+PORT=$RATE_LIMITED_GATEWAY_PORT \
+USER_SERVICE_URL="http://localhost:$USER_PORT" \
+PRODUCT_SERVICE_URL="http://localhost:$PRODUCT_PORT" \
+CELL_B_GATEWAY_URL="http://localhost:$GATEWAY_B_PORT" \
+RATE_LIMIT_RPS=0.01 \
+RATE_LIMIT_BURST=1 \
+RATE_LIMIT_KEY=api-key \
+RATE_LIMIT_API_KEYS=issued-key \
+    "$WORK_DIR/cell-a-gateway" > "$WORK_DIR/gateway-rate-limited.log" 2>&1 &
+PIDS+=($!)
+wait_for "http://localhost:$RATE_LIMITED_GATEWAY_PORT/health"
+RL="http://localhost:$RATE_LIMITED_GATEWAY_PORT"
+CELL=cell-b CELL_CLIENT=203.0.113.1 expect GET "$RL/products/$PRODUCT_ID" "" 200 product
+CELL=cell-b CELL_CLIENT=203.0.113.1 expect GET "$RL/products/$PRODUCT_ID" "" 429 error
+CELL=cell-b CELL_CLIENT=203.0.113.2 expect GET "$RL/products/$PRODUCT_ID" "" 200 product
+HEADER="X-Cell-Client: 203.0.113.3" expect GET "$RL/products/$PRODUCT_ID" "" 200 product
+HEADER="X-Cell-Client: 203.0.113.4" expect GET "$RL/products/$PRODUCT_ID" "" 429 error
+# Only an issued API key gets a bucket of its own
+HEADER="X-API-Key: made-up-key" expect GET "$RL/products/$PRODUCT_ID" "" 429 error
+HEADER="X-API-Key: issued-key" expect GET "$RL/products/$PRODUCT_ID" "" 200 product
+HEADER="X-API-Key: issued-key" expect GET "$RL/products/$PRODUCT_ID" "" 429 error
+
+echo -e "\n${YELLOW}Request validation...${NC}"
+expect POST "$A/users" '{}' 400 invalid
+expect POST "$A/users" '{"name":"Ada","email":"not-an-email"}' 400 invalid
+expect POST "$A/users" '{"name":"Ada",' 400 invalid
+expect PUT "$A/users/$USER_ID" '{"email":"Ada <ada@example.com>"}' 400 invalid
+expect POST "$A/products" '{"name":"Widget","price":-1}' 400 invalid
+CALLER=cell-b/order-service expect PUT "$A/products/$PRODUCT_ID/stock" '{"quantity":0}' 400 invalid
+expect POST "$B/orders" "{\"user_id\":\"$USER_ID\",\"quantity\":1}" 400 invalid
+expect POST "$B/orders" "{\"user_id\":\"$USER_ID\",\"product_id\":\"$PRODUCT_ID\",\"quantity\":-2}" 400 invalid
+expect PUT "$B/orders/$ORDER_ID/status" '{"status":"lost"}' 400 invalid
+expect POST "$B/payments" "{\"order_id\":\"$ORDER_ID\",\"amount\":0,\"method\":\"card\"}" 400 invalid
+expect POST "$B/payments" "{\"order_id\":\"$ORDER_ID\",\"amount\":1,\"method\":\"bitcoin\"}" 400 invalid
+expect PUT "$A/users/$USER_ID" '{"name":"   "}' 400 invalid
+expect POST "$A/auth/register" '{"name":"Alan","email":"alan2@example.com","password":"short"}' 400 invalid
+expect POST "$A/auth/register" '{"name":"Alan","email":"alan2@example.com","password":"ééééééééééééééééééééééééééééééééééééééé"}' 400 invalid
+expect POST "$A/auth/login" '{"email":"alan@example.com"}' 400 invalid
+
+echo -e "\n${YELLOW}Errors...${NC}"
+expect GET "$A/no-such-route" "" 404 error
+expect DELETE "http://localhost:$USER_PORT/readiness" "" 405 error
+expect POST "$B/orders" "{\"user_id\":\"$USER_ID\",\"product_id\":\"missing\",\"quantity\":1}" 400 invalid
+expect POST "$B/orders" "{\"user_id\":\"missing\",\"product_id\":\"$PRODUCT_ID\",\"quantity\":1}" 400 invalid
+TOKEN= expect GET "http://localhost:$ORPHAN_GATEWAY_PORT/products" "" 503 upstream-error
+# Its JWKS comes through the dead gateway too, so no token can be checked
+expect GET "http://localhost:$ORPHAN_GATEWAY_PORT/orders" "" 503 upstream-error
+expect POST "http://localhost:$ORPHAN_PAYMENT_PORT/payments" "{\"order_id\":\"$ORDER_ID\",\"amount\":1,\"method\":\"card\"}" 503 upstream-error
+expect POST "http://localhost:$ORPHAN_ORDER_PORT/orders" "{\"user_id\":\"$USER_ID\",\"product_id\":\"$PRODUCT_ID\",\"quantity\":1}" 503 upstream-error
+
+echo -e "\n${YELLOW}Routing loops...${NC}"
+expect GET "http://localhost:$LOOP_GATEWAY_PORT/orders" "" 508 error
+HEADER="Via: 1.1 ingress, 1.1 edge, 1.1 cdn, 1.1 lb, 1.1 proxy" expect GET "$A/products" "" 508 error
+HEADER="Via: 1.1 ingress, 1.1 edge" expect GET "$B/products" "" 200 products
+CHECKS=$((CHECKS + 1))
+if LOG_LEVEL=info PORT=$BAD_ROUTES_PORT ORDER_SERVICE_URL="http://localhost:$GATEWAY_A_PORT" CELL_A_GATEWAY_URL="http://127.0.0.1:$GATEWAY_A_PORT" \
+    timeout 10 "$WORK_DIR/cell-b-gateway" > "$WORK_DIR/gateway-bad-routes.log" 2>&1; then
+    fail "Gateway started with order-service pointing at Cell A's gateway"
+elif grep -q '/orders loops: cell-b-gateway → cell-a-gateway → cell-b-gateway' "$WORK_DIR/gateway-bad-routes.log"; then
+    pass "Gateway refuses to start with order-service pointing at Cell A's gateway"
+else
+    fail "Gateway with looping routes did not report the loop: $(tail -1 "$WORK_DIR/gateway-bad-routes.log")"
+fi
+
+# Under the KEDA HTTP add-on every upstream URL is the interceptor's, which
+# routes by Host, so sharing an address is not a loop
+cat > "$WORK_DIR/host-router.py" <<EOF
+import urllib.error, urllib.request
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+
+ROUTES = {
+    "cell-a-user-service.local": "http://localhost:$USER_PORT",
+    "cell-a-product-service.local": "http://localhost:$PRODUCT_PORT",
+    "cell-b-gateway.local": "http://localhost:$GATEWAY_B_PORT",
+    "cell-a-gateway.local": "http://localhost:$GATEWAY_A_PORT",
+    "cell-b-order-service.local": "http://localhost:$ORDER_PORT",
+}
+
+class Handler(BaseHTTPRequestHandler):
+    def route(self):
+        target = ROUTES.get(self.headers.get("Host", ""))
+        if target is None:
+            self.send_response(404)
+            self.send_header("Content-Length", "0")
+            self.end_headers()
+            return
+        length = int(self.headers.get("Content-Length", 0))
+        req = urllib.request.Request(target + self.path, data=self.rfile.read(length) if length else None, method=self.command)
+        for key, value in self.headers.items():
+            if key.lower() not in ("host", "content-length", "connection"):
+                req.add_header(key, value)
+        try:
+            resp = urllib.request.urlopen(req)
+        except urllib.error.HTTPError as e:
+            resp = e
+        body = resp.read()
+        self.send_response(resp.status)
+        for key, value in resp.headers.items():
+            if key.lower() not in ("content-length", "connection", "transfer-encoding"):
+                self.send_header(key, value)
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    do_GET = do_POST = do_PUT = do_DELETE = route
+
+    def log_message(self, *args):
+        pass
+
+ThreadingHTTPServer(("127.0.0.1", $HOST_ROUTER_PORT), Handler).serve_forever()
+EOF
+python3 "$WORK_DIR/host-router.py" &
+PIDS+=($!)
+wait_for "http://localhost:$HOST_ROUTER_PORT/"
+INTERCEPTOR="http://127.0.0.1:$HOST_ROUTER_PORT"
+PORT=$SHARED_PROXY_GATEWAY_PORT \
+USER_SERVICE_URL="$INTERCEPTOR" USER_SERVICE_HOST=cell-a-user-service.local \
+PRODUCT_SERVICE_URL="$INTERCEPTOR" PRODUCT_SERVICE_HOST=cell-a-product-service.local \
+CELL_B_GATEWAY_URL="$INTERCEPTOR" CELL_B_GATEWAY_HOST=cell-b-gateway.local \
+    "$WORK_DIR/cell-a-gateway" > "$WORK_DIR/gateway-shared-proxy.log" 2>&1 &
+PIDS+=($!)
+wait_for "http://localhost:$SHARED_PROXY_GATEWAY_PORT/health"
+SP="http://localhost:$SHARED_PROXY_GATEWAY_PORT"
+expect GET "$SP/products/$PRODUCT_ID" "" 200 product
+expect GET "$SP/orders/$ORDER_ID" "" 200 order
+PORT=$SHARED_PROXY_ORDER_PORT \
+CELL_A_GATEWAY_URL="$INTERCEPTOR" CELL_A_GATEWAY_HOST=cell-a-gateway.local \
+READINESS_UPSTREAMS_CRITICAL=true \
+AUTH_ENABLED=false \
+SERVICE_AUTH_ENABLED=false \
+    "$WORK_DIR/cell-b-order-service" > "$WORK_DIR/order-shared-proxy.log" 2>&1 &
+PIDS+=($!)
+PORT=$SHARED_PROXY_PAYMENT_PORT \
+ORDER_SERVICE_URL="$INTERCEPTOR" ORDER_SERVICE_HOST=cell-b-order-service.local \
+READINESS_UPSTREAMS_CRITICAL=true \
+SERVICE_AUTH_ENABLED=false \
+    "$WORK_DIR/cell-b-payment-service" > "$WORK_DIR/payment-shared-proxy.log" 2>&1 &
+PIDS+=($!)
+for port in $SHARED_PROXY_ORDER_PORT $SHARED_PROXY_PAYMENT_PORT; do
+    wait_for "http://localhost:$port/health"
+    CHECKS=$((CHECKS + 1))
+    status=$(curl -s -o /dev/null -w '%{http_code}' "http://localhost:$port/readiness")
+    if [ "$status" = "200" ]; then
+        pass "Readiness on $port probes its upstream through the shared proxy"
+    else
+        fail "Readiness on $port returned $status through the shared proxy"
+    fi
+done
+SPO="http://localhost:$SHARED_PROXY_ORDER_PORT"
+expect POST "$SPO/orders" "{\"user_id\":\"$USER_ID\",\"product_id\":\"$PRODUCT_ID\",\"quantity\":1}" 201 order
+
+echo -e "\n${YELLOW}OpenAPI documents...${NC}"
+expect_spec "http://localhost:$USER_PORT/openapi.json" /users /users/{id} \
+    /auth/register /auth/login /auth/refresh /auth/logout /.well-known/jwks.json
+expect_spec "http://localhost:$PRODUCT_PORT/openapi.json" /products /products/{id} /products/{id}/stock
+expect_spec "http://localhost:$ORDER_PORT/openapi.json" /orders /orders/{id} /orders/{id}/status
+expect_spec "http://localhost:$PAYMENT_PORT/openapi.json" /payments /payments/{id} /payments/{id}/refund /payments/order/{order_id}
+for gateway in "$A" "$B"; do
+    expect_spec "$gateway/openapi.json" /users /users/{id} /auth/login /.well-known/jwks.json /products /products/{id} /products/{id}/stock \
+        /orders /orders/{id} /orders/{id}/status /payments /payments/{id} /payments/{id}/refund /payments/order/{order_id}
+done
+
+echo -e "\n${YELLOW}Deletes...${NC}"
+expect DELETE "$B/orders/$ORDER_ID" "" 200 message
+expect DELETE "$A/users/$USER_ID" "" 200 message
+expect DELETE "$A/users/$USER_ID" "" 404 error
+# Once order-service's cached copy expires, the deleted user cannot order
+sleep 1.1
+expect POST "$B/orders" "{\"user_id\":\"$USER_ID\",\"product_id\":\"$PRODUCT_ID\",\"quantity\":1}" 400 invalid
+expect DELETE "$A/products/$PRODUCT_ID" "" 200 message
+expect GET "$A/users?email=ada%40example.com" "" 200 users
+expect_count 0
+expect POST "$A/users" '{"name":"Ada","email":"ada@example.com"}' 201 user
+expect DELETE "$A/users/$ALAN_ID" "" 200 message
+expect POST "$A/auth/login" '{"email":"alan@example.com","password":"correct horse"}' 401 error
+
+echo ""
+if [ $FAILURES -eq 0 ]; then
+    echo -e "${GREEN}=== All $CHECKS contract checks passed (schema $SCHEMA_VERSION) ===${NC}"
+else
+    echo -e "${RED}=== $FAILURES of $CHECKS contract checks failed ===${NC}"
+    exit 1
+fi
@@ -0,0 +1,408 @@
+#!/usr/bin/env python3
+"""
+Fuzzes every create and update endpoint of both cells.
+
+Each case starts from a valid body and applies one or more mutations: a
+field removed, nulled, retyped, pushed past a bound, filled with blanks,
+control characters or very long text, or the whole body replaced with
+something that is not a JSON object. The fuzzer knows which mutations break
+a rule, and holds every response to these rules:
+
+  - no 5xx, ever
+  - a body known to break a rule gets a 4xx
+  - every response matches the shared types (checked with contract-check)
+  - anything the service accepted satisfies the validation rules
+
+Usage: fuzz-requests.py GATEWAY_A GATEWAY_B CONTRACT_CHECK [--seed N] [--iterations N]
+"""
+
+import argparse
+import json
+import random
+import subprocess
+import sys
+import urllib.error
+import urllib.request
+
+INVALID, VALID, UNKNOWN = "invalid", "valid", "unknown"
+
+PAYMENT_METHODS = ["card", "credit_card", "debit_card", "bank_transfer", "paypal", "wallet"]
+ORDER_STATUSES = ["pending", "paid", "completed", "cancelled"]
+
+
+class Field:
+    """The validation rules of one request field, mirrored from shared/openapi/schemas.go"""
+
+    def __init__(self, kind, required=False, minimum=None, maximum=None, exclusive_minimum=False,
+                 min_length=None, max_length=None, max_bytes=None, visible=False, email=False, enum=None,
+                 reference=False, checked=True):
+        self.kind = kind
+        self.required = required
+        self.minimum = minimum
+        self.maximum = maximum
+        self.exclusive_minimum = exclusive_minimum
+        self.min_length = min_length
+        self.max_length = max_length
+        # Passwords are also limited in UTF-8 bytes, which bcrypt hashes
+        self.max_bytes = max_bytes
+        self.visible = visible
+        self.email = email
+        self.enum = enum
+        self.reference = reference
+        # Whether the service rejects references to resources that do not exist
+        self.checked = checked
+
+    def mutations(self, rng, value):
+        """Yields (new value or REMOVE, expected outcome) pairs"""
+        yield REMOVE, INVALID if self.required else VALID
+        yield None, INVALID
+        yield [value], INVALID
+        yield {"value": value}, INVALID
+        yield True, INVALID
+
+        if self.kind in ("integer", "number"):
+            yield str(value), INVALID
+            low = self.minimum
+            if self.exclusive_minimum:
+                yield low, INVALID
+            else:
+                yield low, VALID
+                yield low - 1, INVALID
+            yield self.maximum, VALID
+            yield self.maximum + 1, INVALID
+            yield 1e308, INVALID
+            yield -1e308, INVALID
+            if self.kind == "integer":
+                yield low + 1.5, INVALID
+                yield 2 ** 63, INVALID
+            else:
+                yield round(rng.uniform(low, self.maximum), 2), VALID
+            return
+
+        yield rng.randint(-10, 10), INVALID
+        if self.enum:
+            yield rng.choice(self.enum), VALID
+            yield rng.choice(self.enum).upper(), INVALID
+            yield "", INVALID
+            yield "bitcoin", INVALID
+            return
+
+        yield "", INVALID if self.visible or self.email or self.min_length else VALID
+        if self.min_length:
+            yield "x" * (self.min_length - 1), INVALID
+            yield "x" * self.min_length, VALID
+        if self.max_bytes:
+            yield "é" * (self.max_bytes // 2), VALID
+            yield "é" * (self.max_bytes // 2 + 1), INVALID
+        if self.max_length:
+            yield "x" * self.max_length, UNKNOWN if self.email or self.reference else VALID
+            yield "x" * (self.max_length + 1), INVALID
+        if self.email:
+            yield FRESH_EMAIL, VALID
+            yield FRESH_EMAIL_UPPER, VALID
+            yield "not-an-email", INVALID
+            yield "Ada <ada@example.com>", INVALID
+            yield "ada@", INVALID
+            yield "@example.com", INVALID
+            yield "a b@example.com", INVALID
+            return
+        if self.visible:
+            yield "   ", INVALID
+            yield "\t\n", INVALID
+            yield "\u00a0\u2003", INVALID
+            yield "Ada\u0000", INVALID
+            yield "Ada\u001b[31m", INVALID
+            yield "Zoë 🚀 Ünïcödé", UNKNOWN if self.reference else VALID
+            yield "  padded  ", UNKNOWN if self.reference else VALID
+            yield "'; DROP TABLE users; --", UNKNOWN if self.reference else VALID
+            yield "<script>alert(1)</script>", UNKNOWN if self.reference else VALID
+        if self.reference:
+            missing = INVALID if self.checked else UNKNOWN
+            yield "does-not-exist", missing
+            yield "../../../etc/passwd", missing
+            yield "%00", missing
+        else:
+            low = self.min_length or 1
+            yield "".join(chr(rng.randint(0x20, 0x7e)) for _ in range(rng.randint(low, low + 40))), VALID
+
+    def accepts(self, value):
+        """Whether a value the service stored satisfies the rules"""
+        if self.kind in ("integer", "number"):
+            if not isinstance(value, (int, float)) or isinstance(value, bool):
+                return False
+            if self.exclusive_minimum and value <= self.minimum:
+                return False
+            return self.minimum <= value <= self.maximum
+        if not isinstance(value, str):
+            return False
+        if self.enum:
+            return value in self.enum
+        if self.max_length and len(value) > self.max_length:
+            return False
+        if self.min_length and len(value) < self.min_length:
+            return False
+        if self.max_bytes and len(value.encode()) > self.max_bytes:
+            return False
+        if self.visible:
+            if any(ord(c) < 0x20 or 0x7f <= ord(c) < 0xa0 for c in value):
+                return False
+            if not value.strip() or all(c.isspace() for c in value):
+                return False
+        if self.email:
+            local, _, domain = value.rpartition("@")
+            return bool(local) and bool(domain) and " " not in value and "<" not in value
+        return True
+
+
+REMOVE = object()
+# Emails must be unique, so valid ones are made up when the case is sent
+FRESH_EMAIL = object()
+FRESH_EMAIL_UPPER = object()
+
+NAME = Field("string", required=True, max_length=200, visible=True)
+EMAIL = Field("string", required=True, max_length=254, email=True)
+PASSWORD = Field("string", required=True, min_length=8, max_length=72, max_bytes=72)
+
+
+class Endpoint:
+    def __init__(self, name, method, url, fields, base, shape, stored=None):
+        self.name = name
+        self.method = method
+        self.url = url
+        self.fields = fields
+        self.base = base
+        self.shape = shape
+        # Which fields of the response data echo the request, for the
+        # accepted-means-valid check
+        self.stored = stored if stored is not None else list(fields)
+
+
+def optional(field):
+    copy = Field.__new__(Field)
+    copy.__dict__.update(field.__dict__)
+    copy.required = False
+    return copy
+
+
+class Fuzzer:
+    def __init__(self, gateway_a, gateway_b, contract_check, seed, iterations):
+        self.a = gateway_a
+        self.b = gateway_b
+        self.contract_check = contract_check
+        self.rng = random.Random(seed)
+        self.seed = seed
+        self.iterations = iterations
+        self.cases = 0
+        self.emails = 0
+        self.failures = []
+
+    def request(self, method, url, body):
+        if isinstance(body, bytes):
+            data = body
+        elif body is None:
+            data = None
+        else:
+            data = json.dumps(body).encode()
+        req = urllib.request.Request(url, data=data, method=method)
+        if data is not None:
+            req.add_header("Content-Type", "application/json")
+        try:
+            with urllib.request.urlopen(req, timeout=30) as resp:
+                return resp.status, resp.read()
+        except urllib.error.HTTPError as err:
+            return err.code, err.read()
+        except urllib.error.URLError as err:
+            # A gateway may answer 413 and close the connection before an
+            # oversized body has been sent in full
+            if isinstance(err.reason, (BrokenPipeError, ConnectionResetError)):
+                return None, b""
+            raise
+
+    def setup(self):
+        """Creates the resources the update endpoints act on"""
+        def create(url, body):
+            status, raw = self.request("POST", url, body)
+            if status != 201:
+                sys.exit(f"setup: POST {url} returned {status}: {raw[:200]!r}")
+            return json.loads(raw)["data"]["id"]
+
+        self.user_id = create(self.a + "/users", {"name": "Fuzz", "email": "fuzz@example.com"})
+        self.product_id = create(self.a + "/products", {"name": "Fuzz", "price": 1, "stock": 1000000})
+        self.order_id = create(self.b + "/orders", {"user_id": self.user_id, "product_id": self.product_id, "quantity": 1})
+
+    def endpoints(self):
+        reference = Field("string", required=True, max_length=64, visible=True, reference=True)
+        price = Field("number", required=True, minimum=0, maximum=1e6)
+        stock = Field("integer", minimum=0, maximum=1e6)
+        quantity = Field("integer", required=True, minimum=1, maximum=1000)
+        return [
+            Endpoint("create user", "POST", self.a + "/users",
+                     {"name": NAME, "email": EMAIL},
+                     {"name": "Ada", "email": FRESH_EMAIL}, "user"),
+            Endpoint("update user", "PUT", self.a + "/users/" + self.user_id,
+                     {"name": optional(NAME), "email": optional(EMAIL)},
+                     {"name": "Ada", "email": FRESH_EMAIL}, "user"),
+            Endpoint("register", "POST", self.a + "/auth/register",
+                     {"name": NAME, "email": EMAIL, "password": PASSWORD},
+                     {"name": "Ada", "email": FRESH_EMAIL, "password": "correct horse"}, "user",
+                     stored=["name", "email"]),
+            Endpoint("create product", "POST", self.a + "/products",
+                     {"name": NAME, "description": Field("string", max_length=2000), "price": price, "stock": stock},
+                     {"name": "Widget", "description": "A widget", "price": 9.99, "stock": 10}, "product"),
+            Endpoint("update product", "PUT", self.a + "/products/" + self.product_id,
+                     {"name": optional(NAME), "description": Field("string", max_length=2000),
+                      "price": optional(price), "stock": stock},
+                     {"name": "Widget", "price": 1, "stock": 1000000}, "product"),
+            Endpoint("reserve stock", "PUT", self.a + "/products/" + self.product_id + "/stock",
+                     {"quantity": Field("integer", required=True, minimum=1, maximum=1000)},
+                     {"quantity": 1}, "product", stored=[]),
+            Endpoint("create order", "POST", self.b + "/orders",
+                     {"user_id": reference, "product_id": reference, "quantity": quantity,
+                      "total": Field("number", minimum=0, maximum=1e9)},
+                     {"user_id": self.user_id, "product_id": self.product_id, "quantity": 1, "total": 1}, "order"),
+            Endpoint("update order status", "PUT", self.b + "/orders/" + self.order_id + "/status",
+                     {"status": Field("string", required=True, enum=ORDER_STATUSES)},
+                     {"status": "pending"}, "order"),
+            Endpoint("create payment", "POST", self.b + "/payments",
+                     {"order_id": reference,
+                      "amount": Field("number", required=True, minimum=0, maximum=1e9, exclusive_minimum=True),
+                      "method": Field("string", required=True, enum=PAYMENT_METHODS)},
+                     {"order_id": self.order_id, "amount": 1, "method": "card"}, "payment"),
+        ]
+
+    def run(self):
+        self.setup()
+        for endpoint in self.endpoints():
+            # Make sure the product never runs out of stock mid-run
+            self.request("PUT", self.a + "/products/" + self.product_id, {"stock": 1000000})
+            before = self.cases
+            for body, expected, label in self.cases_for(endpoint):
+                self.check(endpoint, body, expected, label)
+            print(f"  {endpoint.name}: {self.cases - before} cases")
+
+    def cases_for(self, endpoint):
+        yield dict(endpoint.base), VALID, "baseline"
+
+        # Whole-body mutations
+        yield b"", INVALID, "empty body"
+        yield b"{", INVALID, "truncated JSON"
+        yield b"null", INVALID, "null body"
+        yield b"[]", INVALID, "array body"
+        yield b"\"text\"", INVALID, "string body"
+        yield b"42", INVALID, "number body"
+        yield b"\xff\xfe", INVALID, "not UTF-8"
+        yield b"{" * 10000, INVALID, "deeply nested"
+        yield json.dumps({**self.resolve(endpoint.base), "padding": "x" * (2 << 20)}).encode(), INVALID, "oversized body"
+        yield {**endpoint.base, "unknown_field": {"nested": [1, 2, 3]}}, VALID, "unknown field"
+        yield {**endpoint.base, "id": "client-chosen", "cell_id": "cell-z"}, UNKNOWN, "service-assigned fields"
+
+        # One mutation per field
+        single = []
+        for name, field in endpoint.fields.items():
+            value = endpoint.base.get(name, self.sample(field))
+            for mutated, expected in field.mutations(self.rng, value):
+                single.append((name, mutated, expected))
+        for name, mutated, expected in single:
+            yield self.apply(endpoint.base, [(name, mutated)]), expected, f"{name}={self.show(mutated)}"
+
+        # Random combinations
+        for _ in range(self.iterations):
+            picks = self.rng.sample(single, min(len(single), self.rng.randint(2, 3)))
+            if len({name for name, _, _ in picks}) < len(picks):
+                continue
+            outcomes = {expected for _, _, expected in picks}
+            expected = INVALID if INVALID in outcomes else UNKNOWN if UNKNOWN in outcomes else VALID
+            label = ", ".join(f"{name}={self.show(mutated)}" for name, mutated, _ in picks)
+            yield self.apply(endpoint.base, [(name, mutated) for name, mutated, _ in picks]), expected, label
+
+    def sample(self, field):
+        if field.kind in ("integer", "number"):
+            return field.minimum + 1
+        if field.enum:
+            return field.enum[0]
+        return "sample"
+
+    @staticmethod
+    def apply(base, mutations):
+        body = dict(base)
+        for name, value in mutations:
+            if value is REMOVE:
+                body.pop(name, None)
+            else:
+                body[name] = value
+        return body
+
+    def resolve(self, value):
+        """Replaces the FRESH_EMAIL placeholders with addresses no user has yet"""
+        if value is FRESH_EMAIL or value is FRESH_EMAIL_UPPER:
+            self.emails += 1
+            email = f"fuzz-{self.seed}-{self.emails}@example.com"
+            return email.upper() if value is FRESH_EMAIL_UPPER else email
+        if isinstance(value, dict):
+            return {name: self.resolve(item) for name, item in value.items()}
+        if isinstance(value, list):
+            return [self.resolve(item) for item in value]
+        return value
+
+    @staticmethod
+    def show(value):
+        if value is REMOVE:
+            return "<removed>"
+        if value is FRESH_EMAIL or value is FRESH_EMAIL_UPPER:
+            return "<fresh email>"
+        text = json.dumps(value, default=lambda _: "<fresh email>")
+        return text if len(text) <= 40 else text[:37] + "..."
+
+    def check(self, endpoint, body, expected, label):
+        self.cases += 1
+        status, raw = self.request(endpoint.method, endpoint.url, self.resolve(body))
+        problems = []
+
+        if status is None:
+            if expected != INVALID:
+                self.failures.append(f"{endpoint.method} {endpoint.name} [{label}]: connection closed mid-request")
+            return
+        if status >= 500:
+            problems.append(f"returned {status}")
+        elif expected == INVALID and status < 400:
+            problems.append(f"accepted a body that breaks a rule ({status})")
+        elif expected == VALID and status >= 400:
+            problems.append(f"rejected a valid body ({status})")
+
+        shape = endpoint.shape if status < 400 else "invalid" if status == 400 and b'"invalid_request"' in raw and b'"details"' in raw else "error"
+        check = subprocess.run([self.contract_check, shape], input=raw, capture_output=True)
+        if check.returncode != 0:
+            problems.append("response diverges from the shared types: " + check.stdout.decode().strip().replace("\n", "; "))
+
+        if status < 400 and not problems:
+            data = json.loads(raw).get("data", {})
+            for name in endpoint.stored:
+                if name in data and not endpoint.fields[name].accepts(data[name]):
+                    problems.append(f"stored {name}={self.show(data[name])}, which breaks its rules")
+
+        if problems:
+            self.failures.append(f"{endpoint.method} {endpoint.name} [{label}]: {'; '.join(problems)}\n"
+                                 f"       response: {raw[:200]!r}")
+
+
+def main():
+    parser = argparse.ArgumentParser(description=__doc__, formatter_class=argparse.RawDescriptionHelpFormatter)
+    parser.add_argument("gateway_a")
+    parser.add_argument("gateway_b")
+    parser.add_argument("contract_check")
+    parser.add_argument("--seed", type=int, default=random.randrange(1 << 32))
+    parser.add_argument("--iterations", type=int, default=100, help="random combinations per endpoint")
+    args = parser.parse_args()
+
+    fuzzer = Fuzzer(args.gateway_a, args.gateway_b, args.contract_check, args.seed, args.iterations)
+    print(f"Fuzzing with seed {args.seed}")
+    fuzzer.run()
+
+    for failure in fuzzer.failures:
+        print("  ✗ " + failure)
+    print(f"{fuzzer.cases} cases, {len(fuzzer.failures)} failures (seed {args.seed})")
+    sys.exit(1 if fuzzer.failures else 0)
+
+
+if __name__ == "__main__":
+    main()
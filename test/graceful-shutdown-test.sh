@@ -0,0 +1,211 @@
+#!/bin/bash
+
+# Graceful Shutdown Test
+# Proves that SIGTERM does not drop requests: in-flight requests through a
+# gateway are drained, requests arriving during the drain delay are still
+# served while /readiness fails, and payments still processing in the
+# background complete before payment-service exits.
+
+set -e
+
+# Colors for output
+RED='\033[0;31m'
+GREEN='\033[0;32m'
+YELLOW='\033[1;33m'
+BLUE='\033[0;34m'
+NC='\033[0m' # No Color
+
+ROOT_DIR="$(cd "$(dirname "$0")/.." && pwd)"
+WORK_DIR="$(mktemp -d)"
+STUB_PORT=19021
+GATEWAY_PORT=19020
+PAYMENT_PORT=19022
+IN_FLIGHT=20
+DURING_DRAIN=10
+SLOW_SECONDS=3
+FAILURES=0
+
+PIDS=()
+cleanup() {
+    for pid in "${PIDS[@]}"; do
+        kill "$pid" 2>/dev/null || true
+    done
+    rm -rf "$WORK_DIR"
+}
+trap cleanup EXIT
+
+fail() {
+    echo -e "${RED}❌ $1${NC}"
+    FAILURES=$((FAILURES + 1))
+}
+
+pass() {
+    echo -e "${GREEN}✅ $1${NC}"
+}
+
+wait_for() {
+    local url=$1
+    for _ in $(seq 1 50); do
+        if curl -s -o /dev/null "$url"; then
+            return 0
+        fi
+        sleep 0.1
+    done
+    echo -e "${RED}Timed out waiting for $url${NC}"
+    exit 1
+}
+
+echo -e "${BLUE}=== Graceful Shutdown Test ===${NC}"
+
+echo -e "${YELLOW}Building binaries...${NC}"
+(cd "$ROOT_DIR/cell-b/gateway" && go build -o "$WORK_DIR/gateway" .)
+(cd "$ROOT_DIR/cell-b/payment-service" && go build -o "$WORK_DIR/payment-service" .)
+
+# Stub order-service: /orders/slow takes SLOW_SECONDS, status updates are recorded
+cat > "$WORK_DIR/stub.py" <<EOF
+import json, time
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+
+class Handler(BaseHTTPRequestHandler):
+    def reply(self, code=200):
+        body = json.dumps({"success": True, "cell_id": "cell-b"}).encode()
+        self.send_response(code)
+        self.send_header("Content-Type", "application/json")
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def do_GET(self):
+        if self.path == "/orders/slow":
+            time.sleep($SLOW_SECONDS)
+        self.reply()
+
+    def do_PUT(self):
+        length = int(self.headers.get("Content-Length", 0))
+        payload = self.rfile.read(length).decode()
+        with open("$WORK_DIR/status-updates.log", "a") as f:
+            f.write(self.path + " " + payload + "\n")
+        self.reply()
+
+    def log_message(self, *args):
+        pass
+
+ThreadingHTTPServer(("127.0.0.1", $STUB_PORT), Handler).serve_forever()
+EOF
+python3 "$WORK_DIR/stub.py" &
+PIDS+=($!)
+wait_for "http://localhost:$STUB_PORT/health"
+
+# --- Gateway: drain in-flight requests ---
+echo -e "\n${YELLOW}Testing gateway request draining...${NC}"
+PORT=$GATEWAY_PORT \
+ORDER_SERVICE_URL="http://localhost:$STUB_PORT" \
+HEALTH_CHECK_INTERVAL=0 \
+AUTH_ENABLED=false \
+DEV_MODE=true \
+SHUTDOWN_DRAIN_DELAY=2s \
+SHUTDOWN_TIMEOUT=10s \
+    "$WORK_DIR/gateway" > "$WORK_DIR/gateway.log" 2>&1 &
+GATEWAY_PID=$!
+PIDS+=($GATEWAY_PID)
+wait_for "http://localhost:$GATEWAY_PORT/health"
+curl -s -o /dev/null "http://localhost:$GATEWAY_PORT/orders"
+
+CLIENT_PIDS=()
+for i in $(seq 1 $IN_FLIGHT); do
+    curl -s -o /dev/null -w '%{http_code}' --max-time 30 \
+        "http://localhost:$GATEWAY_PORT/orders/slow" > "$WORK_DIR/inflight-$i.code" &
+    CLIENT_PIDS+=($!)
+done
+sleep 0.5
+
+kill -TERM $GATEWAY_PID
+sleep 0.3
+
+READINESS_CODE=$(curl -s -o /dev/null -w '%{http_code}' "http://localhost:$GATEWAY_PORT/readiness")
+if [ "$READINESS_CODE" = "503" ]; then
+    pass "Readiness fails while draining"
+else
+    fail "Readiness returned $READINESS_CODE while draining (expected 503)"
+fi
+
+for i in $(seq 1 $DURING_DRAIN); do
+    curl -s -o /dev/null -w '%{http_code}' --max-time 30 \
+        "http://localhost:$GATEWAY_PORT/orders" > "$WORK_DIR/drain-$i.code" &
+    CLIENT_PIDS+=($!)
+done
+
+set +e
+wait $GATEWAY_PID
+GATEWAY_EXIT=$?
+wait "${CLIENT_PIDS[@]}"
+set -e
+
+DROPPED=0
+for code_file in "$WORK_DIR"/inflight-*.code "$WORK_DIR"/drain-*.code; do
+    if [ "$(cat "$code_file")" != "200" ]; then
+        DROPPED=$((DROPPED + 1))
+    fi
+done
+
+if [ $DROPPED -eq 0 ]; then
+    pass "All $((IN_FLIGHT + DURING_DRAIN)) requests completed with 200 across shutdown"
+else
+    fail "$DROPPED of $((IN_FLIGHT + DURING_DRAIN)) requests were dropped during shutdown"
+fi
+
+if [ $GATEWAY_EXIT -eq 0 ]; then
+    pass "Gateway exited cleanly"
+else
+    fail "Gateway exited with status $GATEWAY_EXIT"
+    cat "$WORK_DIR/gateway.log"
+fi
+
+# --- Payment service: finish background work ---
+echo -e "\n${YELLOW}Testing payment-service background work completion...${NC}"
+PORT=$PAYMENT_PORT \
+ORDER_SERVICE_URL="http://localhost:$STUB_PORT" \
+AUTH_ENABLED=false \
+SERVICE_AUTH_ENABLED=false \
+DEV_MODE=true \
+SHUTDOWN_DRAIN_DELAY=100ms \
+SHUTDOWN_TIMEOUT=10s \
+    "$WORK_DIR/payment-service" > "$WORK_DIR/payment.log" 2>&1 &
+PAYMENT_PID=$!
+PIDS+=($PAYMENT_PID)
+wait_for "http://localhost:$PAYMENT_PORT/health"
+
+CREATE_CODE=$(curl -s -o /dev/null -w '%{http_code}' -X POST \
+    -H "Content-Type: application/json" \
+    -d '{"order_id":"order-1","amount":10,"method":"card"}' \
+    "http://localhost:$PAYMENT_PORT/payments")
+if [ "$CREATE_CODE" != "201" ]; then
+    fail "Payment creation returned $CREATE_CODE"
+fi
+
+kill -TERM $PAYMENT_PID
+set +e
+wait $PAYMENT_PID
+PAYMENT_EXIT=$?
+set -e
+
+if grep -q "/orders/order-1/status" "$WORK_DIR/status-updates.log" 2>/dev/null; then
+    pass "In-progress payment completed and updated its order before exit"
+else
+    fail "In-progress payment was abandoned during shutdown"
+    cat "$WORK_DIR/payment.log"
+fi
+
+if [ $PAYMENT_EXIT -eq 0 ]; then
+    pass "Payment service exited cleanly"
+else
+    fail "Payment service exited with status $PAYMENT_EXIT"
+fi
+
+echo ""
+if [ $FAILURES -eq 0 ]; then
+    echo -e "${GREEN}=== Graceful shutdown test passed ===${NC}"
+else
+    echo -e "${RED}=== Graceful shutdown test failed ($FAILURES failures) ===${NC}"
+    exit 1
+fi
@@ -32,6 +32,8 @@ const CELL_B_GATEWAY = 'http://10.96.48.68:8020';
 // Or using port-forward approach
 const CELL_A_URL = __ENV.CELL_A_URL || CELL_A_GATEWAY;
 const CELL_B_URL = __ENV.CELL_B_URL || CELL_B_GATEWAY;
+// Gateways require a token on most routes; pass an admin's as ACCESS_TOKEN
+const AUTH_HEADERS = __ENV.ACCESS_TOKEN ? { Authorization: `Bearer ${__ENV.ACCESS_TOKEN}` } : {};
 
 console.log(`Cell A URL: ${CELL_A_URL}`);
 console.log(`Cell B URL: ${CELL_B_URL}`);
@@ -43,11 +45,11 @@ export default function () {
   try {
     let userPayload = JSON.stringify({
       name: `testuser_${Math.random().toString(36).substring(7)}`,
-      email: `test_${Math.random().toString(36).substring(7)}@example.com`
+      email: `test_${__VU}_${__ITER}_${Math.random().toString(36).substring(7)}@example.com`
     });
 
     let userResponse = http.post(`${CELL_A_URL}/users`, userPayload, {
-      headers: { 'Content-Type': 'application/json' },
+      headers: Object.assign({ 'Content-Type': 'application/json' }, AUTH_HEADERS),
       timeout: '30s'
     });
 
@@ -77,7 +79,7 @@ export default function () {
     });
 
     let productResponse = http.post(`${CELL_A_URL}/products`, productPayload, {
-      headers: { 'Content-Type': 'application/json' },
+      headers: Object.assign({ 'Content-Type': 'application/json' }, AUTH_HEADERS),
       timeout: '30s'
     });
 
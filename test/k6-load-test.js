@@ -16,6 +16,8 @@ const CLUSTER_IP_B = __ENV.CELL_B_CLUSTER_IP || 'http://cell-b-gateway.cell-b.sv
 // Use cluster IPs if running inside cluster, otherwise use external URLs
 const CELL_A_URL = __ENV.USE_CLUSTER_IP === 'true' ? CLUSTER_IP_A : CELL_A_BASE_URL;
 const CELL_B_URL = __ENV.USE_CLUSTER_IP === 'true' ? CLUSTER_IP_B : CELL_B_BASE_URL;
+// Gateways require a token on most routes; pass an admin's as ACCESS_TOKEN
+const AUTH_HEADERS = __ENV.ACCESS_TOKEN ? { Authorization: `Bearer ${__ENV.ACCESS_TOKEN}` } : {};
 
 // Load test configuration
 export const options = {
@@ -40,7 +42,7 @@ function generateUser() {
   const userNum = Math.floor(Math.random() * 10000);
   return {
     name: `User${userNum}`,
-    email: `user${userNum}@example.com`
+    email: `user${userNum}_${__VU}_${__ITER}_${Date.now()}@example.com`
   };
 }
 
@@ -74,9 +76,9 @@ function generatePayment(orderId, amount) {
 // Helper function to make requests with error handling
 function makeRequest(method, url, payload = null, expectedStatus = 200) {
   const params = {
-    headers: {
+    headers: Object.assign({
       'Content-Type': 'application/json',
-    },
+    }, AUTH_HEADERS),
     timeout: '30s',
   };
 
@@ -169,9 +171,10 @@ function productManagementFlow() {
         // Get product by ID
         makeRequest('GET', `${CELL_A_URL}/products/${productId}`, null, 200);
         
-        // Update product stock
-        const stockUpdate = { stock: Math.floor(Math.random() * 50) + 10 };
-        makeRequest('PUT', `${CELL_A_URL}/products/${productId}/stock`, stockUpdate, 200);
+        // Restock; reserving stock is left to order-service, which alone
+        // may call the stock endpoint
+        makeRequest('PUT', `${CELL_A_URL}/products/${productId}`, { stock: Math.floor(Math.random() * 50) + 10 }, 200);
+        makeRequest('PUT', `${CELL_A_URL}/products/${productId}/stock`, { quantity: 1 }, 403);
         
         // Get all products
         makeRequest('GET', `${CELL_A_URL}/products`, null, 200);
@@ -17,6 +17,8 @@ const CLUSTER_IP_B = __ENV.CELL_B_CLUSTER_IP || 'http://cell-b-gateway.cell-b.sv
 // Use cluster IPs if running inside cluster
 const BASE_URL_A = __ENV.USE_CLUSTER_IP === 'true' ? CLUSTER_IP_A : CELL_A_URL;
 const BASE_URL_B = __ENV.USE_CLUSTER_IP === 'true' ? CLUSTER_IP_B : CELL_B_URL;
+// Gateways require a token on most routes; pass an admin's as ACCESS_TOKEN
+const AUTH_HEADERS = __ENV.ACCESS_TOKEN ? { Authorization: `Bearer ${__ENV.ACCESS_TOKEN}` } : {};
 
 // Scale-to-zero test configuration
 export const options = {
@@ -53,7 +55,7 @@ export const options = {
 
 function makeRequest(method, url, payload = null, expectedStatus = 200, timeout = '30s') {
   const params = {
-    headers: { 'Content-Type': 'application/json' },
+    headers: Object.assign({ 'Content-Type': 'application/json' }, AUTH_HEADERS),
     timeout: timeout,
   };
 
@@ -153,7 +155,7 @@ function spikeAfterIdleTest() {
     // Simulate sudden spike in traffic after idle period
     const user = {
       name: `SpikeUser${Date.now()}`,
-      email: `spike${Date.now()}@example.com`
+      email: `spike${__VU}_${__ITER}_${Date.now()}@example.com`
     };
     
     const { response, duration } = makeRequest('POST', `${BASE_URL_A}/users`, user, 201, '45s');
@@ -177,7 +179,7 @@ function warmupServices() {
     // Create some initial data
     const user = {
       name: `WarmupUser${Date.now()}`,
-      email: `warmup${Date.now()}@example.com`
+      email: `warmup${__VU}_${__ITER}_${Date.now()}@example.com`
     };
     
     const product = {
@@ -200,7 +202,7 @@ function generateActivity() {
     for (let i = 0; i < 3; i++) {
       const user = {
         name: `ActivityUser${Date.now()}_${i}`,
-        email: `activity${Date.now()}_${i}@example.com`
+        email: `activity${__VU}_${__ITER}_${Date.now()}_${i}@example.com`
       };
       makeRequest('POST', `${BASE_URL_A}/users`, user, 201);
       
@@ -237,7 +239,7 @@ function testColdStart() {
     // Test functional endpoint after scale up
     const user = {
       name: `ColdStartUser${Date.now()}`,
-      email: `coldstart${Date.now()}@example.com`
+      email: `coldstart${__VU}_${__ITER}_${Date.now()}@example.com`
     };
     
     const { response: userResponse, duration: userDuration } = makeRequest('POST', `${BASE_URL_A}/users`, user, 201, '45s');
@@ -260,7 +262,7 @@ function sustainedLoadTest() {
     for (let i = 0; i < 5; i++) {
       const user = {
         name: `SustainedUser${Date.now()}_${i}`,
-        email: `sustained${Date.now()}_${i}@example.com`
+        email: `sustained${__VU}_${__ITER}_${Date.now()}_${i}@example.com`
       };
       
       const { response } = makeRequest('POST', `${BASE_URL_A}/users`, user, 201);